@@ -10,10 +10,16 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
 	ginadapter "github.com/awslabs/aws-lambda-go-api-proxy/gin"
 	"github.com/evergarden0412/gptea-api/internal/auth"
 	"github.com/evergarden0412/gptea-api/internal/chatbot"
 	"github.com/evergarden0412/gptea-api/internal/config"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+	"github.com/evergarden0412/gptea-api/internal/jobs"
+	"github.com/evergarden0412/gptea-api/internal/moderation"
 	"github.com/evergarden0412/gptea-api/internal/postgres"
 	"github.com/evergarden0412/gptea-api/internal/server"
 	"github.com/gin-contrib/cors"
@@ -25,6 +31,9 @@ import (
 
 var ginLambda *ginadapter.GinLambda
 
+// localJobWorkers is how many messages are answered in the background at once when running locally
+const localJobWorkers = 4
+
 func main() {
 	ctx := context.Background()
 	cfg, err := config.Init(ctx)
@@ -48,15 +57,68 @@ func main() {
 	}
 	defer db.Close()
 	postgresDB := postgres.New(db)
-	openAIClient := openai.NewClientWithConfig(openai.DefaultConfig(
-		cfg.OpenAIAPIKey,
-	))
-	chatbot := chatbot.New(openAIClient)
-	s := server.New(a, chatbot, postgresDB)
+	if ok, err := postgresDB.UsePgvector(ctx); err != nil {
+		golog.Error("detect pgvector: ", err)
+	} else if !ok {
+		golog.Info("no pgvector, semantic search ranks in go")
+	}
+	var provider chatbot.Provider
+	var embedder embedding.Embedder
+	// the keyword moderator catches the obvious cheaply, before asking openai
+	mod := moderation.NewKeyword(moderation.DefaultKeywordRules)
+	switch cfg.LLMProvider {
+	case config.LLMProviderFake:
+		golog.Warn("no openai api key, chatbot replies are faked")
+		provider = chatbot.NewFake()
+		embedder = embedding.NewFake()
+	default:
+		openAIConfig := openai.DefaultConfig(cfg.OpenAIAPIKey)
+		openAIConfig.HTTPClient = chatbot.NewHTTPClient()
+		openAIClient := openai.NewClientWithConfig(openAIConfig)
+		resilience := chatbot.DefaultResilienceConfig
+		if os.Getenv("WORKER") == "true" {
+			resilience = chatbot.WorkerResilienceConfig
+		}
+		provider = chatbot.NewResilient(chatbot.NewOpenAI(openAIClient), resilience)
+		mod = moderation.Chain(mod, moderation.NewOpenAI(openAIClient))
+		embedder = embedding.NewOpenAI(openAIClient)
+	}
+	chatbot := chatbot.New(provider)
+	s := server.New(a, chatbot, postgresDB, server.Quota{
+		DailyMessages:   cfg.DailyMessageQuota,
+		DailyTokens:     cfg.DailyTokenQuota,
+		MonthlyMessages: cfg.MonthlyMessageQuota,
+		MonthlyTokens:   cfg.MonthlyTokenQuota,
+	}, mod)
+	chatbot.RegisterTools(s.Tools()...)
+	s.UseEmbedder(embedder)
+	idempotencyKeyTTL, err := time.ParseDuration(cfg.IdempotencyKeyTTL)
+	if err != nil {
+		golog.Fatal(err)
+	}
+	s.SetIdempotencyKeyTTL(idempotencyKeyTTL)
+	switch {
+	case os.Getenv("LOCAL") == "true":
+		s.UseJobQueue(jobs.NewLocal(s.RunJob, localJobWorkers))
+	case cfg.WorkerFunctionName != "":
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(cfg.Region)})
+		if err != nil {
+			golog.Fatal(err)
+		}
+		s.UseJobQueue(jobs.NewLambda(lambdaservice.New(sess), cfg.WorkerFunctionName))
+	}
+	if os.Getenv("WORKER") == "true" {
+		// the same binary answers messages in the background, see template.yaml
+		lambda.Start(func(ctx context.Context, event jobs.Event) error {
+			return s.RunJob(ctx, event.JobID)
+		})
+		return
+	}
 	r := gin.Default()
 	corsCfg := cors.DefaultConfig()
 	corsCfg.AllowOrigins = []string{"https://gptea.keenranger.dev", "https://gptea-test.keenranger.dev"}
-	corsCfg.AllowHeaders = []string{"origin", "content-length", "content-type", "authorization", "x-refresh-token"}
+	corsCfg.AllowHeaders = []string{"origin", "content-length", "content-type", "authorization", "x-refresh-token", "idempotency-key"}
+	corsCfg.ExposeHeaders = []string{"retry-after", "idempotent-replayed"}
 	r.Use(cors.New(corsCfg))
 	s.Install(r.Handle)
 	if os.Getenv("LOCAL") == "true" {
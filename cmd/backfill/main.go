@@ -0,0 +1,106 @@
+// Command backfill embeds the messages and scraps saved without an embedding, e.g. before semantic search
+// or while the embedding api was down. It is configured like the api, and safe to run again.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"github.com/evergarden0412/gptea-api/internal/config"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+	"github.com/evergarden0412/gptea-api/internal/postgres"
+	"github.com/kataras/golog"
+	_ "github.com/lib/pq"
+	"github.com/sashabaranov/go-openai"
+)
+
+func main() {
+	batch := flag.Int("batch", 100, "rows embedded per request to the embedding api")
+	flag.Parse()
+
+	ctx := context.Background()
+	cfg, err := config.Init(ctx)
+	if err != nil {
+		golog.Fatal(err)
+	}
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, "gptea"))
+	if err != nil {
+		golog.Fatal(err)
+	}
+	defer db.Close()
+	postgresDB := postgres.New(db)
+
+	var embedder embedding.Embedder
+	switch cfg.LLMProvider {
+	case config.LLMProviderFake:
+		golog.Warn("no openai api key, embeddings are faked")
+		embedder = embedding.NewFake()
+	default:
+		openAIConfig := openai.DefaultConfig(cfg.OpenAIAPIKey)
+		embedder = embedding.NewOpenAI(openai.NewClientWithConfig(openAIConfig))
+	}
+
+	messages, err := backfillMessages(ctx, postgresDB, embedder, *batch)
+	if err != nil {
+		golog.Fatal("backfill messages: ", err)
+	}
+	scraps, err := backfillScraps(ctx, postgresDB, embedder, *batch)
+	if err != nil {
+		golog.Fatal("backfill scraps: ", err)
+	}
+	golog.Infof("embedded %d messages and %d scraps with %s", messages, scraps, embedder.Model())
+}
+
+// backfillMessages embeds messages without an embedding of the model of embedder until there is none left.
+func backfillMessages(ctx context.Context, db *postgres.DB, embedder embedding.Embedder, batch int) (int, error) {
+	total := 0
+	for {
+		msgs, err := db.SelectMessagesWithoutEmbedding(ctx, embedder.Model(), batch)
+		if err != nil || len(msgs) == 0 {
+			return total, err
+		}
+		texts := make([]string, len(msgs))
+		for i, msg := range msgs {
+			texts[i] = embedding.MessageText(msg)
+		}
+		vectors, err := embedder.Embed(ctx, texts)
+		if err != nil {
+			return total, err
+		}
+		for i, msg := range msgs {
+			if err := db.UpsertMessageEmbedding(ctx, msg.ChatID, msg.Seq, embedder.Model(), vectors[i]); err != nil {
+				return total, err
+			}
+		}
+		total += len(msgs)
+		golog.Infof("embedded %d messages", total)
+	}
+}
+
+// backfillScraps is backfillMessages for scraps.
+func backfillScraps(ctx context.Context, db *postgres.DB, embedder embedding.Embedder, batch int) (int, error) {
+	total := 0
+	for {
+		scraps, err := db.SelectScrapsWithoutEmbedding(ctx, embedder.Model(), batch)
+		if err != nil || len(scraps) == 0 {
+			return total, err
+		}
+		texts := make([]string, len(scraps))
+		for i, scrap := range scraps {
+			texts[i] = embedding.ScrapText(scrap)
+		}
+		vectors, err := embedder.Embed(ctx, texts)
+		if err != nil {
+			return total, err
+		}
+		for i, scrap := range scraps {
+			if err := db.UpsertScrapEmbedding(ctx, scrap.ID, embedder.Model(), vectors[i]); err != nil {
+				return total, err
+			}
+		}
+		total += len(scraps)
+		golog.Infof("embedded %d scraps", total)
+	}
+}
@@ -1,3 +1,6 @@
+-- trigram matching for keyword search, the default text search parser handles korean poorly
+create extension if not exists pg_trgm;
+
 create table if not exists users(
     id text primary key,
     created_at timestamptz not null default now() 
@@ -21,18 +24,207 @@ create table if not exists chats(
     id text primary key,
     user_id text references users(id) on delete cascade not null,
     name text not null,
-    created_at timestamptz not null default now() 
+    created_at timestamptz not null default now(),
+    model text not null default 'gpt-3.5-turbo-0613',
+    temperature real not null default 1,
+    top_p real not null default 1,
+    max_tokens integer not null default 1000,
+    presence_penalty real not null default 0,
+    frequency_penalty real not null default 0,
+    system_prompt text not null default '',
+    -- ground replies in the scraps of the user
+    use_scraps boolean not null default false,
+    -- the last message of the active branch, 0 while the chat is empty
+    head_seq integer not null default 0
 );
 
+-- databases created before the columns above were added to the table get them here, the same for the tables below
+alter table chats add column if not exists model text not null default 'gpt-3.5-turbo-0613';
+alter table chats add column if not exists temperature real not null default 1;
+alter table chats add column if not exists top_p real not null default 1;
+alter table chats add column if not exists max_tokens integer not null default 1000;
+alter table chats add column if not exists presence_penalty real not null default 0;
+alter table chats add column if not exists frequency_penalty real not null default 0;
+alter table chats add column if not exists system_prompt text not null default '';
+alter table chats add column if not exists use_scraps boolean not null default false;
+do $$
+begin
+    if not exists (select 1 from information_schema.columns where table_name = 'chats' and column_name = 'head_seq') then
+        alter table chats add column head_seq integer not null default 0;
+        -- chats from before branching are a single branch ending with their last message
+        update chats c set head_seq = (select coalesce(max(seq), 0) from messages m where m.chat_id = c.id);
+    end if;
+end $$;
+
+create index if not exists chats_name_fts_idx on chats using gin (to_tsvector('simple', name));
+create index if not exists chats_name_trgm_idx on chats using gin (name gin_trgm_ops);
+
 create table if not exists messages(
     chat_id text references chats(id) on delete cascade not null,
     seq integer not null,
     content text not null,
     role text not null,
+    -- the tool of a function_call or function message, the arguments or the result being its content
+    name text not null default '',
     created_at timestamptz not null default now(), 
-    unique (chat_id, seq)
+    version integer not null default 1,
+    -- the message this one follows, null for the first message of the chat
+    parent_seq integer,
+    -- how an assistant message was generated, empty for user messages
+    model text not null default '',
+    finish_reason text not null default '',
+    prompt_tokens integer not null default 0,
+    completion_tokens integer not null default 0,
+    -- the scraps of the user an assistant message cites
+    citations text[] not null default '{}',
+    -- the prompt template the content of a user message was rendered from, empty if written as is
+    template_id text not null default '',
+    unique (chat_id, seq),
+    foreign key (chat_id, parent_seq) references messages(chat_id, seq) on delete cascade
 );
 
+alter table messages add column if not exists name text not null default '';
+alter table messages add column if not exists version integer not null default 1;
+do $$
+begin
+    if not exists (select 1 from information_schema.columns where table_name = 'messages' and column_name = 'parent_seq') then
+        alter table messages add column parent_seq integer;
+        -- messages from before branching follow the one before them
+        update messages set parent_seq = seq - 1 where seq > 1;
+    end if;
+end $$;
+alter table messages add column if not exists model text not null default '';
+alter table messages add column if not exists finish_reason text not null default '';
+alter table messages add column if not exists prompt_tokens integer not null default 0;
+alter table messages add column if not exists completion_tokens integer not null default 0;
+alter table messages add column if not exists citations text[] not null default '{}';
+alter table messages add column if not exists template_id text not null default '';
+do $$
+begin
+    alter table messages add constraint messages_chat_id_parent_seq_fkey
+        foreign key (chat_id, parent_seq) references messages(chat_id, seq) on delete cascade;
+exception
+    when duplicate_object then null;
+end $$;
+
+create index if not exists messages_parent_idx on messages(chat_id, parent_seq);
+
+-- keyword search, see postgres.SearchMine
+create index if not exists messages_content_fts_idx on messages using gin (to_tsvector('simple', content));
+create index if not exists messages_content_trgm_idx on messages using gin (content gin_trgm_ops);
+
+create table if not exists message_versions(
+    chat_id text not null,
+    seq integer not null,
+    version integer not null,
+    content text not null,
+    created_at timestamptz not null default now(),
+    model text not null default '',
+    finish_reason text not null default '',
+    prompt_tokens integer not null default 0,
+    completion_tokens integer not null default 0,
+    citations text[] not null default '{}',
+    foreign key (chat_id, seq) references messages(chat_id, seq) on delete cascade,
+    primary key (chat_id, seq, version)
+);
+
+alter table message_versions add column if not exists model text not null default '';
+alter table message_versions add column if not exists finish_reason text not null default '';
+alter table message_versions add column if not exists prompt_tokens integer not null default 0;
+alter table message_versions add column if not exists completion_tokens integer not null default 0;
+alter table message_versions add column if not exists citations text[] not null default '{}';
+
+-- every generated message rolled up per user per day, in utc
+create table if not exists usages(
+    user_id text references users(id) on delete cascade not null,
+    day date not null,
+    messages integer not null default 0,
+    prompt_tokens integer not null default 0,
+    completion_tokens integer not null default 0,
+    primary key (user_id, day)
+);
+
+-- every decision of moderation, on what users sent (input) and what the chatbot replied (output)
+create table if not exists moderation_audits(
+    id bigserial primary key,
+    user_id text references users(id) on delete cascade not null,
+    chat_id text not null,
+    -- null for input, which is checked before it gets a seq
+    seq integer,
+    stage text not null,
+    flagged boolean not null,
+    categories text[] not null default '{}',
+    moderator text not null,
+    -- what was flagged, empty if it was let through
+    content text not null,
+    created_at timestamptz not null default now()
+);
+
+create table if not exists chat_summaries(
+    chat_id text references chats(id) on delete cascade not null,
+    last_seq integer not null,
+    content text not null,
+    created_at timestamptz not null default now(),
+    primary key (chat_id, last_seq)
+);
+
+-- replies generated in the background, see internal.Job
+create table if not exists jobs(
+    id text primary key,
+    user_id text references users(id) on delete cascade not null,
+    chat_id text references chats(id) on delete cascade not null,
+    -- the user message to answer
+    seq integer not null,
+    -- pending, running, done or failed
+    status text not null,
+    reply_seq integer,
+    error text not null default '',
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+create index if not exists jobs_chat_idx on jobs(chat_id, status);
+
+-- completions running for a chat, so that another request can cancel them
+create table if not exists generations(
+    id text primary key,
+    chat_id text references chats(id) on delete cascade not null,
+    cancelled boolean not null default false,
+    started_at timestamptz not null default now(),
+    finished_at timestamptz
+);
+
+create index if not exists generations_chat_idx on generations(chat_id) where finished_at is null;
+
+-- requests made with an Idempotency-Key and their responses, kept until expires_at, see internal.IdempotentRequest
+create table if not exists idempotent_requests(
+    user_id text references users(id) on delete cascade not null,
+    key text not null,
+    request_hash text not null,
+    -- running or done
+    status text not null,
+    response_status integer not null default 0,
+    response_content_type text not null default '',
+    response_location text not null default '',
+    response_body bytea,
+    created_at timestamptz not null default now(),
+    expires_at timestamptz not null,
+    primary key (user_id, key)
+);
+
+-- prompt templates of users, the built-in ones live in code
+create table if not exists prompt_templates(
+    id text primary key,
+    user_id text references users(id) on delete cascade not null,
+    name text not null,
+    content text not null,
+    -- [{"name": "topic", "required": true, "default": ""}]
+    variables jsonb not null default '[]',
+    created_at timestamptz not null default now()
+);
+
+create index if not exists prompt_templates_user_idx on prompt_templates(user_id);
+
 create table if not exists scrapbooks(
     id text primary key,
     user_id text references users(id) on delete cascade not null,
@@ -51,9 +243,30 @@ create table if not exists scraps(
     unique(message_chat_id, message_seq)
 );
 
+create index if not exists scraps_memo_fts_idx on scraps using gin (to_tsvector('simple', memo));
+create index if not exists scraps_memo_trgm_idx on scraps using gin (memo gin_trgm_ops);
+
 create table if not exists scraps_scrapbooks(
     scrap_id text references scraps(id) on delete cascade not null,
     scrapbook_id text references scrapbooks(id) on delete cascade not null,
     created_at timestamptz not null default now(),
     primary key (scrap_id, scrapbook_id)
-);
\ No newline at end of file
+);
+-- embeddings for semantic search, as real[] so that pgvector is optional, see pgvector.sql
+create table if not exists message_embeddings(
+    chat_id text not null,
+    seq integer not null,
+    -- the embedding model, vectors of different models don't compare
+    model text not null,
+    embedding real[] not null,
+    created_at timestamptz not null default now(),
+    foreign key (chat_id, seq) references messages(chat_id, seq) on delete cascade,
+    primary key (chat_id, seq)
+);
+
+create table if not exists scrap_embeddings(
+    scrap_id text references scraps(id) on delete cascade primary key,
+    model text not null,
+    embedding real[] not null,
+    created_at timestamptz not null default now()
+);
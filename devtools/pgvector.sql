@@ -0,0 +1,5 @@
+-- optional, run after db.sql where the pgvector extension is available.
+-- semantic search then ranks in postgres instead of loading every embedding of the user into the api.
+-- there is no ann index: search is filtered by user, which an approximate index would apply after the fact,
+-- losing results of users with few rows. the exact scan over the rows of one user is fast enough.
+create extension if not exists vector;
@@ -0,0 +1,94 @@
+// Package apperror is the errors the api tells clients about: a stable code for programs to branch on,
+// with the http status and a message for people that go with it, see Status and Message.
+// What caused an error is kept for the logs and never shown to clients, it may be database text.
+package apperror
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Error is a failure with a code clients can rely on.
+type Error struct {
+	Code Code
+	// Detail says what was wrong with a request, shown to clients next to the message.
+	// Only text of our own goes here, e.g. why a field failed validation.
+	Detail string
+	err    error
+}
+
+// New returns an error with code. Errors are equal under errors.Is if they have the same code,
+// so New can be used for sentinel errors.
+func New(code Code) *Error {
+	return &Error{Code: code}
+}
+
+// Wrap returns an error with code caused by err.
+func Wrap(code Code, err error) *Error {
+	return &Error{Code: code, err: err}
+}
+
+// Invalid returns an invalid_request error telling what was wrong with the request, err being ours to show.
+func Invalid(err error) *Error {
+	return &Error{Code: CodeInvalidRequest, Detail: err.Error(), err: err}
+}
+
+func (e *Error) Error() string {
+	if e.err != nil {
+		return string(e.Code) + ": " + e.err.Error()
+	}
+	return string(e.Code)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Is reports whether err has code.
+func Is(err error, code Code) bool {
+	return CodeOf(err) == code
+}
+
+// CodeOf returns the code of err. Errors of postgres without one get the code of what went wrong:
+// a missing row or reference is not_found, a duplicate conflict and a violated check forbidden.
+// Anything else is internal.
+func CodeOf(err error) Code {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "foreign_key_violation":
+			return CodeNotFound
+		case "unique_violation", "exclusion_violation", "restrict_violation":
+			return CodeConflict
+		case "check_violation", "insufficient_privilege":
+			return CodeForbidden
+		case "not_null_violation", "string_data_right_truncation", "invalid_text_representation":
+			return CodeInvalidRequest
+		}
+		return CodeInternal
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return CodeNotFound
+	}
+	return CodeInternal
+}
+
+// DetailOf returns the detail of err, empty if it has none.
+func DetailOf(err error) string {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr.Detail
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package apperror
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Code identifies an error for clients. Codes don't change once published, messages may.
+type Code string
+
+const (
+	CodeInvalidRequest  Code = "invalid_request"
+	CodeUnauthenticated Code = "unauthenticated"
+	CodeForbidden       Code = "forbidden"
+	CodeNotFound        Code = "not_found"
+	CodeConflict        Code = "conflict"
+	CodeInternal        Code = "internal"
+	CodeUnavailable     Code = "unavailable"
+
+	CodeTokenMissing                Code = "token_missing"
+	CodeTokenInvalid                Code = "token_invalid"
+	CodeRefreshTokenRevoked         Code = "refresh_token_revoked"
+	CodeCredentialUnsupported       Code = "credential_unsupported"
+	CodeCredentialInvalid           Code = "credential_invalid"
+	CodeCredentialNotRegistered     Code = "credential_not_registered"
+	CodeCredentialAlreadyRegistered Code = "credential_already_registered"
+
+	CodeChatNotFound              Code = "chat_not_found"
+	CodeChatBusy                  Code = "chat_busy"
+	CodeChatHasNoReply            Code = "chat_has_no_reply"
+	CodeSummaryNotFound           Code = "summary_not_found"
+	CodeMessageNotFound           Code = "message_not_found"
+	CodeMessageNotEditable        Code = "message_not_editable"
+	CodeMessageNotRegenerable     Code = "message_not_regenerable"
+	CodeMessageVersionNotFound    Code = "message_version_not_found"
+	CodeMessageContentOrTemplate  Code = "message_content_or_template"
+	CodeMessageFlagged            Code = "message_flagged"
+	CodeReplyWithheld             Code = "reply_withheld"
+	CodePromptTooLong             Code = "prompt_too_long"
+	CodeGenerationNotFound        Code = "generation_not_found"
+	CodeGenerationCancelled       Code = "generation_cancelled"
+	CodeChatbotUnavailable        Code = "chatbot_unavailable"
+	CodeJobNotFound               Code = "job_not_found"
+	CodeJobTimedOut               Code = "job_timed_out"
+	CodeQuotaExceeded             Code = "quota_exceeded"
+	CodeScrapbookNotFound         Code = "scrapbook_not_found"
+	CodeScrapbookDefaultImmutable Code = "scrapbook_default_immutable"
+	CodeScrapNotFound             Code = "scrap_not_found"
+	CodeScrapAlreadyOnScrapbook   Code = "scrap_already_on_scrapbook"
+	CodeTemplateNotFound          Code = "template_not_found"
+	CodeTemplateBuiltInImmutable  Code = "template_built_in_immutable"
+	CodeTemplateVariablesMissing  Code = "template_variables_missing"
+	CodeBadCursor                 Code = "bad_cursor"
+	CodeBadPageLimit              Code = "bad_page_limit"
+	CodeBadPageDirection          Code = "bad_page_direction"
+	CodeSearchQueryEmpty          Code = "search_query_empty"
+	CodeSemanticSearchDisabled    Code = "semantic_search_disabled"
+	CodeIdempotencyKeyTooLong     Code = "idempotency_key_too_long"
+	CodeIdempotencyKeyReused      Code = "idempotency_key_reused"
+	CodeIdempotentRequestRunning  Code = "idempotent_request_running"
+)
+
+const (
+	LangEnglish = "en"
+	LangKorean  = "ko"
+)
+
+type definition struct {
+	status int
+	// messages by language, English being there for every code
+	messages map[string]string
+}
+
+var definitions = map[Code]definition{
+	CodeInvalidRequest:  {http.StatusBadRequest, msgs("The request is invalid.", "요청이 올바르지 않습니다.")},
+	CodeUnauthenticated: {http.StatusUnauthorized, msgs("Sign in to continue.", "로그인이 필요합니다.")},
+	CodeForbidden:       {http.StatusForbidden, msgs("This is not allowed.", "허용되지 않는 작업입니다.")},
+	CodeNotFound:        {http.StatusNotFound, msgs("It was not found.", "찾을 수 없습니다.")},
+	CodeConflict:        {http.StatusConflict, msgs("It exists already.", "이미 존재합니다.")},
+	CodeInternal:        {http.StatusInternalServerError, msgs("Something went wrong, please try again.", "문제가 발생했습니다. 다시 시도해 주세요.")},
+	CodeUnavailable:     {http.StatusServiceUnavailable, msgs("The service is unavailable, please try again later.", "서비스를 일시적으로 사용할 수 없습니다. 잠시 후 다시 시도해 주세요.")},
+
+	CodeTokenMissing:                {http.StatusUnauthorized, msgs("An access token is required.", "액세스 토큰이 필요합니다.")},
+	CodeTokenInvalid:                {http.StatusUnauthorized, msgs("The token is invalid or expired.", "토큰이 올바르지 않거나 만료되었습니다.")},
+	CodeRefreshTokenRevoked:         {http.StatusUnauthorized, msgs("The refresh token was revoked, sign in again.", "리프레시 토큰이 만료되었습니다. 다시 로그인해 주세요.")},
+	CodeCredentialUnsupported:       {http.StatusBadRequest, msgs("The credential provider is not supported.", "지원하지 않는 로그인 방식입니다.")},
+	CodeCredentialInvalid:           {http.StatusUnauthorized, msgs("The credential could not be verified.", "로그인 정보를 확인할 수 없습니다.")},
+	CodeCredentialNotRegistered:     {http.StatusNotFound, msgs("No account is registered with the credential.", "가입되지 않은 계정입니다.")},
+	CodeCredentialAlreadyRegistered: {http.StatusConflict, msgs("An account is registered with the credential already.", "이미 가입된 계정입니다.")},
+
+	CodeChatNotFound:              {http.StatusNotFound, msgs("The chat was not found.", "채팅을 찾을 수 없습니다.")},
+	CodeChatBusy:                  {http.StatusConflict, msgs("The chat is still answering the previous message.", "채팅이 아직 이전 메시지에 답하고 있습니다.")},
+	CodeChatHasNoReply:            {http.StatusBadRequest, msgs("The chat has no reply to name it after yet.", "채팅에 아직 제목을 지을 답변이 없습니다.")},
+	CodeSummaryNotFound:           {http.StatusNotFound, msgs("The chat has no summary yet.", "채팅에 아직 요약이 없습니다.")},
+	CodeMessageNotFound:           {http.StatusNotFound, msgs("The message was not found.", "메시지를 찾을 수 없습니다.")},
+	CodeMessageNotEditable:        {http.StatusBadRequest, msgs("Only a user message can be edited.", "사용자 메시지만 수정할 수 있습니다.")},
+	CodeMessageNotRegenerable:     {http.StatusBadRequest, msgs("Only a reply to a user message or a tool result can be regenerated.", "사용자 메시지나 도구 결과에 대한 답변만 다시 생성할 수 있습니다.")},
+	CodeMessageVersionNotFound:    {http.StatusNotFound, msgs("The message version was not found.", "메시지 버전을 찾을 수 없습니다.")},
+	CodeMessageContentOrTemplate:  {http.StatusBadRequest, msgs("Either content or templateID is required, not both.", "content와 templateID 중 하나만 보내 주세요.")},
+	CodeMessageFlagged:            {http.StatusUnprocessableEntity, msgs("The message was flagged by moderation.", "메시지가 검토 기준에 맞지 않습니다.")},
+	CodeReplyWithheld:             {http.StatusUnprocessableEntity, msgs("This reply is withheld under the content policy.", "콘텐츠 정책에 따라 이 답변은 표시되지 않습니다.")},
+	CodePromptTooLong:             {http.StatusBadRequest, msgs("The message is too long for the model.", "메시지가 모델이 처리하기에 너무 깁니다.")},
+	CodeGenerationNotFound:        {http.StatusNotFound, msgs("No reply is being generated in the chat.", "채팅에서 생성 중인 답변이 없습니다.")},
+	CodeGenerationCancelled:       {http.StatusConflict, msgs("The reply was cancelled.", "답변 생성이 취소되었습니다.")},
+	CodeChatbotUnavailable:        {http.StatusServiceUnavailable, msgs("The chatbot is unavailable, please try again later.", "챗봇을 일시적으로 사용할 수 없습니다. 잠시 후 다시 시도해 주세요.")},
+	CodeJobNotFound:               {http.StatusNotFound, msgs("The job was not found.", "작업을 찾을 수 없습니다.")},
+	CodeJobTimedOut:               {http.StatusGatewayTimeout, msgs("The reply took too long.", "답변 생성 시간이 초과되었습니다.")},
+	CodeQuotaExceeded:             {http.StatusTooManyRequests, msgs("The usage quota is exceeded.", "사용량 한도를 초과했습니다.")},
+	CodeScrapbookNotFound:         {http.StatusNotFound, msgs("The scrapbook was not found.", "스크랩북을 찾을 수 없습니다.")},
+	CodeScrapbookDefaultImmutable: {http.StatusForbidden, msgs("The default scrapbook can't be renamed or deleted.", "기본 스크랩북은 이름을 바꾸거나 삭제할 수 없습니다.")},
+	CodeScrapNotFound:             {http.StatusNotFound, msgs("The scrap was not found.", "스크랩을 찾을 수 없습니다.")},
+	CodeScrapAlreadyOnScrapbook:   {http.StatusConflict, msgs("The scrap is on the scrapbook already.", "이미 스크랩북에 있는 스크랩입니다.")},
+	CodeTemplateNotFound:          {http.StatusNotFound, msgs("The template was not found.", "템플릿을 찾을 수 없습니다.")},
+	CodeTemplateBuiltInImmutable:  {http.StatusForbidden, msgs("Built-in templates can't be changed.", "기본 제공 템플릿은 바꿀 수 없습니다.")},
+	CodeTemplateVariablesMissing:  {http.StatusBadRequest, msgs("Some variables of the template are missing.", "템플릿 변수가 빠져 있습니다.")},
+	CodeBadCursor:                 {http.StatusBadRequest, msgs("The cursor is invalid.", "커서가 올바르지 않습니다.")},
+	CodeBadPageLimit:              {http.StatusBadRequest, msgs("The limit is out of range.", "limit 값이 허용 범위를 벗어났습니다.")},
+	CodeBadPageDirection:          {http.StatusBadRequest, msgs("The direction has to be next or prev.", "direction은 next 또는 prev여야 합니다.")},
+	CodeSearchQueryEmpty:          {http.StatusBadRequest, msgs("The search query is empty.", "검색어가 비어 있습니다.")},
+	CodeSemanticSearchDisabled:    {http.StatusNotImplemented, msgs("Semantic search is not enabled.", "의미 검색이 활성화되어 있지 않습니다.")},
+	CodeIdempotencyKeyTooLong:     {http.StatusBadRequest, msgs("The Idempotency-Key is longer than 255 characters.", "Idempotency-Key가 255자보다 깁니다.")},
+	CodeIdempotencyKeyReused:      {http.StatusConflict, msgs("The Idempotency-Key was used for another request.", "Idempotency-Key가 다른 요청에 이미 사용되었습니다.")},
+	CodeIdempotentRequestRunning:  {http.StatusConflict, msgs("The request with the Idempotency-Key is still running.", "같은 Idempotency-Key의 요청이 아직 처리 중입니다.")},
+}
+
+func msgs(en, ko string) map[string]string {
+	return map[string]string{LangEnglish: en, LangKorean: ko}
+}
+
+// Status returns the http status for code, 500 for an unknown one.
+func Status(code Code) int {
+	if def, ok := definitions[code]; ok {
+		return def.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Message returns the message for code in lang, in English if there is none in lang.
+func Message(code Code, lang string) string {
+	def, ok := definitions[code]
+	if !ok {
+		def = definitions[CodeInternal]
+	}
+	if msg, ok := def.messages[lang]; ok {
+		return msg
+	}
+	return def.messages[LangEnglish]
+}
+
+// Lang returns the language of messages for an Accept-Language header,
+// the first one it lists that there are messages in, English if none.
+func Lang(acceptLanguage string) string {
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ = strings.Cut(tag, ";")
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), "-")
+		switch lang := strings.ToLower(tag); lang {
+		case LangEnglish, LangKorean:
+			return lang
+		}
+	}
+	return LangEnglish
+}
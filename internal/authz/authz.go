@@ -0,0 +1,112 @@
+// Package authz decides whether a user may act on a resource.
+// A resource the user may not act on is reported missing, the same as one that doesn't exist,
+// so that the ids of other users don't leak.
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+type Kind string
+
+const (
+	KindChat      Kind = "chat"
+	KindMessage   Kind = "message"
+	KindScrap     Kind = "scrap"
+	KindScrapbook Kind = "scrapbook"
+	KindTemplate  Kind = "template"
+)
+
+// notFound is the code for a resource of each kind the user may not act on.
+var notFound = map[Kind]apperror.Code{
+	KindChat:      apperror.CodeChatNotFound,
+	KindMessage:   apperror.CodeMessageNotFound,
+	KindScrap:     apperror.CodeScrapNotFound,
+	KindScrapbook: apperror.CodeScrapbookNotFound,
+	KindTemplate:  apperror.CodeTemplateNotFound,
+}
+
+type Action string
+
+const (
+	ActionRead  Action = "read"
+	ActionWrite Action = "write"
+)
+
+// Resource is something a user may own. A message is the one at Seq in the chat ID.
+type Resource struct {
+	Kind Kind
+	ID   string
+	Seq  int
+}
+
+func Chat(id string) Resource {
+	return Resource{Kind: KindChat, ID: id}
+}
+
+func Message(chatID string, seq int) Resource {
+	return Resource{Kind: KindMessage, ID: chatID, Seq: seq}
+}
+
+func Scrap(id string) Resource {
+	return Resource{Kind: KindScrap, ID: id}
+}
+
+func Scrapbook(id string) Resource {
+	return Resource{Kind: KindScrapbook, ID: id}
+}
+
+func Template(id string) Resource {
+	return Resource{Kind: KindTemplate, ID: id}
+}
+
+// Owners tells who owns a resource, returning sql.ErrNoRows if it doesn't exist.
+type Owners interface {
+	SelectOwner(ctx context.Context, r Resource) (string, error)
+}
+
+type Authorizer struct {
+	owners Owners
+}
+
+func New(owners Owners) *Authorizer {
+	return &Authorizer{owners: owners}
+}
+
+// Authorize returns nil if userID may do action on every one of resources,
+// and the not found error of the first one they may not otherwise.
+// Built-in templates can be read by every user and changed by none.
+func (a *Authorizer) Authorize(ctx context.Context, userID string, action Action, resources ...Resource) error {
+	for _, r := range resources {
+		if r.Kind == KindTemplate {
+			if _, ok := internal.BuiltInTemplate(r.ID); ok {
+				if action == ActionRead {
+					continue
+				}
+				return apperror.New(apperror.CodeTemplateBuiltInImmutable)
+			}
+		}
+		owner, err := a.owners.SelectOwner(ctx, r)
+		if errors.Is(err, sql.ErrNoRows) {
+			return apperror.Wrap(notFound[r.Kind], err)
+		}
+		if err != nil {
+			return err
+		}
+		if !may(userID, owner, action) {
+			return apperror.New(notFound[r.Kind])
+		}
+	}
+	return nil
+}
+
+// may reports whether userID may do action on a resource of owner.
+// Only owners may for now, sharing a resource would let others do the actions it was shared for here.
+func may(userID, owner string, action Action) bool {
+	return userID == owner
+}
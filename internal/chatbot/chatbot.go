@@ -2,6 +2,9 @@ package chatbot
 
 import (
 	"context"
+	"errors"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/evergarden0412/gptea-api/internal"
@@ -9,59 +12,312 @@ import (
 )
 
 type Chatbot struct {
-	client *openai.Client
+	provider Provider
+	// tools by name, toolNames keeps the order they were registered in
+	tools     map[string]Tool
+	toolNames []string
 }
 
-func New(client *openai.Client) *Chatbot {
+func New(provider Provider) *Chatbot {
 	return &Chatbot{
-		client: client,
+		provider: provider,
+		tools:    map[string]Tool{},
 	}
 }
 
-func (c *Chatbot) SendChat(ctx context.Context, chatID string, history []*internal.MessageWithScrap, newmsg string) (in, out *internal.Message, err error) {
-	lastSeq := 0
-	if len(history) != 0 {
-		lastSeq = history[0].Seq
+var ErrNoChoices = errors.New("completion came back without a choice")
+
+// createCompletion calls the completion api, failing on a response without a choice, so that callers can read the first one.
+func (c *Chatbot) createCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := c.provider.CreateChatCompletion(ctx, req)
+	if err == nil && len(resp.Choices) == 0 {
+		err = ErrNoChoices
 	}
-	in = &internal.Message{
-		ChatID:    chatID,
-		Seq:       lastSeq + 1,
-		Content:   newmsg,
-		CreatedAt: time.Now().UTC(),
-		Role:      openai.ChatMessageRoleUser,
+	return resp, err
+}
+
+// Conversation is a chat with what has been said in it so far.
+type Conversation struct {
+	Chat internal.Chat
+	// UserID owns the chat, tools run on their behalf
+	UserID string
+	// Summary covers the messages up to Summary.LastSeq, nil if nothing was summarized yet
+	Summary *internal.ChatSummary
+	// the active branch of the chat, assumes history is sorted in ascending time
+	History []*internal.MessageWithScrap
+	// LastSeq is the highest seq in the chat, across all of its branches
+	LastSeq int
+	// References are the scraps retrieved for the message being answered, which the reply may cite
+	References []Reference
+}
+
+// SendChat answers newmsg in the conversation.
+// out holds everything generated for it in order: the tool calls the model made with their results, then the reply.
+func (c *Chatbot) SendChat(ctx context.Context, conv Conversation, newmsg string) (in *internal.Message, out []*internal.Message, err error) {
+	in = NewUserMessage(conv, newmsg)
+	out, err = c.complete(ctx, conv, in)
+	if err != nil {
+		return nil, nil, err
 	}
+	return in, out, nil
+}
+
+// Answer is SendChat for in, a user message saved before it was answered.
+// The history of conv has to end right before in.
+// It streams like StreamChat without anyone listening, so that if ctx is cancelled,
+// out holds what was generated so far together with the error.
+func (c *Chatbot) Answer(ctx context.Context, conv Conversation, in *internal.Message) (out []*internal.Message, err error) {
+	return c.stream(ctx, conv, in, func(string) error { return nil })
+}
 
-	messages := buildMessages(history, in)
-	req := openai.ChatCompletionRequest{
-		Model:     openai.GPT3Dot5Turbo0613,
-		MaxTokens: 1000,
-		Messages:  messages,
+// complete runs the call loop for in: as long as the model calls a tool, the tool is run and its result sent back.
+func (c *Chatbot) complete(ctx context.Context, conv Conversation, in *internal.Message) ([]*internal.Message, error) {
+	var out []*internal.Message
+	for round := 0; round <= maxToolRounds; round++ {
+		req, err := c.newRequest(conv, in, round < maxToolRounds)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.createCompletion(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		msg := newGenerated(in, resp.Choices[0].Message, generation(req, resp))
+		out = append(out, msg)
+		if msg.Role != roleFunctionCall {
+			cite(msg, conv)
+			return out, nil
+		}
+		result := c.runTool(ctx, conv, msg)
+		out = append(out, result)
+		conv.History = followedBy(conv.History, in, msg)
+		in = result
 	}
-	resp, err := c.client.CreateChatCompletion(ctx, req)
+	return nil, ErrTooManyToolCalls
+}
+
+// Regenerate answers in, a user message or tool result already in the chat, again.
+// The history of conv has to end right before in. The model is not offered tools,
+// so the new reply is an answer rather than another tool call.
+func (c *Chatbot) Regenerate(ctx context.Context, conv Conversation, in *internal.Message) (*internal.Message, error) {
+	req, err := c.newRequest(conv, in, false)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	resp, err := c.createCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	msg := newGenerated(in, resp.Choices[0].Message, generation(req, resp))
+	cite(msg, conv)
+	return msg, nil
+}
 
-	out = &internal.Message{
-		ChatID:    chatID,
-		Seq:       lastSeq + 2,
-		Content:   resp.Choices[0].Message.Content,
-		CreatedAt: time.Now().UTC(),
-		Role:      resp.Choices[0].Message.Role,
+// StreamChat is SendChat with the streaming completion api.
+// onDelta is called with every content delta of the reply as it arrives, tool calls are run in between.
+// If the stream breaks off (e.g. ctx is cancelled because the client went away), out holds what was
+// generated so far together with the error, the reply cut where it broke off, so that the caller can
+// still persist it. out is empty if nothing was received.
+// The streaming api doesn't report usage, so the token counts of out are estimated with CountTokens.
+func (c *Chatbot) StreamChat(ctx context.Context, conv Conversation, newmsg string, onDelta func(delta string) error) (in *internal.Message, out []*internal.Message, err error) {
+	in = NewUserMessage(conv, newmsg)
+	out, err = c.stream(ctx, conv, in, onDelta)
+	return in, out, err
+}
+
+// stream runs the call loop for in like complete, with the streaming api.
+func (c *Chatbot) stream(ctx context.Context, conv Conversation, in *internal.Message, onDelta func(delta string) error) ([]*internal.Message, error) {
+	var out []*internal.Message
+	for round := 0; round <= maxToolRounds; round++ {
+		msg, err := c.streamRound(ctx, conv, in, round < maxToolRounds, onDelta)
+		if msg != nil {
+			cite(msg, conv)
+			out = append(out, msg)
+		}
+		if msg == nil || err != nil || msg.Role != roleFunctionCall {
+			return out, err
+		}
+		result := c.runTool(ctx, conv, msg)
+		out = append(out, result)
+		conv.History = followedBy(conv.History, in, msg)
+		in = result
 	}
-	return
+	return out, ErrTooManyToolCalls
 }
 
-// assumes history is sorted in ascending time
-func buildMessages(history []*internal.MessageWithScrap, new *internal.Message) []openai.ChatCompletionMessage {
-	var res []openai.ChatCompletionMessage
-	for _, hist := range history {
-		res = append(res, openai.ChatCompletionMessage{Role: hist.Role, Content: hist.Content})
+// streamRound streams what the model says after in, sending the content deltas to onDelta.
+// A tool call is collected instead. If the stream breaks off, the content so far is returned
+// with the error, while a tool call cut off is dropped.
+func (c *Chatbot) streamRound(ctx context.Context, conv Conversation, in *internal.Message, withTools bool, onDelta func(delta string) error) (*internal.Message, error) {
+	req, err := c.newRequest(conv, in, withTools)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := c.provider.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var content, arguments strings.Builder
+	var name string
+	var finishReason openai.FinishReason
+	for {
+		resp, recvErr := stream.Recv()
+		if errors.Is(recvErr, io.EOF) {
+			break
+		}
+		if recvErr != nil {
+			err = recvErr
+			break
+		}
+		if len(resp.Choices) == 0 {
+			continue
+		}
+		choice := resp.Choices[0]
+		if choice.FinishReason != "" {
+			finishReason = choice.FinishReason
+		}
+		if call := choice.Delta.FunctionCall; call != nil {
+			name += call.Name
+			arguments.WriteString(call.Arguments)
+			continue
+		}
+		if choice.Delta.Content == "" {
+			continue
+		}
+		content.WriteString(choice.Delta.Content)
+		if err = onDelta(choice.Delta.Content); err != nil {
+			break
+		}
+	}
+
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content.String()}
+	switch {
+	case name != "" && err != nil:
+		return nil, err
+	case name != "":
+		msg.FunctionCall = &openai.FunctionCall{Name: name, Arguments: arguments.String()}
+	case content.Len() == 0:
+		return nil, err
+	}
+	return newGenerated(in, msg, internal.Generation{
+		Model:            req.Model,
+		FinishReason:     string(finishReason),
+		PromptTokens:     promptTokens(req),
+		CompletionTokens: CountTokens(req.Model, content.String()+name+arguments.String()),
+	}), err
+}
+
+// newGenerated returns msg, what the model said after in, as the message following it.
+func newGenerated(in *internal.Message, msg openai.ChatCompletionMessage, gen internal.Generation) *internal.Message {
+	out := &internal.Message{
+		ChatID:     in.ChatID,
+		Seq:        in.Seq + 1,
+		ParentSeq:  in.Seq,
+		Content:    msg.Content,
+		CreatedAt:  time.Now().UTC(),
+		Role:       msg.Role,
+		Generation: gen,
+	}
+	if msg.FunctionCall != nil {
+		out.Role = roleFunctionCall
+		out.Name = msg.FunctionCall.Name
+		out.Content = msg.FunctionCall.Arguments
+	}
+	return out
+}
+
+func generation(req openai.ChatCompletionRequest, resp openai.ChatCompletionResponse) internal.Generation {
+	model := resp.Model
+	if model == "" {
+		model = req.Model
+	}
+	return internal.Generation{
+		Model:            model,
+		FinishReason:     string(resp.Choices[0].FinishReason),
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+}
+
+// usageOf is the usage of a call that generates no message, like summarizing, which counts its tokens only.
+func usageOf(resp openai.ChatCompletionResponse) internal.Usage {
+	return internal.Usage{PromptTokens: resp.Usage.PromptTokens, CompletionTokens: resp.Usage.CompletionTokens}
+}
+
+// followedBy returns history with msgs after it, leaving history as is.
+func followedBy(history []*internal.MessageWithScrap, msgs ...*internal.Message) []*internal.MessageWithScrap {
+	res := make([]*internal.MessageWithScrap, len(history), len(history)+len(msgs))
+	copy(res, history)
+	for _, msg := range msgs {
+		res = append(res, &internal.MessageWithScrap{
+			ChatID:    msg.ChatID,
+			Seq:       msg.Seq,
+			ParentSeq: msg.ParentSeq,
+			Content:   msg.Content,
+			Role:      msg.Role,
+			Name:      msg.Name,
+			CreatedAt: msg.CreatedAt,
+		})
 	}
-	res = append(res, openai.ChatCompletionMessage{Role: new.Role, Content: new.Content})
 	return res
 }
 
+// NewUserMessage returns content as the next message in the chat, following its head.
+// Only the chat and LastSeq of conv are used. The seq is provisional, another message may take it before this one is saved.
+func NewUserMessage(conv Conversation, content string) *internal.Message {
+	return &internal.Message{
+		ChatID:    conv.Chat.ID,
+		Seq:       conv.LastSeq + 1,
+		ParentSeq: conv.Chat.HeadSeq,
+		Content:   content,
+		CreatedAt: time.Now().UTC(),
+		Role:      openai.ChatMessageRoleUser,
+	}
+}
+
+// newRequest builds the request answering in, offering the registered tools if withTools.
+func (c *Chatbot) newRequest(conv Conversation, in *internal.Message, withTools bool) (openai.ChatCompletionRequest, error) {
+	chat := conv.Chat
+	var functions []openai.FunctionDefinition
+	if withTools {
+		functions = c.functions()
+	}
+	messages, _, err := buildMessages(conv, in, functionTokens(chat.Model, functions))
+	if err != nil {
+		return openai.ChatCompletionRequest{}, err
+	}
+	return openai.ChatCompletionRequest{
+		Model:            chat.Model,
+		MaxTokens:        chat.MaxTokens,
+		Temperature:      nonZero(chat.Temperature),
+		TopP:             nonZero(chat.TopP),
+		PresencePenalty:  chat.PresencePenalty,
+		FrequencyPenalty: chat.FrequencyPenalty,
+		Messages:         messages,
+		Functions:        functions,
+	}, nil
+}
+
 func GetSystemMessageRole() string {
 	return openai.ChatMessageRoleSystem
 }
+
+func GetUserMessageRole() string {
+	return openai.ChatMessageRoleUser
+}
+
+func GetAssistantMessageRole() string {
+	return openai.ChatMessageRoleAssistant
+}
+
+// GetFunctionCallMessageRole is the role of a tool call of the model.
+func GetFunctionCallMessageRole() string {
+	return roleFunctionCall
+}
+
+// GetFunctionMessageRole is the role of the result of a tool call.
+func GetFunctionMessageRole() string {
+	return openai.ChatMessageRoleFunction
+}
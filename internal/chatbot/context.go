@@ -0,0 +1,114 @@
+package chatbot
+
+import (
+	"errors"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+var ErrPromptTooLong = errors.New("message is too long for the context window of the model")
+
+// minTrimmedTokens is the least a trimmed message is cut down to.
+// If less than this is left in the budget, the message is dropped instead.
+const minTrimmedTokens = 64
+
+const trimmedPrefix = "…"
+
+// contextBudget is the number of prompt tokens left for the messages of chat,
+// after its reply and the reply priming are taken off the context window of the model.
+func contextBudget(chat internal.Chat) int {
+	window := Models[internal.DefaultChatModel].ContextWindow
+	if model, ok := Models[chat.Model]; ok {
+		window = model.ContextWindow
+	}
+	return window - chat.MaxTokens - tokensPerReply
+}
+
+func messageTokens(model string, msg openai.ChatCompletionMessage) int {
+	tokens := tokensPerMessage + CountTokens(model, msg.Role) + CountTokens(model, msg.Content) + CountTokens(model, msg.Name)
+	if msg.FunctionCall != nil {
+		tokens += CountTokens(model, msg.FunctionCall.Name) + CountTokens(model, msg.FunctionCall.Arguments)
+	}
+	return tokens
+}
+
+// promptTokens estimates the prompt tokens of req, reply priming and functions included.
+func promptTokens(req openai.ChatCompletionRequest) int {
+	tokens := tokensPerReply + functionTokens(req.Model, req.Functions)
+	for _, msg := range req.Messages {
+		tokens += messageTokens(req.Model, msg)
+	}
+	return tokens
+}
+
+// buildMessages builds the prompt for new in the conversation, fitting it into the context window of the chat model
+// with reserved tokens left for the functions.
+// The system prompt, the references, the summary and new are always sent. The history after the summary is filled in
+// from the newest message backwards until the budget runs out. The first message that doesn't fit
+// is cut down to its end if at least minTrimmedTokens are left, and every message before it is dropped.
+// A tool call is never cut down, its arguments wouldn't parse.
+// dropped holds the messages that were not sent whole, in ascending time.
+func buildMessages(conv Conversation, new *internal.Message, reserved int) (res []openai.ChatCompletionMessage, dropped []*internal.MessageWithScrap, err error) {
+	chat := conv.Chat
+	budget := contextBudget(chat) - reserved
+
+	var system []openai.ChatCompletionMessage
+	if chat.SystemPrompt != "" {
+		system = append(system, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: chat.SystemPrompt})
+	}
+	if len(conv.References) > 0 {
+		system = append(system, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: referencesMessage(conv.References)})
+	}
+	history := conv.History
+	if conv.Summary != nil {
+		system = append(system, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: summaryPrefix + conv.Summary.Content})
+		history = after(history, conv.Summary.LastSeq)
+	}
+	last := toOpenAI(new.Role, new.Name, new.Content)
+	for _, msg := range append(system, last) {
+		budget -= messageTokens(chat.Model, msg)
+	}
+	if budget < 0 {
+		return nil, nil, ErrPromptTooLong
+	}
+
+	// walk backwards, then reverse
+	var kept []openai.ChatCompletionMessage
+	i := len(history) - 1
+	for ; i >= 0; i-- {
+		msg := toOpenAI(history[i].Role, history[i].Name, history[i].Content)
+		tokens := messageTokens(chat.Model, msg)
+		if tokens <= budget {
+			kept = append(kept, msg)
+			budget -= tokens
+			continue
+		}
+		overhead := tokens - CountTokens(chat.Model, msg.Content) + CountTokens(chat.Model, trimmedPrefix)
+		if msg.FunctionCall == nil && budget-overhead >= minTrimmedTokens {
+			msg.Content = trimmedPrefix + lastTokens(chat.Model, msg.Content, budget-overhead)
+			kept = append(kept, msg)
+		}
+		break
+	}
+	dropped = history[:i+1]
+
+	res = make([]openai.ChatCompletionMessage, 0, len(system)+len(kept)+1)
+	res = append(res, system...)
+	for i := len(kept) - 1; i >= 0; i-- {
+		res = append(res, kept[i])
+	}
+	res = append(res, last)
+	return res, dropped, nil
+}
+
+// after returns the messages of history after seq.
+// assumes history is sorted in ascending time
+func after(history []*internal.MessageWithScrap, seq int) []*internal.MessageWithScrap {
+	for i, msg := range history {
+		if msg.Seq > seq {
+			return history[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package chatbot
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+// testHistory returns a history of n messages taking turns between the user and the assistant,
+// each starting with its seq and followed by words words.
+func testHistory(n, words int) []*internal.MessageWithScrap {
+	var history []*internal.MessageWithScrap
+	for seq := 1; seq <= n; seq++ {
+		role := openai.ChatMessageRoleUser
+		if seq%2 == 0 {
+			role = openai.ChatMessageRoleAssistant
+		}
+		history = append(history, &internal.MessageWithScrap{
+			ChatID:    "chat",
+			Seq:       seq,
+			ParentSeq: seq - 1,
+			Role:      role,
+			Content:   "m" + strconv.Itoa(seq) + strings.Repeat(" word", words),
+		})
+	}
+	return history
+}
+
+func testChat() internal.Chat {
+	return internal.Chat{
+		ID:          "chat",
+		Model:       internal.DefaultChatModel,
+		Temperature: internal.DefaultChatTemperature,
+		TopP:        internal.DefaultChatTopP,
+		MaxTokens:   internal.DefaultChatMaxTokens,
+	}
+}
+
+func testConversation(history []*internal.MessageWithScrap) Conversation {
+	return Conversation{Chat: testChat(), History: history, LastSeq: len(history)}
+}
+
+func messagesTokens(model string, msgs []openai.ChatCompletionMessage) int {
+	tokens := 0
+	for _, msg := range msgs {
+		tokens += messageTokens(model, msg)
+	}
+	return tokens
+}
+
+func TestBuildMessagesKeepsWhatFits(t *testing.T) {
+	conv := testConversation(testHistory(4, 10))
+	conv.Chat.SystemPrompt = "Be brief."
+	new := NewUserMessage(conv, "hello")
+
+	res, dropped, err := buildMessages(conv, new, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 0 {
+		t.Errorf("dropped %d messages, want none", len(dropped))
+	}
+	want := []string{"Be brief."}
+	for _, msg := range conv.History {
+		want = append(want, msg.Content)
+	}
+	want = append(want, "hello")
+	if len(res) != len(want) {
+		t.Fatalf("sent %d messages, want %d", len(res), len(want))
+	}
+	for i := range want {
+		if res[i].Content != want[i] {
+			t.Errorf("message %d is %q, want %q", i, res[i].Content, want[i])
+		}
+	}
+	if res[0].Role != openai.ChatMessageRoleSystem {
+		t.Errorf("first message is %s, want the system prompt", res[0].Role)
+	}
+}
+
+func TestBuildMessagesTrimsOldest(t *testing.T) {
+	conv := testConversation(testHistory(10, 700))
+	new := NewUserMessage(conv, "hello")
+
+	res, dropped, err := buildMessages(conv, new, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := messagesTokens(conv.Chat.Model, res); tokens > contextBudget(conv.Chat) {
+		t.Errorf("sent %d tokens, over the budget of %d", tokens, contextBudget(conv.Chat))
+	}
+	if len(dropped) == 0 || len(dropped) == len(conv.History) {
+		t.Fatalf("dropped %d of %d messages, want some of them", len(dropped), len(conv.History))
+	}
+	// the newest messages are sent whole, in order, after the end of the first message that didn't fit
+	kept := conv.History[len(dropped):]
+	if len(res) != len(kept)+2 {
+		t.Fatalf("sent %d messages, want %d whole, the trimmed one and the new one", len(res), len(kept))
+	}
+	trimmed := res[0].Content
+	if !strings.HasPrefix(trimmed, trimmedPrefix) {
+		t.Errorf("oldest message sent is %.20q..., want it trimmed", trimmed)
+	}
+	if !strings.HasSuffix(dropped[len(dropped)-1].Content, strings.TrimPrefix(trimmed, trimmedPrefix)) {
+		t.Error("trimmed message isn't the end of the newest dropped one")
+	}
+	for i, msg := range kept {
+		if res[i+1].Content != msg.Content {
+			t.Errorf("message %d is %.20q..., want %.20q...", i+1, res[i+1].Content, msg.Content)
+		}
+	}
+	if res[len(res)-1].Content != "hello" {
+		t.Errorf("last message is %q, want the new one", res[len(res)-1].Content)
+	}
+}
+
+func TestBuildMessagesLeavesReserved(t *testing.T) {
+	conv := testConversation(testHistory(10, 100))
+	new := NewUserMessage(conv, "hello")
+
+	all, _, err := buildMessages(conv, new, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := contextBudget(conv.Chat) - 300
+	res, _, err := buildMessages(conv, new, reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := messagesTokens(conv.Chat.Model, res); tokens > 300 {
+		t.Errorf("sent %d tokens, over the 300 left after the reserved ones", tokens)
+	}
+	if len(res) >= len(all) {
+		t.Errorf("sent %d messages with tokens reserved, want fewer than the %d without", len(res), len(all))
+	}
+}
+
+func TestBuildMessagesDropsToolCallWhole(t *testing.T) {
+	history := testHistory(4, 10)
+	history[1].Role = roleFunctionCall
+	history[1].Name = "search_scraps"
+	history[1].Content = `{"query": "` + strings.Repeat("word ", 1000) + `"}`
+	history[2].Role = openai.ChatMessageRoleFunction
+	history[2].Name = "search_scraps"
+	conv := testConversation(history)
+	new := NewUserMessage(conv, "hello")
+
+	res, dropped, err := buildMessages(conv, new, contextBudget(conv.Chat)-600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 2 {
+		t.Fatalf("dropped %d messages, want the first and the tool call", len(dropped))
+	}
+	for _, msg := range res {
+		if msg.FunctionCall != nil {
+			t.Errorf("sent the tool call, want it dropped whole")
+		}
+	}
+}
+
+func TestBuildMessagesAfterSummary(t *testing.T) {
+	conv := testConversation(testHistory(4, 10))
+	conv.Summary = &internal.ChatSummary{ChatID: "chat", LastSeq: 2, Content: "they said hi"}
+	new := NewUserMessage(conv, "hello")
+
+	res, _, err := buildMessages(conv, new, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{summaryPrefix + "they said hi", conv.History[2].Content, conv.History[3].Content, "hello"}
+	if len(res) != len(want) {
+		t.Fatalf("sent %d messages, want %d", len(res), len(want))
+	}
+	for i := range want {
+		if res[i].Content != want[i] {
+			t.Errorf("message %d is %.20q..., want %.20q...", i, res[i].Content, want[i])
+		}
+	}
+}
+
+func TestBuildMessagesPromptTooLong(t *testing.T) {
+	conv := testConversation(nil)
+	new := NewUserMessage(conv, strings.Repeat(" word", contextBudget(conv.Chat)))
+
+	if _, _, err := buildMessages(conv, new, 0); !errors.Is(err, ErrPromptTooLong) {
+		t.Errorf("got %v, want ErrPromptTooLong", err)
+	}
+}
@@ -0,0 +1,147 @@
+package chatbot
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Fake is a Provider that answers in process, for tests and for running locally without an openai api key.
+// It replies with the scripted replies in order, and once they run out, echoes the last user message.
+type Fake struct {
+	mu      sync.Mutex
+	replies []openai.ChatCompletionMessage
+}
+
+func NewFake(replies ...string) *Fake {
+	f := &Fake{}
+	f.Script(replies...)
+	return f
+}
+
+// Script appends replies to the ones still to be sent.
+func (f *Fake) Script(replies ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, reply := range replies {
+		f.replies = append(f.replies, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply})
+	}
+}
+
+// ScriptToolCall appends a call of the tool name with arguments, in json, to the replies still to be sent.
+func (f *Fake) ScriptToolCall(name, arguments string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append(f.replies, openai.ChatCompletionMessage{
+		Role:         openai.ChatMessageRoleAssistant,
+		FunctionCall: &openai.FunctionCall{Name: name, Arguments: arguments},
+	})
+}
+
+func (f *Fake) next(req openai.ChatCompletionRequest) openai.ChatCompletionMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.replies) > 0 {
+		reply := f.replies[0]
+		f.replies = f.replies[1:]
+		return reply
+	}
+	reply := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "echo"}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == openai.ChatMessageRoleUser {
+			reply.Content = "echo: " + req.Messages[i].Content
+			break
+		}
+	}
+	return reply
+}
+
+func (f *Fake) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	reply := f.next(req)
+	promptTokens := promptTokens(req)
+	completionTokens := messageTokens(req.Model, reply) - tokensPerMessage
+	finishReason := openai.FinishReasonStop
+	if reply.FunctionCall != nil {
+		finishReason = openai.FinishReasonFunctionCall
+	}
+	return openai.ChatCompletionResponse{
+		ID:     "fake",
+		Object: "chat.completion",
+		Model:  req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      reply,
+			FinishReason: finishReason,
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}, nil
+}
+
+func (f *Fake) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	reply := f.next(req)
+	if reply.FunctionCall != nil {
+		return &fakeStream{ctx: ctx, model: req.Model, call: reply.FunctionCall}, nil
+	}
+	return &fakeStream{
+		ctx:    ctx,
+		model:  req.Model,
+		chunks: strings.SplitAfter(reply.Content, " "),
+	}, nil
+}
+
+// fakeStream sends a reply word by word, or a tool call in one chunk.
+type fakeStream struct {
+	ctx    context.Context
+	model  string
+	chunks []string
+	call   *openai.FunctionCall
+	done   bool
+}
+
+func (s *fakeStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if err := s.ctx.Err(); err != nil {
+		return openai.ChatCompletionStreamResponse{}, err
+	}
+	if s.done {
+		return openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	resp := openai.ChatCompletionStreamResponse{
+		ID:     "fake",
+		Object: "chat.completion.chunk",
+		Model:  s.model,
+	}
+	if s.call != nil {
+		resp.Choices = []openai.ChatCompletionStreamChoice{{
+			Delta:        openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant, FunctionCall: s.call},
+			FinishReason: openai.FinishReasonFunctionCall,
+		}}
+		s.done = true
+		return resp, nil
+	}
+	if len(s.chunks) == 0 {
+		s.done = true
+		resp.Choices = []openai.ChatCompletionStreamChoice{{FinishReason: openai.FinishReasonStop}}
+		return resp, nil
+	}
+	resp.Choices = []openai.ChatCompletionStreamChoice{{
+		Delta: openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant, Content: s.chunks[0]},
+	}}
+	s.chunks = s.chunks[1:]
+	return resp, nil
+}
+
+func (s *fakeStream) Close() {
+	s.done = true
+}
@@ -0,0 +1,70 @@
+package chatbot
+
+import (
+	"errors"
+	"math"
+	"unicode/utf8"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+type Model struct {
+	// ContextWindow is the number of tokens the model accepts for prompt and reply together.
+	ContextWindow int
+}
+
+// Models is the allowlist of models a chat can be set to.
+var Models = map[string]Model{
+	openai.GPT3Dot5Turbo0613:    {ContextWindow: 4096},
+	openai.GPT3Dot5Turbo16K0613: {ContextWindow: 16384},
+	openai.GPT40613:             {ContextWindow: 8192},
+}
+
+var (
+	ErrUnknownModel        = errors.New("unknown model")
+	ErrBadTemperature      = errors.New("temperature must be between 0 and 2")
+	ErrBadTopP             = errors.New("topP must be between 0 and 1")
+	ErrBadMaxTokens        = errors.New("maxTokens must be positive and less than the context window of the model")
+	ErrBadPresencePenalty  = errors.New("presencePenalty must be between -2 and 2")
+	ErrBadFrequencyPenalty = errors.New("frequencyPenalty must be between -2 and 2")
+	ErrSystemPromptTooLong = errors.New("systemPrompt is too long")
+)
+
+const maxSystemPromptLength = 4000 // in runes
+
+// ValidateSettings checks the generation settings of chat against the model allowlist and the ranges openai accepts.
+func ValidateSettings(chat internal.Chat) error {
+	model, ok := Models[chat.Model]
+	if !ok {
+		return ErrUnknownModel
+	}
+	if chat.Temperature < 0 || chat.Temperature > 2 {
+		return ErrBadTemperature
+	}
+	if chat.TopP < 0 || chat.TopP > 1 {
+		return ErrBadTopP
+	}
+	if chat.MaxTokens <= 0 || chat.MaxTokens >= model.ContextWindow {
+		return ErrBadMaxTokens
+	}
+	if chat.PresencePenalty < -2 || chat.PresencePenalty > 2 {
+		return ErrBadPresencePenalty
+	}
+	if chat.FrequencyPenalty < -2 || chat.FrequencyPenalty > 2 {
+		return ErrBadFrequencyPenalty
+	}
+	if utf8.RuneCountInString(chat.SystemPrompt) > maxSystemPromptLength {
+		return ErrSystemPromptTooLong
+	}
+	return nil
+}
+
+// nonZero works around go-openai dropping zero floats from requests (omitempty),
+// which would make openai fall back to its defaults instead of 0.
+func nonZero(f float32) float32 {
+	if f == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return f
+}
@@ -0,0 +1,37 @@
+package chatbot
+
+import (
+	"context"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Provider is the chat completion api behind the chatbot.
+// Requests and responses are in the shape of the openai api, which other backends have to speak.
+type Provider interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error)
+}
+
+// Stream is a chat completion being streamed.
+// Recv returns io.EOF after the last chunk.
+type Stream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close()
+}
+
+type openAIProvider struct {
+	client *openai.Client
+}
+
+func NewOpenAI(client *openai.Client) Provider {
+	return &openAIProvider{client: client}
+}
+
+func (p *openAIProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return p.client.CreateChatCompletion(ctx, req)
+}
+
+func (p *openAIProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	return p.client.CreateChatCompletionStream(ctx, req)
+}
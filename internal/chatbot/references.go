@@ -0,0 +1,47 @@
+package chatbot
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+const referencesPrompt = `The user saved the scraps below from earlier answers, with their own memo.
+Use them where they help with the next message of the user, and ignore them otherwise.
+Cite every scrap you use right after the sentence using it, as [scrap:ID]. Don't cite scraps you didn't use.`
+
+var citation = regexp.MustCompile(`\[scrap:([A-Za-z0-9]+)\]`)
+
+// Reference is a scrap of the user retrieved for the message being answered.
+type Reference struct {
+	ID      string
+	Content string
+}
+
+// referencesMessage is the system message giving the model refs to cite.
+func referencesMessage(refs []Reference) string {
+	var b strings.Builder
+	b.WriteString(referencesPrompt)
+	for _, ref := range refs {
+		b.WriteString("\n\n[scrap:" + ref.ID + "]\n" + ref.Content)
+	}
+	return b.String()
+}
+
+// cite records on the reply msg the references of conv it cites, in the order it cites them first.
+func cite(msg *internal.Message, conv Conversation) {
+	if msg.Role != GetAssistantMessageRole() || len(conv.References) == 0 {
+		return
+	}
+	given := map[string]bool{}
+	for _, ref := range conv.References {
+		given[ref.ID] = true
+	}
+	for _, match := range citation.FindAllStringSubmatch(msg.Content, -1) {
+		if id := match[1]; given[id] {
+			given[id] = false
+			msg.Citations = append(msg.Citations, id)
+		}
+	}
+}
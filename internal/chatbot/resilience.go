@@ -0,0 +1,320 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+type ResilienceConfig struct {
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries  int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// CallTimeout is the longest a call may take, retries included.
+	// Calls made with a deadline end DeadlineReserve before it, if that comes first.
+	CallTimeout time.Duration
+	// DeadlineReserve is the time a call leaves to its caller before the deadline of the caller's context,
+	// for what is done after it, like responding before the lambda times out.
+	DeadlineReserve time.Duration
+	// FailureThreshold is the number of failed calls in a row that opens the circuit.
+	FailureThreshold int
+	// OpenDuration is how long the circuit stays open before a trial call is let through.
+	OpenDuration time.Duration
+}
+
+// DefaultResilienceConfig is for answering within a request, whose lambda times out after 10 seconds.
+var DefaultResilienceConfig = ResilienceConfig{
+	MaxRetries:       2,
+	BaseBackoff:      250 * time.Millisecond,
+	MaxBackoff:       2 * time.Second,
+	CallTimeout:      8 * time.Second,
+	DeadlineReserve:  time.Second,
+	FailureThreshold: 5,
+	OpenDuration:     30 * time.Second,
+}
+
+// WorkerResilienceConfig is for answering in the background, whose lambda has minutes, see template.yaml.
+// A reply may take several calls, for tool calls, so each gets a part of the time.
+var WorkerResilienceConfig = ResilienceConfig{
+	MaxRetries:       4,
+	BaseBackoff:      time.Second,
+	MaxBackoff:       10 * time.Second,
+	CallTimeout:      90 * time.Second,
+	DeadlineReserve:  5 * time.Second,
+	FailureThreshold: 5,
+	OpenDuration:     30 * time.Second,
+}
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+// UnavailableError means the completion api can't be used for now, and should be tried again after RetryAfter.
+type UnavailableError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("chatbot unavailable, retry after %s: %s", e.RetryAfter, e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// resilientProvider retries failed calls with jittered exponential backoff, honoring Retry-After,
+// bounds each call with a deadline, and stops calling after repeated failures.
+type resilientProvider struct {
+	next    Provider
+	cfg     ResilienceConfig
+	breaker *breaker
+}
+
+func NewResilient(next Provider, cfg ResilienceConfig) Provider {
+	return &resilientProvider{
+		next:    next,
+		cfg:     cfg,
+		breaker: &breaker{threshold: cfg.FailureThreshold, openDuration: cfg.OpenDuration},
+	}
+}
+
+// callDeadline is the deadline of a call made with ctx, see ResilienceConfig.CallTimeout.
+func (p *resilientProvider) callDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(p.cfg.CallTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Add(-p.cfg.DeadlineReserve).Before(deadline) {
+		deadline = ctxDeadline.Add(-p.cfg.DeadlineReserve)
+	}
+	return deadline
+}
+
+func (p *resilientProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	deadline := p.callDeadline(ctx)
+	callCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var resp openai.ChatCompletionResponse
+	err := p.call(ctx, callCtx, deadline, func(attemptCtx context.Context) error {
+		var err error
+		resp, err = p.next.CreateChatCompletion(attemptCtx, req)
+		return err
+	})
+	return resp, err
+}
+
+// CreateChatCompletionStream applies the deadline to opening the stream only,
+// reading it may take as long as the reply does.
+func (p *resilientProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	deadline := p.callDeadline(ctx)
+	callCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(time.Until(deadline), cancel)
+
+	var stream Stream
+	err := p.call(ctx, callCtx, deadline, func(attemptCtx context.Context) error {
+		var err error
+		stream, err = p.next.CreateChatCompletionStream(attemptCtx, req)
+		return err
+	})
+	if err != nil || !timer.Stop() {
+		cancel()
+		if err == nil {
+			stream.Close()
+			err = &UnavailableError{RetryAfter: p.cfg.BaseBackoff, Err: context.DeadlineExceeded}
+		}
+		return nil, err
+	}
+	return &cancelStream{Stream: stream, cancel: cancel}, nil
+}
+
+// call runs attempt until it succeeds, fails for good or runs out of retries or time.
+// ctx is the context of the caller, callCtx the one cancelled at the deadline of the call.
+func (p *resilientProvider) call(ctx, callCtx context.Context, deadline time.Time, attempt func(context.Context) error) error {
+	if time.Until(deadline) <= 0 {
+		// the caller has no time left for a call, which says nothing about the api
+		return &UnavailableError{RetryAfter: p.cfg.BaseBackoff, Err: context.DeadlineExceeded}
+	}
+	if retryAfter, ok := p.breaker.allow(); !ok {
+		return &UnavailableError{RetryAfter: retryAfter, Err: ErrCircuitOpen}
+	}
+
+	for i := 0; ; i++ {
+		hint := &retryAfterHint{}
+		err := attempt(context.WithValue(callCtx, retryAfterKey{}, hint))
+		if err == nil {
+			p.breaker.success()
+			return nil
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, which says nothing about the api
+			p.breaker.release()
+			return ctx.Err()
+		}
+		if !isRetryable(err) && callCtx.Err() == nil {
+			p.breaker.release()
+			return err
+		}
+
+		delay := p.backoff(i)
+		if hint.d > 0 {
+			delay = hint.d
+		}
+		if i >= p.cfg.MaxRetries || callCtx.Err() != nil || time.Now().Add(delay).After(deadline) {
+			p.breaker.failure()
+			return &UnavailableError{RetryAfter: delay, Err: err}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-callCtx.Done():
+		}
+	}
+}
+
+// backoff is the full jitter delay before retry i.
+func (p *resilientProvider) backoff(i int) time.Duration {
+	ceiling := p.cfg.BaseBackoff << i
+	if ceiling > p.cfg.MaxBackoff || ceiling <= 0 {
+		ceiling = p.cfg.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+func isRetryable(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		// running out of quota is a 429 too, but doesn't go away by retrying
+		if apiErr.Type == "insufficient_quota" {
+			return false
+		}
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return isRetryableStatus(reqErr.HTTPStatusCode)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// cancelStream releases the context of the stream when it's closed.
+type cancelStream struct {
+	Stream
+	cancel context.CancelFunc
+}
+
+func (s *cancelStream) Close() {
+	s.Stream.Close()
+	s.cancel()
+}
+
+// breaker is a circuit breaker counting failed calls in a row.
+// Once open, it rejects calls until openDuration has passed, then lets a single trial call through,
+// which closes it on success and opens it again on failure.
+type breaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a call may go through, or how long to wait if not.
+func (b *breaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return 0, true
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, false
+	}
+	if b.trial {
+		return time.Second, false
+	}
+	b.trial = true
+	return 0, true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.openDuration)
+	}
+}
+
+// release ends a call that neither succeeded nor failed because of the api.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+type retryAfterKey struct{}
+
+// retryAfterHint carries the Retry-After header of a response out of the openai client,
+// which doesn't expose response headers on errors.
+type retryAfterHint struct {
+	d time.Duration
+}
+
+// NewHTTPClient returns the http client to give to the openai client,
+// so that the resilience layer sees the Retry-After headers of its responses.
+func NewHTTPClient() *http.Client {
+	return &http.Client{Transport: &retryAfterTransport{base: http.DefaultTransport}}
+}
+
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if hint, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHint); ok {
+		hint.d = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses both the delay-seconds and the http-date form of Retry-After.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,322 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// deadlineProvider records the deadline of the calls made to it.
+type deadlineProvider struct {
+	calls    int
+	deadline time.Time
+}
+
+func (p *deadlineProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	p.calls++
+	p.deadline, _ = ctx.Deadline()
+	return openai.ChatCompletionResponse{}, nil
+}
+
+func (p *deadlineProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestCallDeadlineFollowsContext(t *testing.T) {
+	next := &deadlineProvider{}
+	p := NewResilient(next, DefaultResilienceConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := p.CreateChatCompletion(ctx, openai.ChatCompletionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	ctxDeadline, _ := ctx.Deadline()
+	if want := ctxDeadline.Add(-DefaultResilienceConfig.DeadlineReserve); !next.deadline.Equal(want) {
+		t.Errorf("call deadline is %s, want %s, the reserve before the one of the caller", next.deadline, want)
+	}
+}
+
+func TestCallDeadlineWithoutContextDeadline(t *testing.T) {
+	next := &deadlineProvider{}
+	p := NewResilient(next, DefaultResilienceConfig)
+
+	start := time.Now()
+	if _, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now()
+	timeout := DefaultResilienceConfig.CallTimeout
+	if next.deadline.Before(start.Add(timeout)) || next.deadline.After(end.Add(timeout)) {
+		t.Errorf("call deadline is %s after the call, want CallTimeout", next.deadline.Sub(start))
+	}
+}
+
+func TestNoTimeLeftKeepsCircuitClosed(t *testing.T) {
+	next := &deadlineProvider{}
+	cfg := DefaultResilienceConfig
+	cfg.FailureThreshold = 1
+	p := NewResilient(next, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DeadlineReserve/2)
+	defer cancel()
+
+	_, err := p.CreateChatCompletion(ctx, openai.ChatCompletionRequest{})
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want an UnavailableError for the deadline", err)
+	}
+	if next.calls != 0 {
+		t.Errorf("called the api %d times without time left", next.calls)
+	}
+	if _, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{}); err != nil {
+		t.Errorf("got %v after running out of time, want the circuit closed", err)
+	}
+}
+
+// flakyProvider fails the calls made to it with errs in order, then succeeds, recording when it was called.
+// A call failing with a 429 sets the Retry-After of the response to retryAfter, if any.
+type flakyProvider struct {
+	errs       []error
+	retryAfter time.Duration
+	calls      []time.Time
+}
+
+func (p *flakyProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	p.calls = append(p.calls, time.Now())
+	if len(p.errs) == 0 {
+		return openai.ChatCompletionResponse{}, nil
+	}
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+	var apiErr *openai.APIError
+	if hint, ok := ctx.Value(retryAfterKey{}).(*retryAfterHint); ok && errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusTooManyRequests {
+		hint.d = p.retryAfter
+	}
+	return openai.ChatCompletionResponse{}, err
+}
+
+func (p *flakyProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	return nil, errors.New("not supported")
+}
+
+func statusError(code int) error {
+	return &openai.APIError{HTTPStatusCode: code, Message: http.StatusText(code)}
+}
+
+// testResilienceConfig retries quickly and opens the circuit after 2 failed calls for 50ms.
+var testResilienceConfig = ResilienceConfig{
+	MaxRetries:       2,
+	BaseBackoff:      10 * time.Millisecond,
+	MaxBackoff:       20 * time.Millisecond,
+	CallTimeout:      time.Second,
+	FailureThreshold: 2,
+	OpenDuration:     50 * time.Millisecond,
+}
+
+func TestBackoffIsJittered(t *testing.T) {
+	p := NewResilient(nil, testResilienceConfig).(*resilientProvider)
+	for i, ceiling := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond} {
+		seen := map[time.Duration]bool{}
+		for j := 0; j < 100; j++ {
+			d := p.backoff(i)
+			if d <= 0 || d > ceiling {
+				t.Fatalf("backoff(%d) = %s, want in (0, %s]", i, d, ceiling)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoff(%d) is always %s, want it jittered", i, p.backoff(i))
+		}
+	}
+}
+
+func TestRetriesWithBackoff(t *testing.T) {
+	next := &flakyProvider{errs: []error{statusError(http.StatusInternalServerError), statusError(http.StatusBadGateway)}}
+	p := NewResilient(next, testResilienceConfig)
+
+	if _, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{}); err != nil {
+		t.Fatalf("got %v, want the third attempt to succeed", err)
+	}
+	if len(next.calls) != 3 {
+		t.Fatalf("called the api %d times, want 3", len(next.calls))
+	}
+	for i := 1; i < len(next.calls); i++ {
+		ceiling := testResilienceConfig.BaseBackoff << (i - 1)
+		if ceiling > testResilienceConfig.MaxBackoff {
+			ceiling = testResilienceConfig.MaxBackoff
+		}
+		// with some slack for the scheduler
+		if gap := next.calls[i].Sub(next.calls[i-1]); gap > ceiling+50*time.Millisecond {
+			t.Errorf("retry %d came %s after the attempt before, want at most about %s", i, gap, ceiling)
+		}
+	}
+}
+
+func TestRetriesRunOut(t *testing.T) {
+	fail := statusError(http.StatusServiceUnavailable)
+	next := &flakyProvider{errs: []error{fail, fail, fail, fail}}
+	cfg := testResilienceConfig
+	cfg.FailureThreshold = 10
+	p := NewResilient(next, cfg)
+
+	_, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{})
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, fail) {
+		t.Fatalf("got %v, want an UnavailableError of the last failure", err)
+	}
+	if len(next.calls) != cfg.MaxRetries+1 {
+		t.Errorf("called the api %d times, want %d", len(next.calls), cfg.MaxRetries+1)
+	}
+}
+
+func TestNoRetryForClientErrors(t *testing.T) {
+	tests := []error{
+		statusError(http.StatusBadRequest),
+		&openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Type: "insufficient_quota"},
+	}
+	for _, fail := range tests {
+		next := &flakyProvider{errs: []error{fail}}
+		p := NewResilient(next, testResilienceConfig)
+
+		_, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{})
+		var unavailable *UnavailableError
+		if err != fail || errors.As(err, &unavailable) {
+			t.Errorf("got %v for %v, want it as is", err, fail)
+		}
+		if len(next.calls) != 1 {
+			t.Errorf("called the api %d times for %v, want once", len(next.calls), fail)
+		}
+	}
+}
+
+func TestRetryAfterIsHonored(t *testing.T) {
+	next := &flakyProvider{errs: []error{statusError(http.StatusTooManyRequests)}, retryAfter: 60 * time.Millisecond}
+	p := NewResilient(next, testResilienceConfig)
+
+	if _, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.calls) != 2 {
+		t.Fatalf("called the api %d times, want 2", len(next.calls))
+	}
+	if gap := next.calls[1].Sub(next.calls[0]); gap < next.retryAfter {
+		t.Errorf("retried after %s, want the Retry-After of %s rather than the backoff", gap, next.retryAfter)
+	}
+}
+
+func TestRetryAfterPastDeadline(t *testing.T) {
+	next := &flakyProvider{errs: []error{statusError(http.StatusTooManyRequests)}, retryAfter: time.Minute}
+	p := NewResilient(next, testResilienceConfig)
+
+	_, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{})
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter != time.Minute {
+		t.Fatalf("got %v, want an UnavailableError telling to retry after a minute", err)
+	}
+	if len(next.calls) != 1 {
+		t.Errorf("called the api %d times, want no retry past the deadline", len(next.calls))
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	retryAfter := "2"
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer api.Close()
+	client := NewHTTPClient()
+
+	for _, tt := range []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"2", 2 * time.Second, 2 * time.Second},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{"soon", 0, 0},
+	} {
+		retryAfter = tt.header
+		hint := &retryAfterHint{}
+		req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), retryAfterKey{}, hint), "GET", api.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if hint.d < tt.min || hint.d > tt.max {
+			t.Errorf("Retry-After %q gave %s, want between %s and %s", tt.header, hint.d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	fail := statusError(http.StatusInternalServerError)
+	cfg := testResilienceConfig
+	cfg.MaxRetries = 0
+	next := &flakyProvider{errs: []error{fail, fail, fail}}
+	p := NewResilient(next, cfg)
+	call := func() error {
+		_, err := p.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{})
+		return err
+	}
+
+	// closed: failures go through until FailureThreshold of them in a row
+	call()
+	call()
+	if len(next.calls) != 2 {
+		t.Fatalf("called the api %d times, want 2", len(next.calls))
+	}
+	// open: calls are rejected without calling the api
+	err := call()
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, ErrCircuitOpen) || unavailable.RetryAfter <= 0 || unavailable.RetryAfter > cfg.OpenDuration {
+		t.Fatalf("got %v, want ErrCircuitOpen telling to retry within OpenDuration", err)
+	}
+	if len(next.calls) != 2 {
+		t.Fatalf("called the api with the circuit open")
+	}
+
+	// half open: after OpenDuration a single trial goes through, and its failure opens the circuit again
+	time.Sleep(cfg.OpenDuration)
+	call()
+	if len(next.calls) != 3 {
+		t.Fatalf("called the api %d times, want the trial call", len(next.calls))
+	}
+	if err := call(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v after the trial failed, want ErrCircuitOpen", err)
+	}
+
+	// a trial succeeding closes it
+	time.Sleep(cfg.OpenDuration)
+	if err := call(); err != nil {
+		t.Fatalf("got %v for the trial, want it to succeed", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := call(); err != nil {
+			t.Fatalf("got %v after the trial succeeded, want the circuit closed", err)
+		}
+	}
+}
+
+func TestBreakerLetsOneTrialThrough(t *testing.T) {
+	b := &breaker{threshold: 1, openDuration: time.Millisecond}
+	b.failure()
+	time.Sleep(time.Millisecond)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("the trial isn't let through once the circuit was open for openDuration")
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("a second call is let through while the trial runs")
+	}
+	// a trial ending for the caller, not the api, lets the next one try
+	b.release()
+	if _, ok := b.allow(); !ok {
+		t.Error("no trial is let through after the one before was released")
+	}
+}
@@ -0,0 +1,102 @@
+package chatbot
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	summaryModel     = openai.GPT3Dot5Turbo0613
+	summaryMaxTokens = 500
+	summaryPrefix    = "Summary of the earlier conversation:\n"
+	summaryPrompt    = `You keep a running summary of a conversation between a user and an assistant.
+You are given the current summary, which may be empty, and the messages that follow it.
+Rewrite the summary so that it also covers the new messages.
+Keep the facts, questions, answers and decisions the assistant needs to continue the conversation, drop small talk.
+Write in the language of the conversation, in at most 300 words. Reply with the summary only.`
+)
+
+// Summarize folds the messages that no longer fit into the context window for newmsg into the summary of the conversation.
+// It returns nil if every message after the current summary still fits, the updated summary otherwise.
+// Old messages are folded in chunks small enough for the summary model, with an extra completion call for each.
+// usage is what the calls took, even if one of them failed.
+func (c *Chatbot) Summarize(ctx context.Context, conv Conversation, newmsg string) (summary *internal.ChatSummary, usage internal.Usage, err error) {
+	in := NewUserMessage(conv, newmsg)
+	_, dropped, err := buildMessages(conv, in, functionTokens(conv.Chat.Model, c.functions()))
+	if err != nil {
+		return nil, usage, err
+	}
+	if len(dropped) == 0 {
+		return nil, usage, nil
+	}
+
+	summary = conv.Summary
+	for len(dropped) > 0 {
+		var n int
+		var foldUsage internal.Usage
+		summary, n, foldUsage, err = c.foldIntoSummary(ctx, conv.Chat.ID, summary, dropped)
+		usage.PromptTokens += foldUsage.PromptTokens
+		usage.CompletionTokens += foldUsage.CompletionTokens
+		if err != nil {
+			return nil, usage, err
+		}
+		dropped = dropped[n:]
+	}
+	return summary, usage, nil
+}
+
+// foldIntoSummary folds as many of msgs as fit in one call into summary, and returns how many were folded with the usage of the call.
+func (c *Chatbot) foldIntoSummary(ctx context.Context, chatID string, summary *internal.ChatSummary, msgs []*internal.MessageWithScrap) (*internal.ChatSummary, int, internal.Usage, error) {
+	var prev string
+	if summary != nil {
+		prev = summary.Content
+	}
+	budget := Models[summaryModel].ContextWindow - summaryMaxTokens - tokensPerReply - 2*tokensPerMessage -
+		CountTokens(summaryModel, summaryPrompt) - CountTokens(summaryModel, prev) - 16
+
+	var transcript strings.Builder
+	n := 0
+	for _, msg := range msgs {
+		role := msg.Role
+		if msg.Name != "" {
+			role += " " + msg.Name
+		}
+		line := role + ": " + msg.Content + "\n"
+		tokens := CountTokens(summaryModel, line)
+		if tokens > budget {
+			if n > 0 {
+				break
+			}
+			// a single message larger than the whole budget, fold in its end
+			line = role + ": " + trimmedPrefix + lastTokens(summaryModel, msg.Content, budget-8) + "\n"
+			tokens = budget
+		}
+		transcript.WriteString(line)
+		budget -= tokens
+		n++
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model:       summaryModel,
+		MaxTokens:   summaryMaxTokens,
+		Temperature: nonZero(0),
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summaryPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: "Current summary:\n" + prev + "\n\nNew messages:\n" + transcript.String()},
+		},
+	}
+	resp, err := c.createCompletion(ctx, req)
+	if err != nil {
+		return nil, 0, internal.Usage{}, err
+	}
+	return &internal.ChatSummary{
+		ChatID:    chatID,
+		LastSeq:   msgs[n-1].Seq,
+		Content:   strings.TrimSpace(resp.Choices[0].Message.Content),
+		CreatedAt: time.Now().UTC(),
+	}, n, usageOf(resp), nil
+}
@@ -0,0 +1,51 @@
+package chatbot
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	titleModel     = openai.GPT3Dot5Turbo0613
+	titleMaxTokens = 30
+	maxTitleLength = 50 // in runes
+	titlePrompt    = `You name conversations between a user and an assistant.
+You are given the first message of the user and the reply of the assistant.
+Write a title of at most 6 words in the language of the user's message.
+Reply with the title only, without quotes or a trailing period.`
+)
+
+// GenerateTitle names a chat after its first exchange, the user message question with the reply answer.
+// Long messages are cut to their start, which is enough to tell what the chat is about.
+// It returns the usage of the call with the title.
+func (c *Chatbot) GenerateTitle(ctx context.Context, question, answer string) (string, internal.Usage, error) {
+	req := openai.ChatCompletionRequest{
+		Model:       titleModel,
+		MaxTokens:   titleMaxTokens,
+		Temperature: nonZero(0),
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: titlePrompt},
+			{Role: openai.ChatMessageRoleUser, Content: "User:\n" + trimToFirstRunes(question, 1000) +
+				"\n\nAssistant:\n" + trimToFirstRunes(answer, 1000)},
+		},
+	}
+	resp, err := c.createCompletion(ctx, req)
+	if err != nil {
+		return "", internal.Usage{}, err
+	}
+	title := strings.TrimSpace(resp.Choices[0].Message.Content)
+	title = strings.Trim(title, "\"'“”「」")
+	title = strings.TrimSuffix(title, ".")
+	return trimToFirstRunes(strings.TrimSpace(title), maxTitleLength), usageOf(resp), nil
+}
+
+func trimToFirstRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
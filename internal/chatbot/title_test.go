@@ -0,0 +1,31 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGenerateTitle(t *testing.T) {
+	c := New(NewFake(`"Steeping green tea."`))
+
+	title, usage, err := c.GenerateTitle(context.Background(), "How long do I steep green tea?", "Two minutes at 80 degrees.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Steeping green tea" {
+		t.Errorf("got %q, want the reply without quotes and the period", title)
+	}
+	if usage.Tokens() == 0 {
+		t.Error("got no usage")
+	}
+}
+
+func TestGenerateTitleWithoutChoices(t *testing.T) {
+	// deadlineProvider answers without a choice
+	c := New(&deadlineProvider{})
+
+	if _, _, err := c.GenerateTitle(context.Background(), "hi", "hello"); !errors.Is(err, ErrNoChoices) {
+		t.Errorf("got %v, want ErrNoChoices", err)
+	}
+}
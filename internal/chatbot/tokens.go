@@ -0,0 +1,69 @@
+package chatbot
+
+import (
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	// every message is wrapped in <|start|>{role}\n{content}<|end|>\n
+	tokensPerMessage = 3
+	// every reply is primed with <|start|>assistant<|message|>
+	tokensPerReply = 3
+)
+
+// fallbackEncoding is used for models tiktoken doesn't know, it is the one of every model in Models.
+const fallbackEncoding = "cl100k_base"
+
+func init() {
+	// the BPE ranks are embedded rather than downloaded on the first count, which a lambda can't afford
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = map[string]*tiktoken.Tiktoken{}
+)
+
+// encoding returns the BPE encoding of model, loading it on first use.
+func encoding(model string) *tiktoken.Tiktoken {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if enc, ok := encodings[model]; ok {
+		return enc
+	}
+	enc, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		enc, err = tiktoken.GetEncoding(fallbackEncoding)
+		if err != nil {
+			// the ranks are embedded, so this only happens if the build is broken
+			panic(err)
+		}
+	}
+	encodings[model] = enc
+	return enc
+}
+
+// CountTokens returns how many tokens text takes in the prompt of model, encoded with the BPE of model.
+func CountTokens(model, text string) int {
+	return len(encoding(model).EncodeOrdinary(text))
+}
+
+// lastTokens returns the longest end of text that takes at most n tokens of model.
+func lastTokens(model, text string, n int) string {
+	enc := encoding(model)
+	tokens := enc.EncodeOrdinary(text)
+	if len(tokens) <= n {
+		return text
+	}
+	end := enc.Decode(tokens[len(tokens)-n:])
+	// the first token may start in the middle of a character, and the end may encode into other tokens on its own
+	for len(end) > 0 && (!utf8.RuneStart(end[0]) || len(enc.EncodeOrdinary(end)) > n) {
+		_, size := utf8.DecodeRuneInString(end)
+		end = end[size:]
+	}
+	return end
+}
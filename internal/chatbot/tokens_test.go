@@ -0,0 +1,57 @@
+package chatbot
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		// counts of cl100k_base, the encoding of every model in Models
+		{"", 0},
+		{"hello world", 2},
+		{"tiktoken is great!", 6},
+		{"antidisestablishmentarianism", 6},
+		{"안녕하세요", 5},
+	}
+	for _, tt := range tests {
+		if got := CountTokens(openai.GPT3Dot5Turbo0613, tt.text); got != tt.want {
+			t.Errorf("CountTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCountTokensByModel(t *testing.T) {
+	text := "The quick brown fox jumps over the lazy dog."
+	for model := range Models {
+		if got := CountTokens(model, text); got != 10 {
+			t.Errorf("CountTokens(%s) = %d, want 10", model, got)
+		}
+	}
+	// models tiktoken doesn't know fall back to cl100k_base
+	if got := CountTokens("unknown", text); got != 10 {
+		t.Errorf("CountTokens(unknown) = %d, want 10", got)
+	}
+}
+
+func TestLastTokens(t *testing.T) {
+	text := strings.Repeat("차를 우려요. ", 50)
+	for _, n := range []int{1, 7, 64, 1000} {
+		end := lastTokens(openai.GPT3Dot5Turbo0613, text, n)
+		if !utf8.ValidString(end) {
+			t.Errorf("end of %d tokens isn't valid utf-8", n)
+		}
+		if !strings.HasSuffix(text, end) {
+			t.Errorf("%.20q... isn't the end of the text", end)
+		}
+		if tokens := CountTokens(openai.GPT3Dot5Turbo0613, end); tokens > n {
+			t.Errorf("end takes %d tokens, over %d", tokens, n)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+// maxToolRounds is how many times the model may call tools for one message.
+// After that it is asked without tools, so that it answers with what it has.
+const maxToolRounds = 5
+
+var ErrTooManyToolCalls = errors.New("chatbot kept calling tools without answering")
+
+const maxToolResultLength = 4000 // in runes
+
+// roleFunctionCall is the role of a stored tool call.
+// openai sends it as an assistant message with a function call, the content being its arguments.
+const roleFunctionCall = "function_call"
+
+// Tool is a function implemented in go that the model can call while answering.
+type Tool struct {
+	// Definition is the name, description and json schema of the parameters shown to the model.
+	Definition openai.FunctionDefinition
+	// Run runs the tool with the arguments the model gave, in json, and returns the result for the model.
+	// An error is sent to the model as the result, so that it can tell the user or try again.
+	Run func(ctx context.Context, call ToolCall) (string, error)
+}
+
+// ToolCall is a call of a tool on behalf of the user of a chat.
+// Tools must only touch what belongs to UserID.
+type ToolCall struct {
+	UserID    string
+	ChatID    string
+	Arguments string
+}
+
+// RegisterTools makes tools available to the model in every chat.
+// It is not safe to call while chats are answered, register the tools at startup.
+func (c *Chatbot) RegisterTools(tools ...Tool) {
+	for _, tool := range tools {
+		if _, ok := c.tools[tool.Definition.Name]; !ok {
+			c.toolNames = append(c.toolNames, tool.Definition.Name)
+		}
+		c.tools[tool.Definition.Name] = tool
+	}
+}
+
+func (c *Chatbot) functions() []openai.FunctionDefinition {
+	functions := make([]openai.FunctionDefinition, 0, len(c.toolNames))
+	for _, name := range c.toolNames {
+		functions = append(functions, c.tools[name].Definition)
+	}
+	return functions
+}
+
+// functionTokens estimates the prompt tokens the definitions of functions take.
+func functionTokens(model string, functions []openai.FunctionDefinition) int {
+	if len(functions) == 0 {
+		return 0
+	}
+	definitions, _ := json.Marshal(functions)
+	return CountTokens(model, string(definitions))
+}
+
+// runTool runs the tool call and returns its result as the message following it.
+func (c *Chatbot) runTool(ctx context.Context, conv Conversation, call *internal.Message) *internal.Message {
+	result := &internal.Message{
+		ChatID:    call.ChatID,
+		Seq:       call.Seq + 1,
+		ParentSeq: call.Seq,
+		Role:      openai.ChatMessageRoleFunction,
+		Name:      call.Name,
+	}
+	tool, ok := c.tools[call.Name]
+	if !ok {
+		result.Content = "error: unknown tool " + call.Name
+	} else if content, err := tool.Run(ctx, ToolCall{UserID: conv.UserID, ChatID: conv.Chat.ID, Arguments: call.Content}); err != nil {
+		result.Content = "error: " + err.Error()
+	} else {
+		result.Content = trimToFirstRunes(content, maxToolResultLength)
+	}
+	result.CreatedAt = time.Now().UTC()
+	return result
+}
+
+// toOpenAI converts a stored message to the shape of the openai api.
+func toOpenAI(role, name, content string) openai.ChatCompletionMessage {
+	switch role {
+	case roleFunctionCall:
+		return openai.ChatCompletionMessage{
+			Role:         openai.ChatMessageRoleAssistant,
+			FunctionCall: &openai.FunctionCall{Name: name, Arguments: content},
+		}
+	case openai.ChatMessageRoleFunction:
+		return openai.ChatCompletionMessage{Role: role, Name: name, Content: content}
+	default:
+		return openai.ChatCompletionMessage{Role: role, Content: content}
+	}
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -25,8 +27,24 @@ type Config struct {
 	DBPassword      string
 	OpenAIAPIKey    string
 	OpenAIAPIOrgID  string
+	// LLMProvider is the backend of the chatbot, one of LLMProviderOpenAI and LLMProviderFake
+	LLMProvider string
+	// usage quotas per user, 0 for no limit
+	DailyMessageQuota   int
+	DailyTokenQuota     int
+	MonthlyMessageQuota int
+	MonthlyTokenQuota   int
+	// WorkerFunctionName is the lambda function answering messages in the background, empty to answer them within the request
+	WorkerFunctionName string
+	// IdempotencyKeyTTL is how long a response is kept for retries with its Idempotency-Key
+	IdempotencyKeyTTL string
 }
 
+const (
+	LLMProviderOpenAI = "openai"
+	LLMProviderFake   = "fake"
+)
+
 type PostgresSecret struct {
 	User     string `json:"username"`
 	Password string `json:"password"`
@@ -54,6 +72,20 @@ func Init(ctx context.Context) (*Config, error) {
 	if cfg.Region == "" {
 		cfg.Region = "ap-northeast-2"
 	}
+	cfg.IdempotencyKeyTTL = os.Getenv("IDEMPOTENCY_KEY_TTL")
+	if cfg.IdempotencyKeyTTL == "" {
+		cfg.IdempotencyKeyTTL = "24h"
+	}
+	for key, quota := range map[string]*int{
+		"DAILY_MESSAGE_QUOTA":   &cfg.DailyMessageQuota,
+		"DAILY_TOKEN_QUOTA":     &cfg.DailyTokenQuota,
+		"MONTHLY_MESSAGE_QUOTA": &cfg.MonthlyMessageQuota,
+		"MONTHLY_TOKEN_QUOTA":   &cfg.MonthlyTokenQuota,
+	} {
+		if err := intFromEnv(key, quota); err != nil {
+			return nil, err
+		}
+	}
 	if os.Getenv("LOCAL") == "true" {
 		cfg.AccessTokenTTL = "5m"
 		cfg.RefreshTokenTTL = "10m"
@@ -63,12 +95,18 @@ func Init(ctx context.Context) (*Config, error) {
 		cfg.DBPort = "5432"
 		cfg.DBUser = "postgres"
 		cfg.DBPassword = "password"
+		cfg.OpenAIAPIKey = os.Getenv("OPENAI_API_KEY")
+		cfg.LLMProvider = LLMProviderOpenAI
+		if cfg.OpenAIAPIKey == "" {
+			cfg.LLMProvider = LLMProviderFake
+		}
 		return cfg, nil
 	}
 	cfg.AccessTokenTTL = os.Getenv("ACCESS_TOKEN_TTL")
 	cfg.RefreshTokenTTL = os.Getenv("REFRESH_TOKEN_TTL")
 	cfg.DBHost = os.Getenv("DB_HOST")
 	cfg.DBPort = os.Getenv("DB_PORT")
+	cfg.WorkerFunctionName = os.Getenv("WORKER_FUNCTION_NAME")
 
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(cfg.Region),
@@ -135,5 +173,20 @@ func Init(ctx context.Context) (*Config, error) {
 	cfg.RefreshTokenKey = hmacSecret.RefreshTokenKey
 	cfg.OpenAIAPIKey = openAIAPISecret.Key
 	cfg.OpenAIAPIOrgID = openAIAPISecret.OrganizationID
+	cfg.LLMProvider = LLMProviderOpenAI
 	return cfg, nil
 }
+
+// intFromEnv reads the environment variable key into v, leaving v as is if it is unset.
+func intFromEnv(key string, v *int) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*v = n
+	return nil
+}
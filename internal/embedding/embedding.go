@@ -0,0 +1,62 @@
+// Package embedding turns the messages and scraps of users into vectors, so that they can be searched by meaning.
+package embedding
+
+import (
+	"context"
+	"math"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+// maxTextLength bounds what is embedded of a text, in runes, within the input limit of the model
+const maxTextLength = 1500
+
+// Embedder embeds texts into vectors whose cosine similarity tells how close the texts are in meaning.
+type Embedder interface {
+	// Model names the embeddings, vectors of different models can't be compared
+	Model() string
+	// Embed returns the embeddings of texts, in order
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// MessageText is what is embedded of msg, empty for messages not worth searching like tool calls.
+func MessageText(msg internal.Message) string {
+	if msg.Role != openai.ChatMessageRoleUser && msg.Role != openai.ChatMessageRoleAssistant {
+		return ""
+	}
+	return trim(msg.Content)
+}
+
+// ScrapText is what is embedded of scrap, the memo then the scrapped message.
+func ScrapText(scrap internal.ScrapWithMessage) string {
+	text := scrap.Memo
+	if scrap.Message != nil {
+		text += "\n" + scrap.Message.Content
+	}
+	return trim(text)
+}
+
+func trim(text string) string {
+	if runes := []rune(text); len(runes) > maxTextLength {
+		return string(runes[:maxTextLength])
+	}
+	return text
+}
+
+// Cosine is the cosine similarity of a and b, 0 if they differ in length or one of them is zero.
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
@@ -0,0 +1,98 @@
+package embedding
+
+import (
+	"context"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCosine(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float64
+	}{
+		{"same", []float32{1, 2, 3}, []float32{1, 2, 3}, 1},
+		{"scaled", []float32{1, 2, 3}, []float32{2, 4, 6}, 1},
+		{"orthogonal", []float32{1, 0}, []float32{0, 1}, 0},
+		{"opposite", []float32{1, 2}, []float32{-1, -2}, -1},
+		{"zero", []float32{0, 0}, []float32{1, 2}, 0},
+		{"lengths differ", []float32{1, 2}, []float32{1, 2, 3}, 0},
+	}
+	for _, tt := range tests {
+		if got := Cosine(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %f, want %f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFakeRanksByMeaning(t *testing.T) {
+	f := NewFake()
+	docs := []string{
+		"Paris is the capital of France.",
+		"Steep green tea at 80 degrees for two minutes.",
+		"녹차는 80도에서 2분 우려요.",
+	}
+	vectors, err := f.Embed(context.Background(), append([]string{"how long to steep green tea"}, docs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := vectors[0]
+	ranked := []int{0, 1, 2}
+	sort.Slice(ranked, func(i, j int) bool {
+		return Cosine(query, vectors[ranked[i]+1]) > Cosine(query, vectors[ranked[j]+1])
+	})
+	if docs[ranked[0]] != docs[1] {
+		t.Errorf("best match is %q, want the one about green tea", docs[ranked[0]])
+	}
+
+	again, err := f.Embed(context.Background(), []string{docs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Cosine(again[0], vectors[2]) != 1 {
+		t.Error("the same text embeds differently")
+	}
+}
+
+func TestFakeMatchesKoreanAcrossParticles(t *testing.T) {
+	vectors, err := NewFake().Embed(context.Background(), []string{"녹차를", "녹차는 맛있어요", "커피는 맛있어요"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Cosine(vectors[0], vectors[1]) <= Cosine(vectors[0], vectors[2]) {
+		t.Error("녹차를 isn't closer to 녹차는 than to 커피는")
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	tests := []struct {
+		role string
+		want string
+	}{
+		{openai.ChatMessageRoleUser, "hello"},
+		{openai.ChatMessageRoleAssistant, "hello"},
+		{openai.ChatMessageRoleFunction, ""},
+		{openai.ChatMessageRoleSystem, ""},
+	}
+	for _, tt := range tests {
+		if got := MessageText(internal.Message{Role: tt.role, Content: "hello"}); got != tt.want {
+			t.Errorf("text of a %s message is %q, want %q", tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestScrapText(t *testing.T) {
+	scrap := internal.ScrapWithMessage{Memo: "tea", Message: &internal.Message{Content: "steep it for two minutes"}}
+	if got, want := ScrapText(scrap), "tea\nsteep it for two minutes"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	long := internal.ScrapWithMessage{Memo: string(make([]rune, 2*maxTextLength))}
+	if got := []rune(ScrapText(long)); len(got) != maxTextLength {
+		t.Errorf("embeds %d runes of a long scrap, want %d", len(got), maxTextLength)
+	}
+}
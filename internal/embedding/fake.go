@@ -0,0 +1,50 @@
+package embedding
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// fakeDimensions is the length of the vectors of Fake
+const fakeDimensions = 256
+
+// Fake is an Embedder that embeds in process, for tests and for running locally without an openai api key.
+// A text is embedded as its words and their character bigrams hashed into a fixed number of dimensions,
+// so texts sharing words are similar, and the same text always gets the same vector.
+type Fake struct{}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+func (f *Fake) Model() string {
+	return "fake"
+}
+
+func (f *Fake) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embedding := make([]float32, fakeDimensions)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			embedding[hash(word)]++
+			// korean words carry particles, their bigrams match across them
+			runes := []rune(word)
+			for j := 0; j+1 < len(runes); j++ {
+				embedding[hash(string(runes[j:j+2]))] += 0.5
+			}
+		}
+		embeddings[i] = embedding
+	}
+	return embeddings, nil
+}
+
+func hash(term string) int {
+	h := fnv.New32a()
+	h.Write([]byte(term))
+	return int(h.Sum32() % fakeDimensions)
+}
@@ -0,0 +1,43 @@
+package embedding
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+type openAIEmbedder struct {
+	client *openai.Client
+}
+
+// NewOpenAI embeds with text-embedding-ada-002, whose vectors have 1536 dimensions.
+func NewOpenAI(client *openai.Client) Embedder {
+	return &openAIEmbedder{client: client}
+}
+
+func (e *openAIEmbedder) Model() string {
+	return openai.AdaEmbeddingV2.String()
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	input := make([]string, len(texts))
+	for i, text := range texts {
+		// openai finds newlines make embeddings worse
+		input[i] = strings.ReplaceAll(text, "\n", " ")
+	}
+	resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: input,
+		Model: openai.AdaEmbeddingV2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float32, len(texts))
+	for _, data := range resp.Data {
+		if data.Index < len(embeddings) {
+			embeddings[data.Index] = data.Embedding
+		}
+	}
+	return embeddings, nil
+}
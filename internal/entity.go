@@ -6,12 +6,41 @@ import (
 	"time"
 )
 
+// RegisterInput is a user registering with their first credential.
+type RegisterInput struct {
+	UserID         string
+	CredentialType string
+	CredentialID   string
+	CreatedAt      *time.Time
+}
+
 type Chat struct {
 	ID        string     `json:"id" example:"Hjejwerhj"`
 	Name      string     `json:"name" example:"basic"`
 	CreatedAt *time.Time `json:"createdAt" example:"2021-01-01T00:00:00Z"`
+
+	// generation settings, used for every message sent in the chat
+	Model            string  `json:"model" example:"gpt-3.5-turbo-0613"`
+	Temperature      float32 `json:"temperature" example:"1"`
+	TopP             float32 `json:"topP" example:"1"`
+	MaxTokens        int     `json:"maxTokens" example:"1000"`
+	PresencePenalty  float32 `json:"presencePenalty" example:"0"`
+	FrequencyPenalty float32 `json:"frequencyPenalty" example:"0"`
+	// sent as the system message ahead of the conversation, never stored as a message
+	SystemPrompt string `json:"systemPrompt" example:"You are a kind tutor."`
+	// UseScraps grounds the replies in the scraps of the user most relevant to each message, which replies cite
+	UseScraps bool `json:"useScraps" example:"false"`
+	// the last message of the active branch, 0 while the chat is empty
+	HeadSeq int `json:"headSeq" example:"4"`
 }
 
+const (
+	DefaultChatModel       = "gpt-3.5-turbo-0613"
+	DefaultChatTemperature = 1
+	DefaultChatTopP        = 1
+	DefaultChatMaxTokens   = 1000
+)
+
 func NewChat() (*Chat, error) {
 	id := make([]byte, 15) // base32 encoding muiltiple of 5
 	_, err := rand.Read(id)
@@ -20,30 +49,177 @@ func NewChat() (*Chat, error) {
 	}
 	now := time.Now().UTC()
 	return &Chat{
-		ID:        base32.StdEncoding.EncodeToString(id),
-		CreatedAt: &now,
+		ID:          base32.StdEncoding.EncodeToString(id),
+		CreatedAt:   &now,
+		Model:       DefaultChatModel,
+		Temperature: DefaultChatTemperature,
+		TopP:        DefaultChatTopP,
+		MaxTokens:   DefaultChatMaxTokens,
 	}, nil
 }
 
+// Messages of a chat form a tree: every message follows its parent, and editing a message
+// starts a new branch next to it. seq is unique across the branches of a chat.
 // pk is (chat_id, seq)
 type Message struct {
+	ChatID     string    `json:"chatID" example:"Hjejwerhj"`
+	Seq        int       `json:"seq" example:"1"`       // seq starts from 1
+	ParentSeq  int       `json:"parentSeq" example:"0"` // 0 for the first message
+	Content    string    `json:"content"`
+	Role       string    `json:"role"`
+	Name       string    `json:"name,omitempty" example:"search_scraps"`      // the tool of a function_call or function message
+	TemplateID string    `json:"templateID,omitempty" example:"builtin-quiz"` // the prompt template a user message was rendered from
+	CreatedAt  time.Time `json:"createdAt"`
+	Version    int       `json:"version" example:"1"` // the active version, see MessageVersion
+	Generation
+}
+
+// Generation is how an assistant message was generated, empty for user messages.
+type Generation struct {
+	Model            string `json:"model,omitempty" example:"gpt-3.5-turbo-0613"`
+	FinishReason     string `json:"finishReason,omitempty" example:"stop"`
+	PromptTokens     int    `json:"promptTokens,omitempty" example:"120"`
+	CompletionTokens int    `json:"completionTokens,omitempty" example:"80"`
+	// Citations are the scraps of the user the reply cites
+	Citations []string `json:"citations,omitempty" example:"Hjejwerhj"`
+}
+
+type MessageWithScrap struct {
+	ChatID     string    `json:"chatID" example:"Hjejwerhj"`
+	Seq        int       `json:"seq" example:"1"`       // seq starts from 1
+	ParentSeq  int       `json:"parentSeq" example:"0"` // 0 for the first message
+	Content    string    `json:"content"`
+	Role       string    `json:"role"`
+	Name       string    `json:"name,omitempty" example:"search_scraps"`      // the tool of a function_call or function message
+	TemplateID string    `json:"templateID,omitempty" example:"builtin-quiz"` // the prompt template a user message was rendered from
+	CreatedAt  time.Time `json:"createdAt"`
+	Version    int       `json:"version" example:"1"` // the active version, see MessageVersion
+	// seqs of the messages with the same parent, this one included, in ascending order
+	SiblingSeqs []int `json:"siblingSeqs" example:"1,5"`
+	Generation
+
+	Scrap *Scrap `json:"scrap,omitempty"`
+}
+
+// MessageVersion is one of the contents a message had, the first one and every regenerated one.
+// The content of the message is that of its active version.
+// pk is (chat_id, seq, version)
+type MessageVersion struct {
 	ChatID    string    `json:"chatID" example:"Hjejwerhj"`
-	Seq       int       `json:"seq" example:"1"` // seq starts from 1
+	Seq       int       `json:"seq" example:"2"`
+	Version   int       `json:"version" example:"1"` // version starts from 1
 	Content   string    `json:"content"`
-	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"createdAt"`
+	Generation
 }
 
-type MessageWithScrap struct {
+// Usage is what a user consumed, rolled up per day.
+// Every generated message counts, regenerated ones included.
+// The tokens of summarizing chats and naming them count too, as no message.
+// pk is (user_id, day)
+type Usage struct {
+	Messages         int `json:"messages" example:"12"`
+	PromptTokens     int `json:"promptTokens" example:"3000"`
+	CompletionTokens int `json:"completionTokens" example:"1500"`
+}
+
+func (u Usage) Tokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// ChatSummary is the running summary of a chat, covering its messages up to LastSeq.
+// pk is (chat_id, last_seq)
+type ChatSummary struct {
 	ChatID    string    `json:"chatID" example:"Hjejwerhj"`
-	Seq       int       `json:"seq" example:"1"` // seq starts from 1
+	LastSeq   int       `json:"lastSeq" example:"10"`
 	Content   string    `json:"content"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"createdAt"`
+	CreatedAt time.Time `json:"createdAt" example:"2021-01-01T00:00:00Z"`
+}
 
-	Scrap *Scrap `json:"scrap,omitempty"`
+// ModerationAudit records a decision of moderation on what a user sent (stage input)
+// or what the chatbot replied (stage output).
+type ModerationAudit struct {
+	UserID     string
+	ChatID     string
+	Seq        int // 0 for input, which is checked before it gets a seq
+	Stage      string
+	Flagged    bool
+	Categories []string
+	Moderator  string
+	Content    string // what was flagged, empty if it was let through
+	CreatedAt  time.Time
 }
 
+const (
+	ModerationStageInput  = "input"
+	ModerationStageOutput = "output"
+)
+
+// Job generates the reply to a user message in the background, for replies that take longer than a request may.
+// pk is id
+type Job struct {
+	ID        string    `json:"id" example:"Hjejwerhj"`
+	UserID    string    `json:"-"`
+	ChatID    string    `json:"chatID" example:"Hjejwerhj"`
+	Seq       int       `json:"seq" example:"3"` // the user message to answer
+	Status    string    `json:"status" example:"done"`
+	ReplySeq  int       `json:"replySeq,omitempty" example:"4"`                // the reply, once done
+	Error     string    `json:"error,omitempty" example:"chatbot_unavailable"` // the error code of why it failed
+	CreatedAt time.Time `json:"createdAt" example:"2021-01-01T00:00:00Z"`
+	UpdatedAt time.Time `json:"updatedAt" example:"2021-01-01T00:00:00Z"`
+}
+
+const (
+	JobStatusPending = "pending"
+	JobStatusRunning = "running"
+	JobStatusDone    = "done"
+	JobStatusFailed  = "failed"
+)
+
+func NewJob(userID, chatID string, seq int) (*Job, error) {
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &Job{
+		ID:        id,
+		UserID:    userID,
+		ChatID:    chatID,
+		Seq:       seq,
+		Status:    JobStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+func (j Job) Finished() bool {
+	return j.Status == JobStatusDone || j.Status == JobStatusFailed
+}
+
+// IdempotentRequest is a request made with an Idempotency-Key, with its response once it has one,
+// so that a retry with the same key gets the response instead of repeating the request.
+// pk is (user_id, key)
+type IdempotentRequest struct {
+	UserID string
+	Key    string
+	// RequestHash is the hash of the method, path and body, a retry has to match
+	RequestHash string
+	Status      string
+	// the response, once done
+	ResponseStatus      int
+	ResponseContentType string
+	ResponseLocation    string
+	ResponseBody        []byte
+	CreatedAt           time.Time
+	ExpiresAt           time.Time
+}
+
+const (
+	IdempotentRequestRunning = "running"
+	IdempotentRequestDone    = "done"
+)
+
 type Scrapbook struct {
 	ID        string    `json:"id" example:"Hjejwerhj"`
 	Name      string    `json:"name" example:"basic"`
@@ -87,6 +263,53 @@ type ScrapWithMessage struct {
 	Message *Message `json:"message,omitempty"`
 }
 
+const (
+	SearchResultChat    = "chat"
+	SearchResultScrap   = "scrap"
+	SearchResultMessage = "message"
+)
+
+// SearchResult is a chat, a scrap or a message of the user found by a search, Type telling which one is set.
+type SearchResult struct {
+	Type string `json:"type" example:"scrap"`
+	// Score is how well it matches, higher is better. Scores of different searches don't compare.
+	Score   float64           `json:"score" example:"0.87"`
+	Chat    *Chat             `json:"chat,omitempty"`
+	Scrap   *ScrapWithMessage `json:"scrap,omitempty"`
+	Message *Message          `json:"message,omitempty"`
+	// Snippet is the matching part of the text, html escaped with the matches in <mark>, for keyword search
+	Snippet string `json:"snippet,omitempty" example:"식물의 <mark>광합성</mark>은 빛 에너지를"`
+}
+
+// SearchFilter narrows a keyword search. Zero fields don't filter.
+type SearchFilter struct {
+	// Types are the kinds of results, SearchResultChat, SearchResultMessage and SearchResultScrap
+	Types []string
+	// ChatID keeps the chat, its messages and the scraps of its messages
+	ChatID string
+	// ScrapbookID keeps the scraps in the scrapbook, and so nothing else
+	ScrapbookID string
+	// From and To bound when the results were created, From included and To excluded
+	From *time.Time
+	To   *time.Time
+}
+
+// Wants tells whether the filter keeps results of resultType.
+func (f SearchFilter) Wants(resultType string) bool {
+	if f.ScrapbookID != "" && resultType != SearchResultScrap {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == resultType {
+			return true
+		}
+	}
+	return false
+}
+
 func NewID() (string, error) {
 	id := make([]byte, 15) // base32 encoding muiltiple of 5
 	_, err := rand.Read(id)
@@ -0,0 +1,22 @@
+// Package jobs hands replies that take longer than a request to a worker.
+package jobs
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrQueueFull = errors.New("job queue is full")
+
+// Queue delivers jobs to the worker running them. A job may be delivered more than once.
+type Queue interface {
+	Enqueue(ctx context.Context, jobID string) error
+}
+
+// Event is the payload a worker is invoked with.
+type Event struct {
+	JobID string `json:"jobID"`
+}
+
+// RunFunc runs the job with jobID, recording its result on the job.
+type RunFunc func(ctx context.Context, jobID string) error
@@ -0,0 +1,34 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// Lambda delivers jobs by invoking the worker function asynchronously with an Event.
+// Lambda retries an invocation that failed, so the worker has to check that the job is still pending.
+type Lambda struct {
+	client       lambdaiface.LambdaAPI
+	functionName string
+}
+
+func NewLambda(client lambdaiface.LambdaAPI, functionName string) *Lambda {
+	return &Lambda{client: client, functionName: functionName}
+}
+
+func (l *Lambda) Enqueue(ctx context.Context, jobID string) error {
+	payload, err := json.Marshal(Event{JobID: jobID})
+	if err != nil {
+		return err
+	}
+	_, err = l.client.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(l.functionName),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	return err
+}
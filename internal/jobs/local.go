@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/kataras/golog"
+)
+
+// localQueueSize is how many jobs may wait for a local worker.
+const localQueueSize = 100
+
+// Local runs jobs on goroutines of the server process, for running without lambda.
+// Jobs waiting are lost when the process exits.
+type Local struct {
+	jobs chan string
+}
+
+// NewLocal starts workers goroutines running the jobs enqueued with run.
+func NewLocal(run RunFunc, workers int) *Local {
+	l := &Local{jobs: make(chan string, localQueueSize)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for jobID := range l.jobs {
+				if err := run(context.Background(), jobID); err != nil {
+					golog.Error("jobs: run ", jobID, ": ", err)
+				}
+			}
+		}()
+	}
+	return l
+}
+
+func (l *Local) Enqueue(ctx context.Context, jobID string) error {
+	select {
+	case l.jobs <- jobID:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
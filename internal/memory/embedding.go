@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+)
+
+// vector is an embedding and the model it was made with, vectors of different models don't compare.
+type vector struct {
+	Model     string
+	Embedding []float32
+}
+
+func (db *DB) UpsertMessageEmbedding(ctx context.Context, chatID string, seq int, model string, embedding []float32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := messageKey{chatID, seq}
+	if _, ok := db.messages[key]; !ok {
+		return apperror.New(apperror.CodeNotFound)
+	}
+	db.messageVectors[key] = vector{Model: model, Embedding: append([]float32(nil), embedding...)}
+	return nil
+}
+
+func (db *DB) UpsertScrapEmbedding(ctx context.Context, scrapID, model string, embedding []float32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.scraps[scrapID]; !ok {
+		return apperror.New(apperror.CodeNotFound)
+	}
+	db.scrapVectors[scrapID] = vector{Model: model, Embedding: append([]float32(nil), embedding...)}
+	return nil
+}
+
+// SearchMyMessagesByEmbedding returns up to limit messages of the user closest to query, best first,
+// scored by cosine similarity. Only embeddings of model are searched.
+func (db *DB) SearchMyMessagesByEmbedding(ctx context.Context, userID, model string, query []float32, limit int) ([]internal.SearchResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var results []internal.SearchResult
+	for key, v := range db.messageVectors {
+		if db.chats[key.ChatID].UserID != userID || !v.comparesWith(model, query) {
+			continue
+		}
+		msg := db.messages[key]
+		results = append(results, internal.SearchResult{
+			Type:    internal.SearchResultMessage,
+			Score:   embedding.Cosine(query, v.Embedding),
+			Message: &internal.Message{ChatID: msg.ChatID, Seq: msg.Seq, Content: msg.Content, Role: msg.Role, CreatedAt: msg.CreatedAt},
+		})
+	}
+	return best(results, limit), nil
+}
+
+// SearchMyScrapsByEmbedding is SearchMyMessagesByEmbedding for scraps.
+func (db *DB) SearchMyScrapsByEmbedding(ctx context.Context, userID, model string, query []float32, limit int) ([]internal.SearchResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var results []internal.SearchResult
+	for scrapID, v := range db.scrapVectors {
+		scrap := db.scraps[scrapID]
+		if db.chats[scrap.Message.ChatID].UserID != userID || !v.comparesWith(model, query) {
+			continue
+		}
+		withMessage := db.withMessage(scrap)
+		results = append(results, internal.SearchResult{
+			Type:  internal.SearchResultScrap,
+			Score: embedding.Cosine(query, v.Embedding),
+			Scrap: &withMessage,
+		})
+	}
+	return best(results, limit), nil
+}
+
+func (v vector) comparesWith(model string, query []float32) bool {
+	return v.Model == model && len(v.Embedding) == len(query)
+}
+
+// best returns up to limit of results, best first.
+func best(results []internal.SearchResult, limit int) []internal.SearchResult {
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
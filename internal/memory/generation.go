@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+type generation struct {
+	ChatID     string
+	Cancelled  bool
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+func (db *DB) InsertGeneration(ctx context.Context, generationID, chatID string, startedAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.chats[chatID]; !ok {
+		return apperror.New(apperror.CodeNotFound)
+	}
+	if _, ok := db.generations[generationID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	db.generations[generationID] = &generation{ChatID: chatID, StartedAt: startedAt}
+	return nil
+}
+
+func (db *DB) FinishGeneration(ctx context.Context, generationID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if generation, ok := db.generations[generationID]; ok {
+		finishedAt := time.Now().UTC()
+		generation.FinishedAt = &finishedAt
+	}
+	return nil
+}
+
+func (db *DB) SelectGenerationCancelled(ctx context.Context, generationID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	generation, ok := db.generations[generationID]
+	if !ok {
+		return false, sql.ErrNoRows
+	}
+	return generation.Cancelled, nil
+}
+
+// CancelGenerations asks the generations of the chat started after since and not finished yet to stop.
+// It returns a generation_not_found error if there is none.
+func (db *DB) CancelGenerations(ctx context.Context, userID, chatID string, since time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return err
+	}
+	cancelled := false
+	for _, generation := range db.generations {
+		if generation.ChatID == chatID && generation.FinishedAt == nil && generation.StartedAt.After(since) {
+			generation.Cancelled = true
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		return apperror.New(apperror.CodeGenerationNotFound)
+	}
+	return nil
+}
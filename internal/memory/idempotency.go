@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+type idempotencyKey struct {
+	UserID string
+	Key    string
+}
+
+// ClaimIdempotentRequest records req as running unless the user made a request with its key already,
+// like postgres.DB.ClaimIdempotentRequest.
+func (db *DB) ClaimIdempotentRequest(ctx context.Context, req internal.IdempotentRequest, staleBefore time.Time) (internal.IdempotentRequest, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for key, prev := range db.idempotent {
+		if key.UserID == req.UserID && prev.ExpiresAt.Before(req.CreatedAt) {
+			delete(db.idempotent, key)
+		}
+	}
+	key := idempotencyKey{req.UserID, req.Key}
+	prev, ok := db.idempotent[key]
+	if ok && !(prev.Status == internal.IdempotentRequestRunning && prev.CreatedAt.Before(staleBefore)) {
+		prev.ResponseBody = append([]byte(nil), prev.ResponseBody...)
+		return prev, false, nil
+	}
+	if err := db.ensureUser(req.UserID); err != nil {
+		return internal.IdempotentRequest{}, false, err
+	}
+	claimed := req
+	claimed.Status = internal.IdempotentRequestRunning
+	claimed.ResponseStatus = 0
+	claimed.ResponseContentType = ""
+	claimed.ResponseLocation = ""
+	claimed.ResponseBody = nil
+	db.idempotent[key] = claimed
+	return req, true, nil
+}
+
+// FinishIdempotentRequest records the response of the request claimed with ClaimIdempotentRequest.
+func (db *DB) FinishIdempotentRequest(ctx context.Context, req internal.IdempotentRequest) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := idempotencyKey{req.UserID, req.Key}
+	prev, ok := db.idempotent[key]
+	if !ok {
+		return nil
+	}
+	prev.Status = internal.IdempotentRequestDone
+	prev.ResponseStatus = req.ResponseStatus
+	prev.ResponseContentType = req.ResponseContentType
+	prev.ResponseLocation = req.ResponseLocation
+	prev.ResponseBody = append([]byte(nil), req.ResponseBody...)
+	db.idempotent[key] = prev
+	return nil
+}
+
+// ReleaseIdempotentRequest forgets the request claimed with ClaimIdempotentRequest, so that it can be retried.
+func (db *DB) ReleaseIdempotentRequest(ctx context.Context, userID, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.idempotent, idempotencyKey{userID, key})
+	return nil
+}
@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+// InsertMessageWithJob appends the user message like AppendTurn, together with the job answering it.
+// The seq of msg is assigned here, and so is that of the job.
+func (db *DB) InsertMessageWithJob(ctx context.Context, userID string, msg *internal.Message, job *internal.Job) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, msg.ChatID); err != nil {
+		return err
+	}
+	if err := db.ensureParent(*msg); err != nil {
+		return err
+	}
+	if _, ok := db.jobs[job.ID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	assignSeqs([]*internal.Message{msg}, db.lastSeq(msg.ChatID))
+	job.Seq = msg.Seq
+	db.insertMessage(userID, *msg)
+	stored := *job
+	stored.UserID = userID
+	stored.ReplySeq = 0
+	stored.Error = ""
+	db.jobs[job.ID] = &stored
+	return nil
+}
+
+// SelectJob returns the job for the worker running it, whoever it belongs to.
+func (db *DB) SelectJob(ctx context.Context, jobID string) (internal.Job, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	job, ok := db.jobs[jobID]
+	if !ok {
+		return internal.Job{}, apperror.Wrap(apperror.CodeJobNotFound, sql.ErrNoRows)
+	}
+	return *job, nil
+}
+
+func (db *DB) SelectMyJob(ctx context.Context, userID, chatID, jobID string) (internal.Job, error) {
+	job, err := db.SelectJob(ctx, jobID)
+	if err != nil {
+		return internal.Job{}, err
+	}
+	if job.UserID != userID || job.ChatID != chatID {
+		return internal.Job{}, apperror.New(apperror.CodeJobNotFound)
+	}
+	return job, nil
+}
+
+// SelectUnfinishedJob returns the latest job of the chat that is pending or running and was updated after since.
+// It returns sql.ErrNoRows if there is none.
+func (db *DB) SelectUnfinishedJob(ctx context.Context, chatID string, since time.Time) (internal.Job, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var latest *internal.Job
+	for _, job := range db.jobs {
+		unfinished := job.Status == internal.JobStatusPending || job.Status == internal.JobStatusRunning
+		if job.ChatID == chatID && unfinished && job.UpdatedAt.After(since) && (latest == nil || job.CreatedAt.After(latest.CreatedAt)) {
+			latest = job
+		}
+	}
+	if latest == nil {
+		return internal.Job{}, sql.ErrNoRows
+	}
+	return *latest, nil
+}
+
+// StartJob marks the job running and reports whether it was pending.
+// A job delivered twice is only run by the worker that started it first.
+func (db *DB) StartJob(ctx context.Context, jobID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	job, ok := db.jobs[jobID]
+	if !ok || job.Status != internal.JobStatusPending {
+		return false, nil
+	}
+	job.Status = internal.JobStatusRunning
+	job.UpdatedAt = time.Now().UTC()
+	return true, nil
+}
+
+func (db *DB) FinishJob(ctx context.Context, jobID string, replySeq int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if job, ok := db.jobs[jobID]; ok {
+		job.Status = internal.JobStatusDone
+		job.ReplySeq = replySeq
+		job.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+// FailJob records why the job failed, unless it is finished already.
+func (db *DB) FailJob(ctx context.Context, jobID, reason string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if job, ok := db.jobs[jobID]; ok && (job.Status == internal.JobStatusPending || job.Status == internal.JobStatusRunning) {
+		job.Status = internal.JobStatusFailed
+		job.Error = reason
+		job.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
@@ -0,0 +1,930 @@
+// Package memory keeps the data of the server in process, for testing the server without postgres.
+// DB answers like postgres.DB, with its errors and the cascades of devtools/db.sql, and loses everything when the process exits.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+type credential struct {
+	Type string
+	ID   string
+}
+
+type messageKey struct {
+	ChatID string
+	Seq    int
+}
+
+type scrapOnScrapbook struct {
+	ScrapID     string
+	ScrapbookID string
+}
+
+type chat struct {
+	internal.Chat
+	UserID string
+}
+
+type scrapbook struct {
+	internal.Scrapbook
+	UserID string
+}
+
+type scrap struct {
+	internal.Scrap
+	Message messageKey
+}
+
+// DB is a postgres.DB in memory. The zero DB is not usable, see New.
+type DB struct {
+	// mu guards everything below, every method holding it throughout like a transaction
+	mu sync.Mutex
+
+	users            map[string]time.Time
+	credentials      map[credential]string
+	refreshTokens    map[string]string
+	chats            map[string]*chat
+	messages         map[messageKey]*internal.Message
+	versions         map[messageKey][]internal.MessageVersion
+	summaries        map[messageKey]internal.ChatSummary
+	usages           map[usageKey]internal.Usage
+	moderationAudits []internal.ModerationAudit
+	jobs             map[string]*internal.Job
+	generations      map[string]*generation
+	idempotent       map[idempotencyKey]internal.IdempotentRequest
+	templates        map[string]*template
+	scrapbooks       map[string]*scrapbook
+	scraps           map[string]*scrap
+	scrapsScrapbooks map[scrapOnScrapbook]time.Time
+	messageVectors   map[messageKey]vector
+	scrapVectors     map[string]vector
+}
+
+func New() *DB {
+	return &DB{
+		users:            map[string]time.Time{},
+		credentials:      map[credential]string{},
+		refreshTokens:    map[string]string{},
+		chats:            map[string]*chat{},
+		messages:         map[messageKey]*internal.Message{},
+		versions:         map[messageKey][]internal.MessageVersion{},
+		summaries:        map[messageKey]internal.ChatSummary{},
+		usages:           map[usageKey]internal.Usage{},
+		jobs:             map[string]*internal.Job{},
+		generations:      map[string]*generation{},
+		idempotent:       map[idempotencyKey]internal.IdempotentRequest{},
+		templates:        map[string]*template{},
+		scrapbooks:       map[string]*scrapbook{},
+		scraps:           map[string]*scrap{},
+		scrapsScrapbooks: map[scrapOnScrapbook]time.Time{},
+		messageVectors:   map[messageKey]vector{},
+		scrapVectors:     map[string]vector{},
+	}
+}
+
+func (db *DB) Register(ctx context.Context, inp internal.RegisterInput) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[inp.UserID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	cred := credential{Type: inp.CredentialType, ID: inp.CredentialID}
+	if _, ok := db.credentials[cred]; ok {
+		return apperror.New(apperror.CodeCredentialAlreadyRegistered)
+	}
+	scrapbookID, err := internal.NewID()
+	if err != nil {
+		return err
+	}
+	createdAt := now(inp.CreatedAt)
+	db.users[inp.UserID] = createdAt
+	db.credentials[cred] = inp.UserID
+	db.scrapbooks[scrapbookID] = &scrapbook{
+		Scrapbook: internal.Scrapbook{ID: scrapbookID, Name: internal.DefaultScrapbookName, IsDefault: true, CreatedAt: createdAt},
+		UserID:    inp.UserID,
+	}
+	return nil
+}
+
+func (db *DB) SignIn(ctx context.Context, credentialType, credentialID string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	userID, ok := db.credentials[credential{Type: credentialType, ID: credentialID}]
+	if !ok {
+		return "", apperror.Wrap(apperror.CodeCredentialNotRegistered, sql.ErrNoRows)
+	}
+	return userID, nil
+}
+
+func (db *DB) Logout(ctx context.Context, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.refreshTokens[userID]; !ok {
+		return apperror.New(apperror.CodeRefreshTokenRevoked)
+	}
+	delete(db.refreshTokens, userID)
+	return nil
+}
+
+// Resign deletes the user with what references them, down to the scraps of their chats.
+func (db *DB) Resign(ctx context.Context, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[userID]; !ok {
+		return apperror.New(apperror.CodeUnauthenticated)
+	}
+	for cred, credUserID := range db.credentials {
+		if credUserID == userID {
+			delete(db.credentials, cred)
+		}
+	}
+	delete(db.refreshTokens, userID)
+	for id, chat := range db.chats {
+		if chat.UserID == userID {
+			db.deleteChat(id)
+		}
+	}
+	for key := range db.usages {
+		if key.UserID == userID {
+			delete(db.usages, key)
+		}
+	}
+	audits := db.moderationAudits[:0]
+	for _, audit := range db.moderationAudits {
+		if audit.UserID != userID {
+			audits = append(audits, audit)
+		}
+	}
+	db.moderationAudits = audits
+	for id, job := range db.jobs {
+		if job.UserID == userID {
+			delete(db.jobs, id)
+		}
+	}
+	for key := range db.idempotent {
+		if key.UserID == userID {
+			delete(db.idempotent, key)
+		}
+	}
+	for id, template := range db.templates {
+		if template.UserID == userID {
+			delete(db.templates, id)
+		}
+	}
+	for id, scrapbook := range db.scrapbooks {
+		if scrapbook.UserID == userID {
+			db.deleteScrapbook(id)
+		}
+	}
+	delete(db.users, userID)
+	return nil
+}
+
+func (db *DB) IsRefreshTokenExists(ctx context.Context, userID, tokenID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored, ok := db.refreshTokens[userID]
+	return ok && stored == tokenID, nil
+}
+
+func (db *DB) UpsertRefreshToken(ctx context.Context, userID, tokenID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureUser(userID); err != nil {
+		return err
+	}
+	db.refreshTokens[userID] = tokenID
+	return nil
+}
+
+// SelectMyChats returns a page of the chats of the user, newest first.
+func (db *DB) SelectMyChats(ctx context.Context, userID string, page internal.Page) ([]internal.Chat, internal.Cursors, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := createdAtCursor(page); err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	var chats []internal.Chat
+	for _, chat := range db.chats {
+		if chat.UserID == userID {
+			chats = append(chats, chat.copy())
+		}
+	}
+	key := func(chat internal.Chat) internal.Cursor {
+		return internal.Cursor{CreatedAt: chat.CreatedAt, ID: chat.ID}
+	}
+	sortNewestFirst(chats, key)
+	chats, cursors := internal.PageOf(chats, page, key, newestFirst(key))
+	return chats, cursors, nil
+}
+
+func (db *DB) SelectMyChat(ctx context.Context, userID, chatID string) (internal.Chat, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	chat, err := db.myChat(userID, chatID)
+	if err != nil {
+		return internal.Chat{}, err
+	}
+	return chat.copy(), nil
+}
+
+// myChat returns the chat of the user, telling chats of other users apart from missing ones no more than postgres.DB does.
+func (db *DB) myChat(userID, chatID string) (*chat, error) {
+	chat, ok := db.chats[chatID]
+	if !ok {
+		return nil, apperror.Wrap(apperror.CodeChatNotFound, sql.ErrNoRows)
+	}
+	if chat.UserID != userID {
+		return nil, apperror.New(apperror.CodeChatNotFound)
+	}
+	return chat, nil
+}
+
+func (db *DB) InsertChat(ctx context.Context, userID string, inp internal.Chat) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureUser(userID); err != nil {
+		return err
+	}
+	if _, ok := db.chats[inp.ID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	createdAt := now(inp.CreatedAt)
+	inp.CreatedAt = &createdAt
+	inp.HeadSeq = 0
+	db.chats[inp.ID] = &chat{Chat: inp, UserID: userID}
+	return nil
+}
+
+// PatchChat updates the chat like postgres.DB.PatchChat.
+func (db *DB) PatchChat(ctx context.Context, userID string, inp internal.Chat) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	chat, err := db.myChat(userID, inp.ID)
+	if err != nil {
+		return err
+	}
+	if inp.Name != "" {
+		chat.Name = inp.Name
+	}
+	if inp.Model != "" {
+		chat.Model = inp.Model
+		chat.Temperature = inp.Temperature
+		chat.TopP = inp.TopP
+		chat.MaxTokens = inp.MaxTokens
+		chat.PresencePenalty = inp.PresencePenalty
+		chat.FrequencyPenalty = inp.FrequencyPenalty
+		chat.SystemPrompt = inp.SystemPrompt
+		chat.UseScraps = inp.UseScraps
+	}
+	return nil
+}
+
+func (db *DB) DeleteChat(ctx context.Context, userID, chatID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return apperror.New(apperror.CodeChatNotFound)
+	}
+	db.deleteChat(chatID)
+	return nil
+}
+
+// deleteChat deletes the chat with its messages, summaries, jobs and generations.
+func (db *DB) deleteChat(chatID string) {
+	for key := range db.messages {
+		if key.ChatID == chatID {
+			db.deleteMessage(key)
+		}
+	}
+	for key := range db.summaries {
+		if key.ChatID == chatID {
+			delete(db.summaries, key)
+		}
+	}
+	for id, job := range db.jobs {
+		if job.ChatID == chatID {
+			delete(db.jobs, id)
+		}
+	}
+	for id, generation := range db.generations {
+		if generation.ChatID == chatID {
+			delete(db.generations, id)
+		}
+	}
+	delete(db.chats, chatID)
+}
+
+// deleteMessage deletes the message with its versions, scrap and embedding.
+// Its replies are deleted along with it only by deleteChat, as nothing else deletes messages.
+func (db *DB) deleteMessage(key messageKey) {
+	delete(db.versions, key)
+	for id, scrap := range db.scraps {
+		if scrap.Message == key {
+			db.deleteScrap(id)
+		}
+	}
+	delete(db.messageVectors, key)
+	delete(db.messages, key)
+}
+
+// GetMyMessages returns a page of the active branch of the chat, like postgres.DB.GetMyMessages.
+func (db *DB) GetMyMessages(ctx context.Context, userID, chatID string, page internal.Page) ([]*internal.MessageWithScrap, internal.Cursors, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	chat, err := db.myChat(userID, chatID)
+	if err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	if page.Cursor != nil && page.Cursor.Seq == 0 {
+		return nil, internal.Cursors{}, internal.ErrBadCursor
+	}
+	messages, cursors := internal.PageOf(db.path(chatID, chat.HeadSeq), page,
+		func(msg *internal.MessageWithScrap) internal.Cursor {
+			return internal.Cursor{Seq: msg.Seq}
+		},
+		// the branch runs from the head back, so later messages come first
+		func(msg *internal.MessageWithScrap, cursor internal.Cursor) int {
+			return cursor.Seq - msg.Seq
+		})
+	return messages, cursors, nil
+}
+
+// SelectMessagePath returns the branch ending at seq, from seq up to the first message.
+func (db *DB) SelectMessagePath(ctx context.Context, userID, chatID string, seq int) ([]*internal.MessageWithScrap, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return nil, err
+	}
+	return db.path(chatID, seq), nil
+}
+
+// path returns the branch ending at leafSeq from leafSeq up, leaving out system messages.
+func (db *DB) path(chatID string, leafSeq int) []*internal.MessageWithScrap {
+	var messages []*internal.MessageWithScrap
+	for msg, ok := db.messages[messageKey{chatID, leafSeq}]; ok; msg, ok = db.messages[messageKey{chatID, msg.ParentSeq}] {
+		if msg.Role != "system" {
+			messages = append(messages, db.withScrap(msg))
+		}
+	}
+	return messages
+}
+
+func (db *DB) withScrap(msg *internal.Message) *internal.MessageWithScrap {
+	res := &internal.MessageWithScrap{
+		ChatID:     msg.ChatID,
+		Seq:        msg.Seq,
+		ParentSeq:  msg.ParentSeq,
+		Content:    msg.Content,
+		Role:       msg.Role,
+		Name:       msg.Name,
+		TemplateID: msg.TemplateID,
+		CreatedAt:  msg.CreatedAt,
+		Version:    msg.Version,
+		Generation: copyGeneration(msg.Generation),
+	}
+	res.SiblingSeqs = []int{}
+	for key, sibling := range db.messages {
+		if key.ChatID == msg.ChatID && sibling.ParentSeq == msg.ParentSeq {
+			res.SiblingSeqs = append(res.SiblingSeqs, key.Seq)
+		}
+	}
+	sort.Ints(res.SiblingSeqs)
+	for _, scrap := range db.scraps {
+		if scrap.Message == (messageKey{msg.ChatID, msg.Seq}) {
+			s := scrap.Scrap
+			res.Scrap = &s
+		}
+	}
+	return res
+}
+
+// SelectLastSeq returns the highest seq in the chat, across all of its branches.
+func (db *DB) SelectLastSeq(ctx context.Context, userID, chatID string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return 0, err
+	}
+	return db.lastSeq(chatID), nil
+}
+
+func (db *DB) lastSeq(chatID string) int {
+	last := 0
+	for key := range db.messages {
+		if key.ChatID == chatID && key.Seq > last {
+			last = key.Seq
+		}
+	}
+	return last
+}
+
+// AppendTurn adds msgs to the chat of the first one and assigns their seqs, like postgres.DB.AppendTurn.
+func (db *DB) AppendTurn(ctx context.Context, userID string, msgs ...*internal.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, msgs[0].ChatID); err != nil {
+		return err
+	}
+	if err := db.ensureParent(*msgs[0]); err != nil {
+		return err
+	}
+	assignSeqs(msgs, db.lastSeq(msgs[0].ChatID))
+	for _, msg := range msgs {
+		db.insertMessage(userID, *msg)
+	}
+	return nil
+}
+
+// ensureParent reports the parent msg follows missing the way the foreign key on it does.
+func (db *DB) ensureParent(msg internal.Message) error {
+	if msg.ParentSeq == 0 {
+		return nil
+	}
+	if _, ok := db.messages[messageKey{msg.ChatID, msg.ParentSeq}]; !ok {
+		return apperror.New(apperror.CodeNotFound)
+	}
+	return nil
+}
+
+// assignSeqs numbers msgs on from lastSeq, each following the one before.
+func assignSeqs(msgs []*internal.Message, lastSeq int) {
+	for i, msg := range msgs {
+		msg.Seq = lastSeq + 1 + i
+		if i > 0 {
+			msg.ParentSeq = msgs[i-1].Seq
+		}
+	}
+}
+
+// insertMessage adds msg as its first version and the head of its chat, counting what was generated in the usage of the user.
+func (db *DB) insertMessage(userID string, msg internal.Message) {
+	key := messageKey{msg.ChatID, msg.Seq}
+	msg.Version = 1
+	msg.Generation = copyGeneration(msg.Generation)
+	db.messages[key] = &msg
+	db.versions[key] = []internal.MessageVersion{{
+		ChatID:     msg.ChatID,
+		Seq:        msg.Seq,
+		Version:    1,
+		Content:    msg.Content,
+		CreatedAt:  msg.CreatedAt,
+		Generation: copyGeneration(msg.Generation),
+	}}
+	db.chats[msg.ChatID].HeadSeq = msg.Seq
+	if msg.Model != "" {
+		// tool calls take tokens, but only replies count as messages
+		messages := 0
+		if msg.Role == "assistant" {
+			messages = 1
+		}
+		db.addUsage(userID, msg.CreatedAt, messages, msg.Generation)
+	}
+}
+
+// CheckoutBranch makes the branch through seq the active one, its newest message becoming the head of the chat.
+func (db *DB) CheckoutBranch(ctx context.Context, userID, chatID string, seq int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	chat, err := db.myChat(userID, chatID)
+	if err != nil {
+		return err
+	}
+	if _, ok := db.messages[messageKey{chatID, seq}]; !ok {
+		return apperror.New(apperror.CodeMessageNotFound)
+	}
+	// children always have higher seqs than their parent, so following the newest child leads to the newest leaf
+	for {
+		child := 0
+		for key, msg := range db.messages {
+			if key.ChatID == chatID && msg.ParentSeq == seq && key.Seq > child {
+				child = key.Seq
+			}
+		}
+		if child == 0 {
+			break
+		}
+		seq = child
+	}
+	chat.HeadSeq = seq
+	return nil
+}
+
+// SelectChatSummaryBefore returns the latest summary of the chat that covers only messages before seq,
+// sql.ErrNoRows if there is none.
+func (db *DB) SelectChatSummaryBefore(ctx context.Context, userID, chatID string, seq int) (internal.ChatSummary, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return internal.ChatSummary{}, err
+	}
+	var latest internal.ChatSummary
+	for key, summary := range db.summaries {
+		if key.ChatID == chatID && key.Seq < seq && key.Seq > latest.LastSeq {
+			latest = summary
+		}
+	}
+	if latest.ChatID == "" {
+		return internal.ChatSummary{}, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+func (db *DB) InsertChatSummary(ctx context.Context, userID string, inp internal.ChatSummary) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, inp.ChatID); err != nil {
+		return err
+	}
+	db.summaries[messageKey{inp.ChatID, inp.LastSeq}] = inp
+	return nil
+}
+
+// SelectMyScrapbooks returns a page of the scrapbooks of the user, oldest first.
+func (db *DB) SelectMyScrapbooks(ctx context.Context, userID string, page internal.Page) ([]internal.Scrapbook, internal.Cursors, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := createdAtCursor(page); err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	var scrapbooks []internal.Scrapbook
+	for _, scrapbook := range db.scrapbooks {
+		if scrapbook.UserID == userID {
+			scrapbooks = append(scrapbooks, scrapbook.Scrapbook)
+		}
+	}
+	key := func(scrapbook internal.Scrapbook) internal.Cursor {
+		return internal.Cursor{CreatedAt: &scrapbook.CreatedAt, ID: scrapbook.ID}
+	}
+	sortNewestFirst(scrapbooks, key)
+	reverse(scrapbooks)
+	scrapbooks, cursors := internal.PageOf(scrapbooks, page, key, func(scrapbook internal.Scrapbook, cursor internal.Cursor) int {
+		return -newestFirst(key)(scrapbook, cursor)
+	})
+	return scrapbooks, cursors, nil
+}
+
+func (db *DB) SelectMyScrapbook(ctx context.Context, userID, scrapbookID string) (internal.Scrapbook, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	scrapbook, err := db.myScrapbook(userID, scrapbookID)
+	if err != nil {
+		return internal.Scrapbook{}, err
+	}
+	return scrapbook.Scrapbook, nil
+}
+
+func (db *DB) myScrapbook(userID, scrapbookID string) (*scrapbook, error) {
+	scrapbook, ok := db.scrapbooks[scrapbookID]
+	if !ok {
+		return nil, apperror.Wrap(apperror.CodeScrapbookNotFound, sql.ErrNoRows)
+	}
+	if scrapbook.UserID != userID {
+		return nil, apperror.New(apperror.CodeScrapbookNotFound)
+	}
+	return scrapbook, nil
+}
+
+func (db *DB) InsertScrapbook(ctx context.Context, userID string, inp internal.Scrapbook) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureUser(userID); err != nil {
+		return err
+	}
+	if _, ok := db.scrapbooks[inp.ID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	// only Register makes default scrapbooks
+	inp.IsDefault = false
+	db.scrapbooks[inp.ID] = &scrapbook{Scrapbook: inp, UserID: userID}
+	return nil
+}
+
+// DeleteScrapbook deletes the scrapbook with the scraps that are on no other scrapbook.
+// The default scrapbook can't be deleted.
+func (db *DB) DeleteScrapbook(ctx context.Context, userID, scrapbookID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureScrapbookMutable(userID, scrapbookID); err != nil {
+		return err
+	}
+	for link := range db.scrapsScrapbooks {
+		if link.ScrapbookID == scrapbookID && len(db.scrapbooksOn(link.ScrapID)) == 1 {
+			db.deleteScrap(link.ScrapID)
+		}
+	}
+	db.deleteScrapbook(scrapbookID)
+	return nil
+}
+
+// deleteScrapbook deletes the scrapbook, taking its scraps off it.
+func (db *DB) deleteScrapbook(scrapbookID string) {
+	for link := range db.scrapsScrapbooks {
+		if link.ScrapbookID == scrapbookID {
+			delete(db.scrapsScrapbooks, link)
+		}
+	}
+	delete(db.scrapbooks, scrapbookID)
+}
+
+// PatchScrapbook renames the scrapbook. The default scrapbook can't be renamed.
+func (db *DB) PatchScrapbook(ctx context.Context, userID, scrapbookID, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureScrapbookMutable(userID, scrapbookID); err != nil {
+		return err
+	}
+	db.scrapbooks[scrapbookID].Name = name
+	return nil
+}
+
+// ensureScrapbookMutable tells a missing scrapbook from the default one, which is there to stay.
+func (db *DB) ensureScrapbookMutable(userID, scrapbookID string) error {
+	scrapbook, err := db.myScrapbook(userID, scrapbookID)
+	if err != nil {
+		return err
+	}
+	if scrapbook.IsDefault {
+		return apperror.New(apperror.CodeScrapbookDefaultImmutable)
+	}
+	return nil
+}
+
+// SelectScrapsOnScrapbook returns a page of the scraps in the scrapbook, newest first.
+func (db *DB) SelectScrapsOnScrapbook(ctx context.Context, userID, scrapbookID string, page internal.Page) ([]internal.ScrapWithMessage, internal.Cursors, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.pageOfScraps(page, func(scrap *scrap) bool {
+		_, on := db.scrapsScrapbooks[scrapOnScrapbook{scrap.ID, scrapbookID}]
+		scrapbook, ok := db.scrapbooks[scrapbookID]
+		return on && ok && scrapbook.UserID == userID
+	})
+}
+
+// SelectMyScraps returns a page of the scraps of the user, newest first.
+func (db *DB) SelectMyScraps(ctx context.Context, userID string, page internal.Page) ([]internal.ScrapWithMessage, internal.Cursors, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.pageOfScraps(page, func(scrap *scrap) bool {
+		return db.chats[scrap.Message.ChatID].UserID == userID
+	})
+}
+
+// pageOfScraps returns a page of the scraps keep keeps, newest first.
+func (db *DB) pageOfScraps(page internal.Page, keep func(*scrap) bool) ([]internal.ScrapWithMessage, internal.Cursors, error) {
+	if err := createdAtCursor(page); err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	var scraps []internal.ScrapWithMessage
+	for _, scrap := range db.scraps {
+		if keep(scrap) {
+			scraps = append(scraps, db.withMessage(scrap))
+		}
+	}
+	sortNewestFirst(scraps, scrapCursor)
+	scraps, cursors := internal.PageOf(scraps, page, scrapCursor, newestFirst(scrapCursor))
+	return scraps, cursors, nil
+}
+
+// withMessage returns the scrap with the columns of its message postgres.DB selects.
+func (db *DB) withMessage(scrap *scrap) internal.ScrapWithMessage {
+	msg := db.messages[scrap.Message]
+	return internal.ScrapWithMessage{
+		ID:        scrap.ID,
+		Memo:      scrap.Memo,
+		CreatedAt: scrap.CreatedAt,
+		Message: &internal.Message{
+			ChatID:    msg.ChatID,
+			Seq:       msg.Seq,
+			Content:   msg.Content,
+			Role:      msg.Role,
+			CreatedAt: msg.CreatedAt,
+		},
+	}
+}
+
+func scrapCursor(scrap internal.ScrapWithMessage) internal.Cursor {
+	return internal.Cursor{CreatedAt: &scrap.CreatedAt, ID: scrap.ID}
+}
+
+func (db *DB) SelectMyScrap(ctx context.Context, userID, scrapID string) (internal.ScrapWithMessage, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	scrap, err := db.myScrap(userID, scrapID)
+	if err != nil {
+		return internal.ScrapWithMessage{}, err
+	}
+	return db.withMessage(scrap), nil
+}
+
+// myScrap returns the scrap of a message of the user.
+func (db *DB) myScrap(userID, scrapID string) (*scrap, error) {
+	scrap, ok := db.scraps[scrapID]
+	if !ok || db.chats[scrap.Message.ChatID].UserID != userID {
+		return nil, apperror.Wrap(apperror.CodeScrapNotFound, sql.ErrNoRows)
+	}
+	return scrap, nil
+}
+
+// InsertScrap scraps the message of the user onto the scrapbooks of the user, all of it or nothing.
+func (db *DB) InsertScrap(ctx context.Context, userID string, inp internal.Scrap, msg internal.Message, scrapbookIDs []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := messageKey{msg.ChatID, msg.Seq}
+	chat, ok := db.chats[msg.ChatID]
+	if _, exists := db.messages[key]; !exists || !ok || chat.UserID != userID {
+		return apperror.New(apperror.CodeMessageNotFound)
+	}
+	if _, ok := db.scraps[inp.ID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	for _, scrap := range db.scraps {
+		if scrap.Message == key {
+			return apperror.New(apperror.CodeConflict)
+		}
+	}
+	seen := map[string]bool{}
+	for _, scrapbookID := range scrapbookIDs {
+		if scrapbook, ok := db.scrapbooks[scrapbookID]; !ok || scrapbook.UserID != userID {
+			return apperror.New(apperror.CodeScrapbookNotFound)
+		}
+		if seen[scrapbookID] {
+			return apperror.New(apperror.CodeConflict)
+		}
+		seen[scrapbookID] = true
+	}
+	db.scraps[inp.ID] = &scrap{Scrap: inp, Message: key}
+	for _, scrapbookID := range scrapbookIDs {
+		db.scrapsScrapbooks[scrapOnScrapbook{inp.ID, scrapbookID}] = time.Now().UTC()
+	}
+	return nil
+}
+
+func (db *DB) PatchScrap(ctx context.Context, userID, scrapID, memo string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	scrap, err := db.myScrap(userID, scrapID)
+	if err != nil {
+		return apperror.New(apperror.CodeScrapNotFound)
+	}
+	scrap.Memo = memo
+	return nil
+}
+
+func (db *DB) DeleteScrap(ctx context.Context, userID, scrapID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myScrap(userID, scrapID); err != nil {
+		return apperror.New(apperror.CodeScrapNotFound)
+	}
+	db.deleteScrap(scrapID)
+	return nil
+}
+
+// deleteScrap deletes the scrap, taking it off its scrapbooks, with its embedding.
+func (db *DB) deleteScrap(scrapID string) {
+	for link := range db.scrapsScrapbooks {
+		if link.ScrapID == scrapID {
+			delete(db.scrapsScrapbooks, link)
+		}
+	}
+	delete(db.scrapVectors, scrapID)
+	delete(db.scraps, scrapID)
+}
+
+// SelectMyScrapbooksOnScrap returns the scrapbooks of the user the scrap is on, oldest first.
+func (db *DB) SelectMyScrapbooksOnScrap(ctx context.Context, userID, scrapID string) ([]internal.Scrapbook, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var scrapbooks []internal.Scrapbook
+	for _, scrapbookID := range db.scrapbooksOn(scrapID) {
+		if scrapbook := db.scrapbooks[scrapbookID]; scrapbook.UserID == userID {
+			scrapbooks = append(scrapbooks, scrapbook.Scrapbook)
+		}
+	}
+	sortNewestFirst(scrapbooks, func(scrapbook internal.Scrapbook) internal.Cursor {
+		return internal.Cursor{CreatedAt: &scrapbook.CreatedAt, ID: scrapbook.ID}
+	})
+	reverse(scrapbooks)
+	return scrapbooks, nil
+}
+
+// scrapbooksOn returns the ids of the scrapbooks the scrap is on.
+func (db *DB) scrapbooksOn(scrapID string) []string {
+	var scrapbookIDs []string
+	for link := range db.scrapsScrapbooks {
+		if link.ScrapID == scrapID {
+			scrapbookIDs = append(scrapbookIDs, link.ScrapbookID)
+		}
+	}
+	return scrapbookIDs
+}
+
+func (db *DB) InsertScrapOnScrapbook(ctx context.Context, userID, scrapID, scrapbookID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if scrapbook, ok := db.scrapbooks[scrapbookID]; !ok || scrapbook.UserID != userID {
+		return apperror.New(apperror.CodeScrapbookNotFound)
+	}
+	if _, ok := db.scraps[scrapID]; !ok {
+		return apperror.New(apperror.CodeScrapNotFound)
+	}
+	link := scrapOnScrapbook{scrapID, scrapbookID}
+	if _, ok := db.scrapsScrapbooks[link]; ok {
+		return apperror.New(apperror.CodeScrapAlreadyOnScrapbook)
+	}
+	db.scrapsScrapbooks[link] = time.Now().UTC()
+	return nil
+}
+
+func (db *DB) DeleteScrapOnScrapbook(ctx context.Context, userID, scrapID, scrapbookID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	link := scrapOnScrapbook{scrapID, scrapbookID}
+	scrapbook, ok := db.scrapbooks[scrapbookID]
+	if _, on := db.scrapsScrapbooks[link]; !on || !ok || scrapbook.UserID != userID {
+		return apperror.New(apperror.CodeScrapNotFound)
+	}
+	delete(db.scrapsScrapbooks, link)
+	return nil
+}
+
+// ensureUser reports a missing user the way the foreign keys on users do.
+func (db *DB) ensureUser(userID string) error {
+	if _, ok := db.users[userID]; !ok {
+		return apperror.New(apperror.CodeNotFound)
+	}
+	return nil
+}
+
+func (c *chat) copy() internal.Chat {
+	chat := c.Chat
+	createdAt := *c.CreatedAt
+	chat.CreatedAt = &createdAt
+	return chat
+}
+
+func copyGeneration(gen internal.Generation) internal.Generation {
+	gen.Citations = append([]string{}, gen.Citations...)
+	return gen
+}
+
+// now returns t, or the current time if t is nil, as the defaults of devtools/db.sql do.
+func now(t *time.Time) time.Time {
+	if t == nil {
+		return time.Now().UTC()
+	}
+	return *t
+}
+
+// createdAtCursor checks the cursor of a list keyed by created_at then id.
+func createdAtCursor(page internal.Page) error {
+	if page.Cursor != nil && page.Cursor.CreatedAt == nil {
+		return internal.ErrBadCursor
+	}
+	return nil
+}
+
+// compareKeys orders the keys of a list keyed by created_at then id, oldest first.
+func compareKeys(a, b internal.Cursor) int {
+	switch {
+	case a.CreatedAt.Before(*b.CreatedAt):
+		return -1
+	case a.CreatedAt.After(*b.CreatedAt):
+		return 1
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// newestFirst compares items of a list keyed by key, newest first, with a cursor, see internal.PageOf.
+func newestFirst[T any](key func(T) internal.Cursor) func(T, internal.Cursor) int {
+	return func(item T, cursor internal.Cursor) int {
+		return -compareKeys(key(item), cursor)
+	}
+}
+
+func sortNewestFirst[T any](items []T, key func(T) internal.Cursor) {
+	sort.Slice(items, func(i, j int) bool { return compareKeys(key(items[i]), key(items[j])) > 0 })
+}
+
+func reverse[T any](items []T) {
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
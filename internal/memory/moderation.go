@@ -0,0 +1,18 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+func (db *DB) InsertModerationAudit(ctx context.Context, inp internal.ModerationAudit) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureUser(inp.UserID); err != nil {
+		return err
+	}
+	inp.Categories = append([]string{}, inp.Categories...)
+	db.moderationAudits = append(db.moderationAudits, inp)
+	return nil
+}
@@ -0,0 +1,41 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/evergarden0412/gptea-api/internal/authz"
+)
+
+// SelectOwner returns the user who owns r, see authz.Owners. It returns sql.ErrNoRows if r doesn't exist.
+// A message belongs to the owner of its chat, and a scrap to the owner of the message it scrapped.
+func (db *DB) SelectOwner(ctx context.Context, r authz.Resource) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch r.Kind {
+	case authz.KindChat:
+		if chat, ok := db.chats[r.ID]; ok {
+			return chat.UserID, nil
+		}
+	case authz.KindMessage:
+		if _, ok := db.messages[messageKey{r.ID, r.Seq}]; ok {
+			return db.chats[r.ID].UserID, nil
+		}
+	case authz.KindScrap:
+		if scrap, ok := db.scraps[r.ID]; ok {
+			return db.chats[scrap.Message.ChatID].UserID, nil
+		}
+	case authz.KindScrapbook:
+		if scrapbook, ok := db.scrapbooks[r.ID]; ok {
+			return scrapbook.UserID, nil
+		}
+	case authz.KindTemplate:
+		if template, ok := db.templates[r.ID]; ok {
+			return template.UserID, nil
+		}
+	default:
+		return "", fmt.Errorf("no owner of %s", r.Kind)
+	}
+	return "", sql.ErrNoRows
+}
@@ -0,0 +1,161 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+// keywords is a query of SearchMine in the web search syntax: words and "quoted phrases",
+// each a clause of words joined by or, and the -excluded words.
+type keywords struct {
+	query    string
+	clauses  [][]string
+	excluded []string
+}
+
+func parseKeywords(query string) keywords {
+	k := keywords{query: strings.ToLower(query)}
+	var terms []string
+	for i, phrase := range strings.Split(k.query, `"`) {
+		if i%2 == 1 {
+			terms = append(terms, `"`+phrase)
+			continue
+		}
+		terms = append(terms, strings.Fields(phrase)...)
+	}
+	or := false
+	for _, term := range terms {
+		switch {
+		case term == "or":
+			or = len(k.clauses) > 0
+		case strings.HasPrefix(term, `"`):
+			if term = strings.TrimPrefix(term, `"`); term != "" {
+				k.add(term, or)
+			}
+			or = false
+		case strings.HasPrefix(term, "-") && len(term) > 1:
+			k.excluded = append(k.excluded, term[1:])
+		default:
+			k.add(term, or)
+			or = false
+		}
+	}
+	return k
+}
+
+func (k *keywords) add(term string, or bool) {
+	if or {
+		k.clauses[len(k.clauses)-1] = append(k.clauses[len(k.clauses)-1], term)
+		return
+	}
+	k.clauses = append(k.clauses, []string{term})
+}
+
+// score tells how well text matches, 0 if it doesn't. In place of the full text search and trigrams of postgres,
+// a word matches anywhere in the text, korean particles and all, and text is scored by the share of the words it has,
+// plus one if it has the whole query.
+func (k keywords) score(text string) float64 {
+	text = strings.ToLower(text)
+	whole := 0.0
+	if strings.Contains(text, k.query) {
+		whole = 1
+	}
+	for _, term := range k.excluded {
+		if strings.Contains(text, term) {
+			return whole
+		}
+	}
+	terms, found := 0, 0
+	for _, clause := range k.clauses {
+		clauseFound := false
+		for _, term := range clause {
+			terms++
+			if strings.Contains(text, term) {
+				found++
+				clauseFound = true
+			}
+		}
+		if !clauseFound {
+			return whole
+		}
+	}
+	if terms == 0 {
+		return whole
+	}
+	return whole + float64(found)/float64(terms)
+}
+
+// within tells whether t is in the bounds of filter.
+func within(filter internal.SearchFilter, t time.Time) bool {
+	return (filter.From == nil || !t.Before(*filter.From)) && (filter.To == nil || t.Before(*filter.To))
+}
+
+// SearchMine returns the chats, messages and scraps of the user matching the keywords of query, best first,
+// skipping offset of them and returning up to limit, like postgres.DB.SearchMine but scored by keywords.score.
+func (db *DB) SearchMine(ctx context.Context, userID, query string, filter internal.SearchFilter, limit, offset int) ([]internal.SearchResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := parseKeywords(query)
+	var results []internal.SearchResult
+	add := func(res internal.SearchResult, text string) {
+		if res.Score = k.score(text); res.Score > 0 {
+			results = append(results, res)
+		}
+	}
+
+	for _, chat := range db.chats {
+		if !filter.Wants(internal.SearchResultChat) || chat.UserID != userID ||
+			filter.ChatID != "" && chat.ID != filter.ChatID || !within(filter, *chat.CreatedAt) {
+			continue
+		}
+		found := chat.copy()
+		add(internal.SearchResult{Type: internal.SearchResultChat, Chat: &found}, chat.Name)
+	}
+	for _, msg := range db.messages {
+		if !filter.Wants(internal.SearchResultMessage) || db.chats[msg.ChatID].UserID != userID || msg.Role != "user" && msg.Role != "assistant" ||
+			filter.ChatID != "" && msg.ChatID != filter.ChatID || !within(filter, msg.CreatedAt) {
+			continue
+		}
+		found := internal.Message{ChatID: msg.ChatID, Seq: msg.Seq, Content: msg.Content, Role: msg.Role, CreatedAt: msg.CreatedAt}
+		add(internal.SearchResult{Type: internal.SearchResultMessage, Message: &found}, msg.Content)
+	}
+	for _, scrap := range db.scraps {
+		_, onScrapbook := db.scrapsScrapbooks[scrapOnScrapbook{scrap.ID, filter.ScrapbookID}]
+		if !filter.Wants(internal.SearchResultScrap) || db.chats[scrap.Message.ChatID].UserID != userID ||
+			filter.ChatID != "" && scrap.Message.ChatID != filter.ChatID || filter.ScrapbookID != "" && !onScrapbook || !within(filter, scrap.CreatedAt) {
+			continue
+		}
+		found := db.withMessage(scrap)
+		add(internal.SearchResult{Type: internal.SearchResultScrap, Scrap: &found}, scrap.Memo)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return createdAt(results[i]).After(createdAt(results[j]))
+	})
+	if offset >= len(results) {
+		return nil, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func createdAt(res internal.SearchResult) time.Time {
+	switch {
+	case res.Chat != nil:
+		return *res.Chat.CreatedAt
+	case res.Message != nil:
+		return res.Message.CreatedAt
+	default:
+		return res.Scrap.CreatedAt
+	}
+}
@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+type template struct {
+	internal.PromptTemplate
+	UserID string
+}
+
+func (t *template) copy() internal.PromptTemplate {
+	template := t.PromptTemplate
+	template.Variables = append([]internal.TemplateVariable{}, t.Variables...)
+	return template
+}
+
+func (db *DB) SelectMyTemplates(ctx context.Context, userID string) ([]internal.PromptTemplate, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var templates []internal.PromptTemplate
+	for _, template := range db.templates {
+		if template.UserID == userID {
+			templates = append(templates, template.copy())
+		}
+	}
+	sort.SliceStable(templates, func(i, j int) bool { return templates[i].CreatedAt.Before(templates[j].CreatedAt) })
+	return templates, nil
+}
+
+func (db *DB) SelectMyTemplate(ctx context.Context, userID, templateID string) (internal.PromptTemplate, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	template, ok := db.templates[templateID]
+	if !ok || template.UserID != userID {
+		return internal.PromptTemplate{}, apperror.New(apperror.CodeTemplateNotFound)
+	}
+	return template.copy(), nil
+}
+
+func (db *DB) InsertTemplate(ctx context.Context, userID string, inp internal.PromptTemplate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ensureUser(userID); err != nil {
+		return err
+	}
+	if _, ok := db.templates[inp.ID]; ok {
+		return apperror.New(apperror.CodeConflict)
+	}
+	stored := &template{PromptTemplate: inp, UserID: userID}
+	stored.PromptTemplate = stored.copy()
+	db.templates[inp.ID] = stored
+	return nil
+}
+
+// PatchTemplate replaces the name, content and variables of the template.
+func (db *DB) PatchTemplate(ctx context.Context, userID string, inp internal.PromptTemplate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	template, ok := db.templates[inp.ID]
+	if !ok || template.UserID != userID {
+		return apperror.New(apperror.CodeTemplateNotFound)
+	}
+	template.Name = inp.Name
+	template.Content = inp.Content
+	template.Variables = append([]internal.TemplateVariable{}, inp.Variables...)
+	return nil
+}
+
+func (db *DB) DeleteTemplate(ctx context.Context, userID, templateID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	template, ok := db.templates[templateID]
+	if !ok || template.UserID != userID {
+		return apperror.New(apperror.CodeTemplateNotFound)
+	}
+	delete(db.templates, templateID)
+	return nil
+}
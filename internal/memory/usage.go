@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+const dayLayout = "2006-01-02"
+
+type usageKey struct {
+	UserID string
+	Day    string
+}
+
+// addUsage adds a generation to the usage of the user on the day, in utc, it was created.
+func (db *DB) addUsage(userID string, createdAt time.Time, messages int, gen internal.Generation) {
+	key := usageKey{userID, createdAt.UTC().Format(dayLayout)}
+	usage := db.usages[key]
+	usage.Messages += messages
+	usage.PromptTokens += gen.PromptTokens
+	usage.CompletionTokens += gen.CompletionTokens
+	db.usages[key] = usage
+}
+
+// AddUsage adds usage to the usage of the user on the day, in utc, of at.
+func (db *DB) AddUsage(ctx context.Context, userID string, at time.Time, usage internal.Usage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	gen := internal.Generation{PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens}
+	db.addUsage(userID, at, usage.Messages, gen)
+	return nil
+}
+
+// SelectUsageSince returns the usage of the user from the day, in utc, of since up to now.
+func (db *DB) SelectUsageSince(ctx context.Context, userID string, since time.Time) (internal.Usage, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	from := since.UTC().Format(dayLayout)
+	var total internal.Usage
+	for key, usage := range db.usages {
+		// days in dayLayout sort as strings
+		if key.UserID == userID && key.Day >= from {
+			total.Messages += usage.Messages
+			total.PromptTokens += usage.PromptTokens
+			total.CompletionTokens += usage.CompletionTokens
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+func (db *DB) SelectMessageVersions(ctx context.Context, userID, chatID string, seq int) ([]internal.MessageVersion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return nil, err
+	}
+	var versions []internal.MessageVersion
+	for _, version := range db.versions[messageKey{chatID, seq}] {
+		version.Generation = copyGeneration(version.Generation)
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// InsertMessageVersion adds msg as the next version of the message at its seq and makes it the active one.
+// msg is added to the usage of the user.
+func (db *DB) InsertMessageVersion(ctx context.Context, userID string, msg internal.Message) (internal.MessageVersion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, msg.ChatID); err != nil {
+		return internal.MessageVersion{}, err
+	}
+	key := messageKey{msg.ChatID, msg.Seq}
+	stored, ok := db.messages[key]
+	if !ok {
+		return internal.MessageVersion{}, sql.ErrNoRows
+	}
+	versions := db.versions[key]
+	version := internal.MessageVersion{
+		ChatID:     msg.ChatID,
+		Seq:        msg.Seq,
+		Version:    len(versions) + 1,
+		Content:    msg.Content,
+		CreatedAt:  time.Now().UTC(),
+		Generation: copyGeneration(msg.Generation),
+	}
+	db.versions[key] = append(versions, version)
+	activate(stored, version)
+	db.addUsage(userID, version.CreatedAt, 1, version.Generation)
+	return version, nil
+}
+
+// ActivateMessageVersion makes version the active version of the message.
+func (db *DB) ActivateMessageVersion(ctx context.Context, userID, chatID string, seq, version int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.myChat(userID, chatID); err != nil {
+		return err
+	}
+	key := messageKey{chatID, seq}
+	versions := db.versions[key]
+	if version < 1 || version > len(versions) {
+		return apperror.New(apperror.CodeMessageVersionNotFound)
+	}
+	activate(db.messages[key], versions[version-1])
+	return nil
+}
+
+// activate gives msg the content and generation of version.
+func activate(msg *internal.Message, version internal.MessageVersion) {
+	msg.Content = version.Content
+	msg.Version = version.Version
+	msg.Generation = copyGeneration(version.Generation)
+}
@@ -0,0 +1,111 @@
+package moderation
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// KeywordRule flags text matching Pattern for Category.
+// Pattern is matched against the text folded by fold, so it is written in lower case.
+type KeywordRule struct {
+	Category string
+	Pattern  *regexp.Regexp
+	// Except lists harmless words containing a match, removed from the text before matching
+	Except []string
+}
+
+// DefaultKeywordRules catch common Korean and English profanity and slurs, including the usual ways
+// of writing around a filter: initial consonants (ㅅㅂ), and digits, spaces or symbols between syllables (시1발).
+var DefaultKeywordRules = []KeywordRule{
+	{
+		Category: "profanity",
+		Pattern:  regexp.MustCompile(`[시씨쉬쒸]이?[발빨벌뻘팔펄]|ㅅㅂ|ㅆㅂ|ㅅㅃ|병[신싄딱]|ㅂㅅ|개[새색세]끼|개[새색]기|좆|ㅈ같|\bf+u+c+k|\bshit\b|\bbitch`),
+		Except:   []string{"시발점", "시발역", "시발택시"},
+	},
+	{
+		Category: "hate",
+		Pattern:  regexp.MustCompile(`한남충|김치녀|된장녀|틀딱|급식충|맘충|짱깨|쪽바리|흑형`),
+	},
+}
+
+type keywordModerator struct {
+	rules []KeywordRule
+}
+
+// NewKeyword moderates locally with rules, see DefaultKeywordRules.
+func NewKeyword(rules []KeywordRule) Moderator {
+	return &keywordModerator{rules: rules}
+}
+
+func (m *keywordModerator) Moderate(ctx context.Context, text string) (Verdict, error) {
+	folded := fold(text)
+	verdict := Verdict{Moderator: "keyword"}
+	for _, rule := range m.rules {
+		t := folded
+		for _, except := range rule.Except {
+			t = strings.ReplaceAll(t, except, "")
+		}
+		if rule.Pattern.MatchString(t) {
+			verdict.Flagged = true
+			verdict.Categories = append(verdict.Categories, rule.Category)
+		}
+	}
+	return verdict, nil
+}
+
+// fold composes decomposed hangul, turns full-width latin into ascii and lower cases, so that "ＦＵＣＫ" matches like "fuck".
+// Symbols and digits between hangul are dropped, as are spaces between single syllables, so that "시1발" and
+// "시 발" match like "시발" while "다시 발견" doesn't. Any other run of non-letters becomes a single space.
+func fold(text string) string {
+	runes := []rune(norm.NFC.String(text))
+	for i, r := range runes {
+		if r >= '！' && r <= '～' {
+			r -= '！' - '!'
+		}
+		runes[i] = unicode.ToLower(r)
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		if unicode.IsLetter(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j, space := i, false
+		for j < len(runes) && !unicode.IsLetter(runes[j]) {
+			space = space || unicode.IsSpace(runes[j])
+			j++
+		}
+		if i == 0 || j == len(runes) {
+			i = j
+			continue
+		}
+		between := isHangul(runes[i-1]) && isHangul(runes[j])
+		if between && space {
+			between = wordLen(runes, i-1, -1) == 1 && wordLen(runes, j, 1) == 1
+		}
+		if !between {
+			b.WriteRune(' ')
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// wordLen is the number of letters in the word of runes[i], counting in direction dir.
+func wordLen(runes []rune, i, dir int) int {
+	n := 0
+	for ; i >= 0 && i < len(runes) && unicode.IsLetter(runes[i]); i += dir {
+		n++
+	}
+	return n
+}
+
+func isHangul(r rune) bool {
+	return unicode.Is(unicode.Hangul, r)
+}
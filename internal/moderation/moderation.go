@@ -0,0 +1,41 @@
+// Package moderation checks what users send and what the chatbot replies against the content policy.
+package moderation
+
+import "context"
+
+// Moderator checks text against the content policy.
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (Verdict, error)
+}
+
+// Verdict is the decision of a moderator on a text.
+type Verdict struct {
+	Flagged bool
+	// Categories the text was flagged for, e.g. "profanity" or "hate"
+	Categories []string
+	// Moderator is the name of the moderator that decided
+	Moderator string
+}
+
+type chain []Moderator
+
+// Chain checks text with every moderator in order, stopping at the first that flags it.
+// Put cheap local moderators first.
+func Chain(moderators ...Moderator) Moderator {
+	return chain(moderators)
+}
+
+func (c chain) Moderate(ctx context.Context, text string) (Verdict, error) {
+	var verdict Verdict
+	for _, m := range c {
+		var err error
+		verdict, err = m.Moderate(ctx, text)
+		if err != nil {
+			return Verdict{}, err
+		}
+		if verdict.Flagged {
+			return verdict, nil
+		}
+	}
+	return verdict, nil
+}
@@ -0,0 +1,50 @@
+package moderation
+
+import (
+	"context"
+	"sort"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+type openAIModerator struct {
+	client *openai.Client
+}
+
+// NewOpenAI moderates with the moderation api of openai.
+func NewOpenAI(client *openai.Client) Moderator {
+	return &openAIModerator{client: client}
+}
+
+func (m *openAIModerator) Moderate(ctx context.Context, text string) (Verdict, error) {
+	resp, err := m.client.Moderations(ctx, openai.ModerationRequest{
+		Input: text,
+		Model: openai.ModerationTextLatest,
+	})
+	if err != nil {
+		return Verdict{}, err
+	}
+	verdict := Verdict{Moderator: "openai"}
+	for _, result := range resp.Results {
+		if !result.Flagged {
+			continue
+		}
+		verdict.Flagged = true
+		c := result.Categories
+		for name, flagged := range map[string]bool{
+			"hate":             c.Hate,
+			"hate/threatening": c.HateThreatening,
+			"self-harm":        c.SelfHarm,
+			"sexual":           c.Sexual,
+			"sexual/minors":    c.SexualMinors,
+			"violence":         c.Violence,
+			"violence/graphic": c.ViolenceGraphic,
+		} {
+			if flagged {
+				verdict.Categories = append(verdict.Categories, name)
+			}
+		}
+	}
+	sort.Strings(verdict.Categories)
+	return verdict, nil
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+const (
+	// DirectionNext pages on from the last item of the previous page, the way the list is ordered
+	DirectionNext = "next"
+	// DirectionPrev pages back from the first item of the previous page
+	DirectionPrev = "prev"
+)
+
+var ErrBadCursor = apperror.New(apperror.CodeBadCursor)
+
+// Page asks for a page of a list. The zero Page asks for the whole list.
+type Page struct {
+	// Limit is the most items on the page, 0 for no limit
+	Limit int
+	// Cursor is where the page starts, exclusive, nil for the start of the list
+	Cursor *Cursor
+	// Direction is DirectionNext or DirectionPrev, DirectionNext if empty
+	Direction string
+}
+
+// Cursor is the key of an item of a list, which pages start after or end before.
+// Lists of messages are keyed by seq, the others by created_at then id.
+type Cursor struct {
+	CreatedAt *time.Time `json:"t,omitempty"`
+	ID        string     `json:"id,omitempty"`
+	Seq       int        `json:"seq,omitempty"`
+}
+
+// Encode returns the cursor as an opaque string for clients.
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor reads a cursor encoded by Encode, nil if s is empty.
+func DecodeCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrBadCursor
+	}
+	return &c, nil
+}
+
+// Cursors are the cursors to the pages around a page, empty where there is none.
+type Cursors struct {
+	Next string
+	Prev string
+}
+
+// Backward tells whether the page goes back from its cursor, against the order of the list.
+func (p Page) Backward() bool {
+	return p.Direction == DirectionPrev
+}
+
+// Paginate trims the rows selected for page, in the order they were selected in for page, to the page in the order of the list,
+// and returns the cursors around it.
+func Paginate[T any](rows []T, page Page, key func(T) Cursor) ([]T, Cursors) {
+	more := page.Limit > 0 && len(rows) > page.Limit
+	if more {
+		rows = rows[:page.Limit]
+	}
+	if page.Backward() {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	var cursors Cursors
+	if len(rows) == 0 {
+		return rows, cursors
+	}
+	// a page reached from a cursor has the item of the cursor on the other side
+	if more && !page.Backward() || page.Cursor != nil && page.Backward() {
+		cursors.Next = key(rows[len(rows)-1]).Encode()
+	}
+	if more && page.Backward() || page.Cursor != nil && !page.Backward() {
+		cursors.Prev = key(rows[0]).Encode()
+	}
+	return rows, cursors
+}
+
+// PageOf returns the page of list, a whole list in its order, and the cursors around it,
+// the way the queries of postgres.DB page, for lists kept in memory. compare orders an item against the key of a cursor like strings.Compare.
+func PageOf[T any](list []T, page Page, key func(T) Cursor, compare func(T, Cursor) int) ([]T, Cursors) {
+	var rows []T
+	if page.Backward() {
+		for i := len(list) - 1; i >= 0; i-- {
+			if page.Cursor == nil || compare(list[i], *page.Cursor) < 0 {
+				rows = append(rows, list[i])
+			}
+		}
+	} else {
+		for _, item := range list {
+			if page.Cursor == nil || compare(item, *page.Cursor) > 0 {
+				rows = append(rows, item)
+			}
+		}
+	}
+	if page.Limit > 0 && len(rows) > page.Limit+1 {
+		rows = rows[:page.Limit+1]
+	}
+	return Paginate(rows, page, key)
+}
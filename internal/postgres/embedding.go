@@ -0,0 +1,182 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+	"github.com/lib/pq"
+)
+
+// UsePgvector ranks semantic search in postgres if the pgvector extension is installed, see devtools/pgvector.sql.
+// Otherwise the embeddings of the user are ranked by cosine similarity in go.
+func (db *DB) UsePgvector(ctx context.Context) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'vector')`
+	if err := db.db.QueryRowContext(ctx, query).Scan(&db.pgvector); err != nil {
+		return false, err
+	}
+	return db.pgvector, nil
+}
+
+func (db *DB) UpsertMessageEmbedding(ctx context.Context, chatID string, seq int, model string, vector []float32) error {
+	query := `INSERT INTO message_embeddings (chat_id, seq, model, embedding, created_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (chat_id, seq) DO UPDATE SET model = $3, embedding = $4, created_at = now()`
+	_, err := db.db.ExecContext(ctx, query, chatID, seq, model, pq.Float32Array(vector))
+	return err
+}
+
+func (db *DB) UpsertScrapEmbedding(ctx context.Context, scrapID, model string, vector []float32) error {
+	query := `INSERT INTO scrap_embeddings (scrap_id, model, embedding, created_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (scrap_id) DO UPDATE SET model = $2, embedding = $3, created_at = now()`
+	_, err := db.db.ExecContext(ctx, query, scrapID, model, pq.Float32Array(vector))
+	return err
+}
+
+// SelectMessagesWithoutEmbedding returns up to limit messages of any user with no embedding of model,
+// leaving out the ones embedding.MessageText skips.
+func (db *DB) SelectMessagesWithoutEmbedding(ctx context.Context, model string, limit int) ([]internal.Message, error) {
+	query := `SELECT m.chat_id, m.seq, m.content, m.role, m.created_at
+		FROM messages AS m
+		LEFT JOIN message_embeddings AS e
+		ON m.chat_id = e.chat_id AND m.seq = e.seq AND e.model = $1
+		WHERE e.chat_id IS NULL AND m.role IN ('user', 'assistant') AND m.content <> ''
+		ORDER BY m.created_at
+		LIMIT $2`
+	rows, err := db.db.QueryContext(ctx, query, model, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	for rows.Next() {
+		var msg internal.Message
+		if err := rows.Scan(&msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// SelectScrapsWithoutEmbedding returns up to limit scraps of any user with no embedding of model.
+func (db *DB) SelectScrapsWithoutEmbedding(ctx context.Context, model string, limit int) ([]internal.ScrapWithMessage, error) {
+	query := `SELECT s.id, s.memo, s.created_at, m.chat_id, m.seq, m.content, m.role, m.created_at
+		FROM scraps AS s
+		INNER JOIN messages AS m
+		ON s.message_chat_id = m.chat_id AND s.message_seq = m.seq
+		LEFT JOIN scrap_embeddings AS e
+		ON s.id = e.scrap_id AND e.model = $1
+		WHERE e.scrap_id IS NULL
+		ORDER BY s.created_at
+		LIMIT $2`
+	rows, err := db.db.QueryContext(ctx, query, model, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scraps []internal.ScrapWithMessage
+	for rows.Next() {
+		var scrap internal.ScrapWithMessage
+		var msg internal.Message
+		if err := rows.Scan(&scrap.ID, &scrap.Memo, &scrap.CreatedAt, &msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		scrap.Message = &msg
+		scraps = append(scraps, scrap)
+	}
+	return scraps, rows.Err()
+}
+
+// SearchMyMessagesByEmbedding returns up to limit messages of the user closest to vector, best first,
+// scored by cosine similarity. Only embeddings of model are searched.
+func (db *DB) SearchMyMessagesByEmbedding(ctx context.Context, userID, model string, vector []float32, limit int) ([]internal.SearchResult, error) {
+	query := `SELECT m.chat_id, m.seq, m.content, m.role, m.created_at, %s
+		FROM message_embeddings AS e
+		INNER JOIN messages AS m
+		ON e.chat_id = m.chat_id AND e.seq = m.seq
+		INNER JOIN chats AS c
+		ON m.chat_id = c.id
+		WHERE c.user_id = $1 AND e.model = $2 AND cardinality(e.embedding) = $3
+		%s`
+	return db.searchByEmbedding(ctx, query, userID, model, vector, limit, func(scan func(...any) error) (internal.SearchResult, error) {
+		var msg internal.Message
+		res := internal.SearchResult{Type: internal.SearchResultMessage, Message: &msg}
+		return res, scan(&msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt)
+	})
+}
+
+// SearchMyScrapsByEmbedding is SearchMyMessagesByEmbedding for scraps.
+func (db *DB) SearchMyScrapsByEmbedding(ctx context.Context, userID, model string, vector []float32, limit int) ([]internal.SearchResult, error) {
+	query := `SELECT s.id, s.memo, s.created_at, m.chat_id, m.seq, m.content, m.role, m.created_at, %s
+		FROM scrap_embeddings AS e
+		INNER JOIN scraps AS s
+		ON e.scrap_id = s.id
+		INNER JOIN messages AS m
+		ON s.message_chat_id = m.chat_id AND s.message_seq = m.seq
+		INNER JOIN chats AS c
+		ON m.chat_id = c.id
+		WHERE c.user_id = $1 AND e.model = $2 AND cardinality(e.embedding) = $3
+		%s`
+	return db.searchByEmbedding(ctx, query, userID, model, vector, limit, func(scan func(...any) error) (internal.SearchResult, error) {
+		scrap := internal.ScrapWithMessage{Message: &internal.Message{}}
+		res := internal.SearchResult{Type: internal.SearchResultScrap, Scrap: &scrap}
+		return res, scan(&scrap.ID, &scrap.Memo, &scrap.CreatedAt,
+			&scrap.Message.ChatID, &scrap.Message.Seq, &scrap.Message.Content, &scrap.Message.Role, &scrap.Message.CreatedAt)
+	})
+}
+
+// searchByEmbedding runs query, which selects the columns scanned by scanRow followed by the score or the embedding,
+// with the placeholders $1 user, $2 model, $3 dimensions and, ranking in postgres, $4 vector and $5 limit.
+func (db *DB) searchByEmbedding(ctx context.Context, query, userID, model string, vector []float32, limit int,
+	scanRow func(scan func(...any) error) (internal.SearchResult, error)) ([]internal.SearchResult, error) {
+	args := []any{userID, model, len(vector)}
+	if db.pgvector {
+		// the cast to real[] first lets pq send the vector as an array
+		distance := fmt.Sprintf("e.embedding::vector(%d) <=> $4::real[]::vector(%d)", len(vector), len(vector))
+		query = fmt.Sprintf(query, "1 - ("+distance+")", "ORDER BY "+distance+" LIMIT $5")
+		args = append(args, pq.Float32Array(vector), limit)
+	} else {
+		query = fmt.Sprintf(query, "e.embedding", "")
+	}
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []internal.SearchResult
+	for rows.Next() {
+		var score float64
+		var other pq.Float32Array
+		res, err := scanRow(func(dest ...any) error {
+			if db.pgvector {
+				return rows.Scan(append(dest, &score)...)
+			}
+			return rows.Scan(append(dest, &other)...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Score = score
+		if !db.pgvector {
+			res.Score = embedding.Cosine(vector, other)
+		}
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !db.pgvector {
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+		if len(results) > limit {
+			results = results[:limit]
+		}
+	}
+	return results, nil
+}
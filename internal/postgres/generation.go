@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+func (db *DB) InsertGeneration(ctx context.Context, generationID, chatID string, startedAt time.Time) error {
+	query := `INSERT INTO generations (id, chat_id, started_at) VALUES ($1, $2, $3)`
+	_, err := db.db.ExecContext(ctx, query, generationID, chatID, startedAt)
+	return err
+}
+
+func (db *DB) FinishGeneration(ctx context.Context, generationID string) error {
+	query := `UPDATE generations SET finished_at = $1 WHERE id = $2`
+	_, err := db.db.ExecContext(ctx, query, time.Now().UTC(), generationID)
+	return err
+}
+
+func (db *DB) SelectGenerationCancelled(ctx context.Context, generationID string) (bool, error) {
+	query := `SELECT cancelled FROM generations WHERE id = $1`
+	var cancelled bool
+	if err := db.db.QueryRowContext(ctx, query, generationID).Scan(&cancelled); err != nil {
+		return false, err
+	}
+	return cancelled, nil
+}
+
+// CancelGenerations asks the generations of the chat started after since and not finished yet to stop.
+// It returns a generation_not_found error if there is none.
+func (db *DB) CancelGenerations(ctx context.Context, userID, chatID string, since time.Time) error {
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE generations SET cancelled = true WHERE chat_id = $1 AND finished_at IS NULL AND started_at > $2`
+	res, err := db.db.ExecContext(ctx, query, chatID, since)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return apperror.New(apperror.CodeGenerationNotFound)
+	}
+	return nil
+}
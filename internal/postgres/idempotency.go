@@ -0,0 +1,67 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+// ClaimIdempotentRequest records req as running unless the user made a request with its key already,
+// and reports whether it did. If not, it returns the request made with the key before.
+// A request made before with the key is forgotten once it expired, or if it is still running after staleBefore,
+// the process running it having died.
+func (db *DB) ClaimIdempotentRequest(ctx context.Context, req internal.IdempotentRequest, staleBefore time.Time) (internal.IdempotentRequest, bool, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return internal.IdempotentRequest{}, false, err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM idempotent_requests WHERE user_id = $1 AND expires_at < $2`
+	if _, err := tx.ExecContext(ctx, query, req.UserID, req.CreatedAt); err != nil {
+		return internal.IdempotentRequest{}, false, err
+	}
+	query = `INSERT INTO idempotent_requests (user_id, key, request_hash, status, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = $3, status = $4, created_at = $5, expires_at = $6,
+			response_status = 0, response_content_type = '', response_location = '', response_body = NULL
+		WHERE idempotent_requests.status = $4 AND idempotent_requests.created_at < $7`
+	res, err := tx.ExecContext(ctx, query, req.UserID, req.Key, req.RequestHash, internal.IdempotentRequestRunning, req.CreatedAt, req.ExpiresAt, staleBefore)
+	if err != nil {
+		return internal.IdempotentRequest{}, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return internal.IdempotentRequest{}, false, err
+	} else if n == 1 {
+		return req, true, tx.Commit()
+	}
+
+	query = `SELECT user_id, key, request_hash, status, response_status, response_content_type, response_location,
+		COALESCE(response_body, ''), created_at, expires_at
+		FROM idempotent_requests WHERE user_id = $1 AND key = $2`
+	var prev internal.IdempotentRequest
+	if err := tx.QueryRowContext(ctx, query, req.UserID, req.Key).Scan(&prev.UserID, &prev.Key, &prev.RequestHash, &prev.Status,
+		&prev.ResponseStatus, &prev.ResponseContentType, &prev.ResponseLocation, &prev.ResponseBody, &prev.CreatedAt, &prev.ExpiresAt); err != nil {
+		return internal.IdempotentRequest{}, false, err
+	}
+	return prev, false, tx.Commit()
+}
+
+// FinishIdempotentRequest records the response of the request claimed with ClaimIdempotentRequest.
+func (db *DB) FinishIdempotentRequest(ctx context.Context, req internal.IdempotentRequest) error {
+	query := `UPDATE idempotent_requests
+		SET status = $1, response_status = $2, response_content_type = $3, response_location = $4, response_body = $5
+		WHERE user_id = $6 AND key = $7`
+	_, err := db.db.ExecContext(ctx, query, internal.IdempotentRequestDone, req.ResponseStatus, req.ResponseContentType,
+		req.ResponseLocation, req.ResponseBody, req.UserID, req.Key)
+	return err
+}
+
+// ReleaseIdempotentRequest forgets the request claimed with ClaimIdempotentRequest, so that it can be retried.
+func (db *DB) ReleaseIdempotentRequest(ctx context.Context, userID, key string) error {
+	query := `DELETE FROM idempotent_requests WHERE user_id = $1 AND key = $2`
+	_, err := db.db.ExecContext(ctx, query, userID, key)
+	return err
+}
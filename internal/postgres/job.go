@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+const selectJob = `SELECT id, user_id, chat_id, seq, status, COALESCE(reply_seq, 0), error, created_at, updated_at FROM jobs`
+
+// InsertMessageWithJob appends the user message like AppendTurn, together with the job answering it.
+// The seq of msg is assigned here, and so is that of the job.
+func (db *DB) InsertMessageWithJob(ctx context.Context, userID string, msg *internal.Message, job *internal.Job) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	lastSeq, err := lockChat(ctx, tx, userID, msg.ChatID)
+	if err != nil {
+		return err
+	}
+	assignSeqs([]*internal.Message{msg}, lastSeq)
+	job.Seq = msg.Seq
+	if err := insertMessage(ctx, tx, userID, *msg); err != nil {
+		return err
+	}
+	query := `INSERT INTO jobs (id, user_id, chat_id, seq, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := tx.ExecContext(ctx, query, job.ID, userID, job.ChatID, job.Seq, job.Status, job.CreatedAt, job.UpdatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SelectJob returns the job for the worker running it, whoever it belongs to.
+func (db *DB) SelectJob(ctx context.Context, jobID string) (internal.Job, error) {
+	query := selectJob + ` WHERE id = $1`
+	var job internal.Job
+	if err := db.db.QueryRowContext(ctx, query, jobID).Scan(&job.ID, &job.UserID, &job.ChatID, &job.Seq, &job.Status,
+		&job.ReplySeq, &job.Error, &job.CreatedAt, &job.UpdatedAt); err != nil {
+		return internal.Job{}, notFound(err, apperror.CodeJobNotFound)
+	}
+	return job, nil
+}
+
+func (db *DB) SelectMyJob(ctx context.Context, userID, chatID, jobID string) (internal.Job, error) {
+	job, err := db.SelectJob(ctx, jobID)
+	if err != nil {
+		return internal.Job{}, err
+	}
+	if job.UserID != userID || job.ChatID != chatID {
+		return internal.Job{}, apperror.New(apperror.CodeJobNotFound)
+	}
+	return job, nil
+}
+
+// SelectUnfinishedJob returns a job of the chat that is pending or running and was updated after since.
+// It returns sql.ErrNoRows if there is none.
+func (db *DB) SelectUnfinishedJob(ctx context.Context, chatID string, since time.Time) (internal.Job, error) {
+	query := selectJob + ` WHERE chat_id = $1 AND status IN ($2, $3) AND updated_at > $4 ORDER BY created_at DESC LIMIT 1`
+	var job internal.Job
+	if err := db.db.QueryRowContext(ctx, query, chatID, internal.JobStatusPending, internal.JobStatusRunning, since).Scan(
+		&job.ID, &job.UserID, &job.ChatID, &job.Seq, &job.Status, &job.ReplySeq, &job.Error, &job.CreatedAt, &job.UpdatedAt); err != nil {
+		return internal.Job{}, err
+	}
+	return job, nil
+}
+
+// StartJob marks the job running and reports whether it was pending.
+// A job delivered twice is only run by the worker that started it first.
+func (db *DB) StartJob(ctx context.Context, jobID string) (bool, error) {
+	query := `UPDATE jobs SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4`
+	res, err := db.db.ExecContext(ctx, query, internal.JobStatusRunning, time.Now().UTC(), jobID, internal.JobStatusPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (db *DB) FinishJob(ctx context.Context, jobID string, replySeq int) error {
+	query := `UPDATE jobs SET status = $1, reply_seq = $2, updated_at = $3 WHERE id = $4`
+	_, err := db.db.ExecContext(ctx, query, internal.JobStatusDone, replySeq, time.Now().UTC(), jobID)
+	return err
+}
+
+// FailJob records why the job failed, unless it is finished already.
+func (db *DB) FailJob(ctx context.Context, jobID, reason string) error {
+	query := `UPDATE jobs SET status = $1, error = $2, updated_at = $3 WHERE id = $4 AND status IN ($5, $6)`
+	_, err := db.db.ExecContext(ctx, query, internal.JobStatusFailed, reason, time.Now().UTC(), jobID,
+		internal.JobStatusPending, internal.JobStatusRunning)
+	return err
+}
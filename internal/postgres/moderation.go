@@ -0,0 +1,21 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/lib/pq"
+)
+
+func (db *DB) InsertModerationAudit(ctx context.Context, inp internal.ModerationAudit) error {
+	categories := inp.Categories
+	if categories == nil {
+		// pq sends a nil slice as null
+		categories = []string{}
+	}
+	query := `INSERT INTO moderation_audits (user_id, chat_id, seq, stage, flagged, categories, moderator, content, created_at)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8, $9)`
+	_, err := db.db.ExecContext(ctx, query, inp.UserID, inp.ChatID, inp.Seq, inp.Stage, inp.Flagged,
+		pq.Array(categories), inp.Moderator, inp.Content, inp.CreatedAt)
+	return err
+}
@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/evergarden0412/gptea-api/internal/authz"
+)
+
+// SelectOwner returns the user who owns r, see authz.Owners. It returns sql.ErrNoRows if r doesn't exist.
+// A message belongs to the owner of its chat, and a scrap to the owner of the message it scrapped.
+func (db *DB) SelectOwner(ctx context.Context, r authz.Resource) (string, error) {
+	var query string
+	args := []any{r.ID}
+	switch r.Kind {
+	case authz.KindChat:
+		query = `SELECT user_id FROM chats WHERE id = $1`
+	case authz.KindMessage:
+		query = `SELECT c.user_id FROM messages AS m
+			INNER JOIN chats AS c ON m.chat_id = c.id
+			WHERE m.chat_id = $1 AND m.seq = $2`
+		args = append(args, r.Seq)
+	case authz.KindScrap:
+		query = `SELECT c.user_id FROM scraps AS s
+			INNER JOIN chats AS c ON s.message_chat_id = c.id
+			WHERE s.id = $1`
+	case authz.KindScrapbook:
+		query = `SELECT user_id FROM scrapbooks WHERE id = $1`
+	case authz.KindTemplate:
+		query = `SELECT user_id FROM prompt_templates WHERE id = $1`
+	default:
+		return "", fmt.Errorf("no owner of %s", r.Kind)
+	}
+	var userID string
+	if err := db.db.QueryRowContext(ctx, query, args...).Scan(&userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
@@ -0,0 +1,42 @@
+package postgres
+
+import "github.com/evergarden0412/gptea-api/internal"
+
+// keyset returns how to compare the keys of rows with the cursor of page and how to order them to get the page,
+// for a list ordered descending if desc.
+func keyset(page internal.Page, desc bool) (cmp, order string) {
+	if page.Backward() == desc {
+		return ">", "ASC"
+	}
+	return "<", "DESC"
+}
+
+// pageLimit is the LIMIT of the query of page, one more than the page to tell whether there is more, NULL for no limit.
+func pageLimit(page internal.Page) any {
+	if page.Limit == 0 {
+		return nil
+	}
+	return page.Limit + 1
+}
+
+// createdAtKey returns the created_at and id of the cursor of page of a list keyed by them, NULLs for the start of the list.
+func createdAtKey(page internal.Page) (any, any, error) {
+	if page.Cursor == nil {
+		return nil, nil, nil
+	}
+	if page.Cursor.CreatedAt == nil {
+		return nil, nil, internal.ErrBadCursor
+	}
+	return *page.Cursor.CreatedAt, page.Cursor.ID, nil
+}
+
+// seqKey returns the seq of the cursor of page of a list of messages, NULL for the start of the list.
+func seqKey(page internal.Page) (any, error) {
+	if page.Cursor == nil {
+		return nil, nil
+	}
+	if page.Cursor.Seq == 0 {
+		return nil, internal.ErrBadCursor
+	}
+	return page.Cursor.Seq, nil
+}
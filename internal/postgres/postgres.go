@@ -4,13 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"time"
 
 	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/lib/pq"
 )
 
+// DB is the store of the server on postgres.
+// Its methods taking a userID only touch the rows of that user, even though the server authorizes
+// the resources of a request before calling them, see authz.Authorizer. The user_id checks in the
+// queries are kept as defense in depth: a route missing its authorization still can't reach
+// the data of another user, it finds nothing.
 type DB struct {
 	db *sql.DB
+	// pgvector tells whether semantic search can rank in postgres, see UsePgvector
+	pgvector bool
 }
 
 func New(db *sql.DB) *DB {
@@ -18,20 +26,11 @@ func New(db *sql.DB) *DB {
 }
 
 var (
-	ErrUnauthorized     = errors.New("unauthorized")
-	ErrChatNotPatched   = errors.New("chat not patched")
 	ErrInsertScrapbook  = errors.New("insert scrapbook failed")
 	ErrBadScrapbookName = errors.New("bad scrapbook name")
 )
 
-type RegisterInput struct {
-	UserID         string
-	CredentialType string
-	CredentialID   string
-	CreatedAt      *time.Time
-}
-
-func (db *DB) Register(ctx context.Context, inp RegisterInput) error {
+func (db *DB) Register(ctx context.Context, inp internal.RegisterInput) error {
 	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -43,6 +42,9 @@ func (db *DB) Register(ctx context.Context, inp RegisterInput) error {
 	}
 	query = `INSERT INTO user_credentials (user_id, credential_type, credential_id) VALUES ($1, $2, $3)`
 	if _, err := tx.ExecContext(ctx, query, inp.UserID, inp.CredentialType, inp.CredentialID); err != nil {
+		if apperror.Is(err, apperror.CodeConflict) {
+			return apperror.Wrap(apperror.CodeCredentialAlreadyRegistered, err)
+		}
 		return err
 	}
 	query = `INSERT INTO scrapbooks (id, user_id, name, is_default, created_at) VALUES ($1, $2, $3, $4, $5)`
@@ -60,7 +62,7 @@ func (db *DB) SignIn(ctx context.Context, credentialType, credentialID string) (
 	var userID string
 	query := `SELECT user_id FROM user_credentials WHERE credential_type = $1 AND credential_id = $2`
 	if err := db.db.QueryRowContext(ctx, query, credentialType, credentialID).Scan(&userID); err != nil {
-		return "", err
+		return "", notFound(err, apperror.CodeCredentialNotRegistered)
 	}
 	return userID, nil
 }
@@ -74,7 +76,7 @@ func (db *DB) Logout(ctx context.Context, userID string) error {
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeRefreshTokenRevoked)
 	}
 	return nil
 }
@@ -88,7 +90,7 @@ func (db *DB) Resign(ctx context.Context, userID string) error {
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeUnauthenticated)
 	}
 	return nil
 }
@@ -109,45 +111,66 @@ func (db *DB) UpsertRefreshToken(ctx context.Context, userID, tokenID string) er
 	return err
 }
 
-func (db *DB) SelectMyChats(ctx context.Context, userID string) ([]internal.Chat, error) {
-	query := `SELECT id, name, created_at FROM chats WHERE user_id = $1 ORDER BY created_at DESC`
-	rows, err := db.db.QueryContext(ctx, query, userID)
+// SelectMyChats returns a page of the chats of the user, newest first.
+func (db *DB) SelectMyChats(ctx context.Context, userID string, page internal.Page) ([]internal.Chat, internal.Cursors, error) {
+	createdAt, id, err := createdAtKey(page)
 	if err != nil {
-		return nil, err
+		return nil, internal.Cursors{}, err
+	}
+	cmp, order := keyset(page, true)
+	query := `SELECT id, name, created_at, model, temperature, top_p, max_tokens, presence_penalty, frequency_penalty, system_prompt, use_scraps, head_seq
+		FROM chats WHERE user_id = $1
+		AND ($2::timestamptz IS NULL OR (created_at, id) ` + cmp + ` ($2, $3))
+		ORDER BY created_at ` + order + `, id ` + order + `
+		LIMIT $4`
+	rows, err := db.db.QueryContext(ctx, query, userID, createdAt, id, pageLimit(page))
+	if err != nil {
+		return nil, internal.Cursors{}, err
 	}
 	defer rows.Close()
 	var chats []internal.Chat
 	for rows.Next() {
 		var chat internal.Chat
-		if err := rows.Scan(&chat.ID, &chat.Name, &chat.CreatedAt); err != nil {
-			return nil, err
+		if err := rows.Scan(&chat.ID, &chat.Name, &chat.CreatedAt,
+			&chat.Model, &chat.Temperature, &chat.TopP, &chat.MaxTokens, &chat.PresencePenalty, &chat.FrequencyPenalty, &chat.SystemPrompt, &chat.UseScraps, &chat.HeadSeq); err != nil {
+			return nil, internal.Cursors{}, err
 		}
 		chats = append(chats, chat)
 	}
-	return chats, nil
+	chats, cursors := internal.Paginate(chats, page, func(chat internal.Chat) internal.Cursor {
+		return internal.Cursor{CreatedAt: chat.CreatedAt, ID: chat.ID}
+	})
+	return chats, cursors, nil
 }
 
 func (db *DB) SelectMyChat(ctx context.Context, userID, chatID string) (internal.Chat, error) {
-	query := `SELECT id, user_id, name, created_at FROM chats WHERE id = $1`
+	query := `SELECT id, user_id, name, created_at, model, temperature, top_p, max_tokens, presence_penalty, frequency_penalty, system_prompt, use_scraps, head_seq
+		FROM chats WHERE id = $1`
 	var chat internal.Chat
 	var chatUserID string
-	if err := db.db.QueryRowContext(ctx, query, chatID).Scan(&chat.ID, &chatUserID, &chat.Name, &chat.CreatedAt); err != nil {
-		return internal.Chat{}, err
+	if err := db.db.QueryRowContext(ctx, query, chatID).Scan(&chat.ID, &chatUserID, &chat.Name, &chat.CreatedAt,
+		&chat.Model, &chat.Temperature, &chat.TopP, &chat.MaxTokens, &chat.PresencePenalty, &chat.FrequencyPenalty, &chat.SystemPrompt, &chat.UseScraps, &chat.HeadSeq); err != nil {
+		return internal.Chat{}, notFound(err, apperror.CodeChatNotFound)
 	}
 	if chatUserID != userID {
-		return internal.Chat{}, ErrUnauthorized
+		// chats of other users are not told apart from missing ones
+		return internal.Chat{}, apperror.New(apperror.CodeChatNotFound)
 	}
 	return chat, nil
 }
 
 func (db *DB) InsertChat(ctx context.Context, userID string, inp internal.Chat) error {
-	query := `INSERT INTO chats (id, user_id, name, created_at) VALUES ($1, $2, $3, $4)`
-	if _, err := db.db.ExecContext(ctx, query, inp.ID, userID, inp.Name, inp.CreatedAt); err != nil {
+	query := `INSERT INTO chats (id, user_id, name, created_at, model, temperature, top_p, max_tokens, presence_penalty, frequency_penalty, system_prompt, use_scraps)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	if _, err := db.db.ExecContext(ctx, query, inp.ID, userID, inp.Name, inp.CreatedAt,
+		inp.Model, inp.Temperature, inp.TopP, inp.MaxTokens, inp.PresencePenalty, inp.FrequencyPenalty, inp.SystemPrompt, inp.UseScraps); err != nil {
 		return err
 	}
 	return nil
 }
 
+// PatchChat updates the name of the chat if inp.Name is not empty,
+// and its generation settings, system prompt and use of scraps if inp.Model is not empty.
 func (db *DB) PatchChat(ctx context.Context, userID string, inp internal.Chat) error {
 	chat, err := db.SelectMyChat(ctx, userID, inp.ID)
 	if err != nil {
@@ -156,15 +179,28 @@ func (db *DB) PatchChat(ctx context.Context, userID string, inp internal.Chat) e
 	if inp.Name != "" {
 		chat.Name = inp.Name
 	}
-	query := `UPDATE chats SET name = $1 WHERE id = $2`
-	res, err := db.db.ExecContext(ctx, query, chat.Name, chat.ID)
+	if inp.Model != "" {
+		chat.Model = inp.Model
+		chat.Temperature = inp.Temperature
+		chat.TopP = inp.TopP
+		chat.MaxTokens = inp.MaxTokens
+		chat.PresencePenalty = inp.PresencePenalty
+		chat.FrequencyPenalty = inp.FrequencyPenalty
+		chat.SystemPrompt = inp.SystemPrompt
+		chat.UseScraps = inp.UseScraps
+	}
+	query := `UPDATE chats SET name = $1, model = $2, temperature = $3, top_p = $4, max_tokens = $5, presence_penalty = $6, frequency_penalty = $7,
+		system_prompt = $8, use_scraps = $9
+		WHERE id = $10`
+	res, err := db.db.ExecContext(ctx, query, chat.Name,
+		chat.Model, chat.Temperature, chat.TopP, chat.MaxTokens, chat.PresencePenalty, chat.FrequencyPenalty, chat.SystemPrompt, chat.UseScraps, chat.ID)
 	if err != nil {
 		return err
 	}
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrChatNotPatched
+		return apperror.New(apperror.CodeChatNotFound)
 	}
 	return nil
 }
@@ -178,23 +214,65 @@ func (db *DB) DeleteChat(ctx context.Context, userID, chatID string) error {
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeChatNotFound)
 	}
 	return nil
 }
 
-func (db *DB) GetMyMessages(ctx context.Context, userID, chatID string) ([]*internal.MessageWithScrap, error) {
+// GetMyMessages returns a page of the active branch of the chat, from its head up to the first message.
+// The first page is the latest messages, DirectionNext pages back to older ones.
+func (db *DB) GetMyMessages(ctx context.Context, userID, chatID string, page internal.Page) ([]*internal.MessageWithScrap, internal.Cursors, error) {
+	chat, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	messages, err := db.selectPath(ctx, chatID, chat.HeadSeq, page)
+	if err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	messages, cursors := internal.Paginate(messages, page, func(msg *internal.MessageWithScrap) internal.Cursor {
+		return internal.Cursor{Seq: msg.Seq}
+	})
+	return messages, cursors, nil
+}
+
+// SelectMessagePath returns the branch ending at seq, from seq up to the first message.
+func (db *DB) SelectMessagePath(ctx context.Context, userID, chatID string, seq int) ([]*internal.MessageWithScrap, error) {
 	_, err := db.SelectMyChat(ctx, userID, chatID)
 	if err != nil {
 		return nil, err
 	}
-	query := `SELECT m.chat_id, m.seq, m.content, m.role, m.created_at, COALESCE(s.id, ''), COALESCE(s.memo, ''), COALESCE(s.created_at, '1970-01-01T00:00:00Z') 
-		FROM messages AS m
+	return db.selectPath(ctx, chatID, seq, internal.Page{})
+}
+
+// selectPath returns the rows of page of the branch ending at leafSeq, in the order of page.keyset, see paginate.
+func (db *DB) selectPath(ctx context.Context, chatID string, leafSeq int, page internal.Page) ([]*internal.MessageWithScrap, error) {
+	seq, err := seqKey(page)
+	if err != nil {
+		return nil, err
+	}
+	cmp, order := keyset(page, true)
+	query := `WITH RECURSIVE path AS (
+			SELECT chat_id, seq, parent_seq FROM messages WHERE chat_id = $1 AND seq = $2
+			UNION ALL
+			SELECT m.chat_id, m.seq, m.parent_seq FROM messages AS m
+			INNER JOIN path AS p ON m.chat_id = p.chat_id AND m.seq = p.parent_seq
+		)
+		SELECT m.chat_id, m.seq, COALESCE(m.parent_seq, 0), m.content, m.role, m.name, m.template_id, m.created_at, m.version,
+			m.model, m.finish_reason, m.prompt_tokens, m.completion_tokens, m.citations,
+			ARRAY(SELECT sib.seq FROM messages AS sib
+				WHERE sib.chat_id = m.chat_id AND sib.parent_seq IS NOT DISTINCT FROM m.parent_seq
+				ORDER BY sib.seq),
+			COALESCE(s.id, ''), COALESCE(s.memo, ''), COALESCE(s.created_at, '1970-01-01T00:00:00Z')
+		FROM path AS p
+		INNER JOIN messages AS m
+		ON m.chat_id = p.chat_id AND m.seq = p.seq
 		LEFT JOIN scraps AS s
 		ON s.message_chat_id = m.chat_id AND s.message_seq = m.seq
-		WHERE m.chat_id = $1
-		ORDER BY m.seq DESC`
-	rows, err := db.db.QueryContext(ctx, query, chatID)
+		WHERE m.role <> 'system' AND ($3::integer IS NULL OR m.seq ` + cmp + ` $3)
+		ORDER BY m.seq ` + order + `
+		LIMIT $4`
+	rows, err := db.db.QueryContext(ctx, query, chatID, leafSeq, seq, pageLimit(page))
 	if err != nil {
 		return nil, err
 	}
@@ -203,10 +281,16 @@ func (db *DB) GetMyMessages(ctx context.Context, userID, chatID string) ([]*inte
 	var messages []*internal.MessageWithScrap
 	for rows.Next() {
 		var msg internal.MessageWithScrap
+		var siblingSeqs pq.Int64Array
 		var scrap internal.Scrap
-		if err := rows.Scan(&msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt, &scrap.ID, &scrap.Memo, &scrap.CreatedAt); err != nil {
+		if err := rows.Scan(&msg.ChatID, &msg.Seq, &msg.ParentSeq, &msg.Content, &msg.Role, &msg.Name, &msg.TemplateID, &msg.CreatedAt, &msg.Version,
+			&msg.Model, &msg.FinishReason, &msg.PromptTokens, &msg.CompletionTokens, (*pq.StringArray)(&msg.Citations), &siblingSeqs, &scrap.ID, &scrap.Memo, &scrap.CreatedAt); err != nil {
 			return nil, err
 		}
+		msg.SiblingSeqs = make([]int, len(siblingSeqs))
+		for i, seq := range siblingSeqs {
+			msg.SiblingSeqs[i] = int(seq)
+		}
 		if scrap.ID != "" {
 			msg.Scrap = &scrap
 		}
@@ -215,23 +299,181 @@ func (db *DB) GetMyMessages(ctx context.Context, userID, chatID string) ([]*inte
 	return messages, nil
 }
 
-func (db *DB) InsertMessage(ctx context.Context, userID string, inp internal.Message) error {
+// SelectLastSeq returns the highest seq in the chat, across all of its branches.
+func (db *DB) SelectLastSeq(ctx context.Context, userID, chatID string) (int, error) {
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return 0, err
+	}
+	query := `SELECT COALESCE(MAX(seq), 0) FROM messages WHERE chat_id = $1`
+	var seq int
+	if err := db.db.QueryRowContext(ctx, query, chatID).Scan(&seq); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// AppendTurn adds msgs, a message with what was generated for it, to the chat of the first one:
+// the first under its parent, every other following the one before, the last becoming the head of the chat.
+// Their seqs are assigned here, with the chat locked, so that turns appended at the same time get distinct ones.
+// A turn generated while another was appended stays under the parent it was generated for,
+// as a branch next to the other turn. Generated messages are added to the usage of the user.
+func (db *DB) AppendTurn(ctx context.Context, userID string, msgs ...*internal.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	lastSeq, err := lockChat(ctx, tx, userID, msgs[0].ChatID)
+	if err != nil {
+		return err
+	}
+	assignSeqs(msgs, lastSeq)
+	for _, msg := range msgs {
+		if err := insertMessage(ctx, tx, userID, *msg); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// lockChat locks the chat of the user until tx ends, and returns the highest seq in it, across all of its branches.
+func lockChat(ctx context.Context, tx *sql.Tx, userID, chatID string) (int, error) {
+	query := `SELECT user_id FROM chats WHERE id = $1 FOR UPDATE`
+	var chatUserID string
+	if err := tx.QueryRowContext(ctx, query, chatID).Scan(&chatUserID); err != nil {
+		return 0, notFound(err, apperror.CodeChatNotFound)
+	}
+	if chatUserID != userID {
+		return 0, apperror.New(apperror.CodeChatNotFound)
+	}
+	query = `SELECT COALESCE(MAX(seq), 0) FROM messages WHERE chat_id = $1`
+	var lastSeq int
+	if err := tx.QueryRowContext(ctx, query, chatID).Scan(&lastSeq); err != nil {
+		return 0, err
+	}
+	return lastSeq, nil
+}
+
+// assignSeqs numbers msgs on from lastSeq, each following the one before.
+func assignSeqs(msgs []*internal.Message, lastSeq int) {
+	for i, msg := range msgs {
+		msg.Seq = lastSeq + 1 + i
+		if i > 0 {
+			msg.ParentSeq = msgs[i-1].Seq
+		}
+	}
+}
+
+func insertMessage(ctx context.Context, tx *sql.Tx, userID string, inp internal.Message) error {
+	citations := pq.Array(nonNil(inp.Citations))
+	query := `INSERT INTO messages (chat_id, seq, parent_seq, content, role, name, template_id, created_at, version,
+		model, finish_reason, prompt_tokens, completion_tokens, citations)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8, 1, $9, $10, $11, $12, $13)`
+	if _, err := tx.ExecContext(ctx, query, inp.ChatID, inp.Seq, inp.ParentSeq, inp.Content, inp.Role, inp.Name, inp.TemplateID, inp.CreatedAt,
+		inp.Model, inp.FinishReason, inp.PromptTokens, inp.CompletionTokens, citations); err != nil {
+		return err
+	}
+	query = `INSERT INTO message_versions (chat_id, seq, version, content, created_at,
+		model, finish_reason, prompt_tokens, completion_tokens, citations)
+		VALUES ($1, $2, 1, $3, $4, $5, $6, $7, $8, $9)`
+	if _, err := tx.ExecContext(ctx, query, inp.ChatID, inp.Seq, inp.Content, inp.CreatedAt,
+		inp.Model, inp.FinishReason, inp.PromptTokens, inp.CompletionTokens, citations); err != nil {
+		return err
+	}
+	query = `UPDATE chats SET head_seq = $1 WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, query, inp.Seq, inp.ChatID); err != nil {
+		return err
+	}
+	if inp.Model != "" {
+		// tool calls take tokens, but only replies count as messages
+		messages := 0
+		if inp.Role == "assistant" {
+			messages = 1
+		}
+		if err := addUsage(ctx, tx, userID, inp.CreatedAt, messages, inp.Generation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckoutBranch makes the branch through seq the active one.
+// The head of the chat becomes the newest message at the end of that branch.
+func (db *DB) CheckoutBranch(ctx context.Context, userID, chatID string, seq int) error {
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return err
+	}
+	// children always have higher seqs than their parent, so following the newest child leads to the newest leaf
+	query := `WITH RECURSIVE down AS (
+			SELECT seq FROM messages WHERE chat_id = $1 AND seq = $2
+			UNION ALL
+			SELECT (SELECT MAX(c.seq) FROM messages AS c WHERE c.chat_id = $1 AND c.parent_seq = d.seq)
+			FROM down AS d
+			WHERE d.seq IS NOT NULL
+		)
+		UPDATE chats SET head_seq = (SELECT MAX(seq) FROM down)
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM down)`
+	res, err := db.db.ExecContext(ctx, query, chatID, seq)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return apperror.New(apperror.CodeMessageNotFound)
+	}
+	return nil
+}
+
+// SelectChatSummaryBefore returns the latest summary of the chat that covers only messages before seq.
+func (db *DB) SelectChatSummaryBefore(ctx context.Context, userID, chatID string, seq int) (internal.ChatSummary, error) {
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return internal.ChatSummary{}, err
+	}
+	query := `SELECT chat_id, last_seq, content, created_at FROM chat_summaries
+		WHERE chat_id = $1 AND last_seq < $2
+		ORDER BY last_seq DESC
+		LIMIT 1`
+	var summary internal.ChatSummary
+	if err := db.db.QueryRowContext(ctx, query, chatID, seq).Scan(&summary.ChatID, &summary.LastSeq, &summary.Content, &summary.CreatedAt); err != nil {
+		return internal.ChatSummary{}, err
+	}
+	return summary, nil
+}
+
+func (db *DB) InsertChatSummary(ctx context.Context, userID string, inp internal.ChatSummary) error {
 	_, err := db.SelectMyChat(ctx, userID, inp.ChatID)
 	if err != nil {
 		return err
 	}
-	query := `INSERT INTO messages (chat_id, seq, content, role, created_at) VALUES ($1, $2, $3, $4, $5)`
-	if _, err := db.db.ExecContext(ctx, query, inp.ChatID, inp.Seq, inp.Content, inp.Role, inp.CreatedAt); err != nil {
+	query := `INSERT INTO chat_summaries (chat_id, last_seq, content, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (chat_id, last_seq) DO UPDATE SET content = $3, created_at = $4`
+	if _, err := db.db.ExecContext(ctx, query, inp.ChatID, inp.LastSeq, inp.Content, inp.CreatedAt); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *DB) SelectMyScrapbooks(ctx context.Context, userID string) ([]internal.Scrapbook, error) {
-	query := `SELECT id, name, is_default, created_at FROM scrapbooks WHERE user_id = $1 ORDER BY created_at ASC`
-	rows, err := db.db.QueryContext(ctx, query, userID)
+// SelectMyScrapbooks returns a page of the scrapbooks of the user, oldest first.
+func (db *DB) SelectMyScrapbooks(ctx context.Context, userID string, page internal.Page) ([]internal.Scrapbook, internal.Cursors, error) {
+	createdAt, id, err := createdAtKey(page)
 	if err != nil {
-		return nil, err
+		return nil, internal.Cursors{}, err
+	}
+	cmp, order := keyset(page, false)
+	query := `SELECT id, name, is_default, created_at FROM scrapbooks WHERE user_id = $1
+		AND ($2::timestamptz IS NULL OR (created_at, id) ` + cmp + ` ($2, $3))
+		ORDER BY created_at ` + order + `, id ` + order + `
+		LIMIT $4`
+	rows, err := db.db.QueryContext(ctx, query, userID, createdAt, id, pageLimit(page))
+	if err != nil {
+		return nil, internal.Cursors{}, err
 	}
 	defer rows.Close()
 
@@ -239,11 +481,14 @@ func (db *DB) SelectMyScrapbooks(ctx context.Context, userID string) ([]internal
 	for rows.Next() {
 		var scrapbook internal.Scrapbook
 		if err := rows.Scan(&scrapbook.ID, &scrapbook.Name, &scrapbook.IsDefault, &scrapbook.CreatedAt); err != nil {
-			return nil, err
+			return nil, internal.Cursors{}, err
 		}
 		scrapbooks = append(scrapbooks, scrapbook)
 	}
-	return scrapbooks, nil
+	scrapbooks, cursors := internal.Paginate(scrapbooks, page, func(scrapbook internal.Scrapbook) internal.Cursor {
+		return internal.Cursor{CreatedAt: &scrapbook.CreatedAt, ID: scrapbook.ID}
+	})
+	return scrapbooks, cursors, nil
 }
 
 func (db *DB) SelectMyScrapbook(ctx context.Context, userID, scrapbookID string) (internal.Scrapbook, error) {
@@ -251,15 +496,14 @@ func (db *DB) SelectMyScrapbook(ctx context.Context, userID, scrapbookID string)
 	var scrapbook internal.Scrapbook
 	var scrapbookUserID string
 	if err := db.db.QueryRowContext(ctx, query, scrapbookID).Scan(&scrapbook.ID, &scrapbookUserID, &scrapbook.Name, &scrapbook.IsDefault, &scrapbook.CreatedAt); err != nil {
-		return internal.Scrapbook{}, err
+		return internal.Scrapbook{}, notFound(err, apperror.CodeScrapbookNotFound)
 	}
 	if scrapbookUserID != userID {
-		return internal.Scrapbook{}, ErrUnauthorized
+		return internal.Scrapbook{}, apperror.New(apperror.CodeScrapbookNotFound)
 	}
 	return scrapbook, nil
 }
 
-
 func (db *DB) InsertScrapbook(ctx context.Context, userID string, inp internal.Scrapbook) error {
 	query := `INSERT INTO scrapbooks (id, user_id, name, created_at) VALUES ($1, $2, $3, $4)`
 	res, err := db.db.ExecContext(ctx, query, inp.ID, userID, inp.Name, inp.CreatedAt)
@@ -274,7 +518,12 @@ func (db *DB) InsertScrapbook(ctx context.Context, userID string, inp internal.S
 	return nil
 }
 
+// DeleteScrapbook deletes the scrapbook with the scraps that are on no other scrapbook.
+// The default scrapbook can't be deleted.
 func (db *DB) DeleteScrapbook(ctx context.Context, userID, scrapbookID string) error {
+	if err := db.ensureScrapbookMutable(ctx, userID, scrapbookID); err != nil {
+		return err
+	}
 	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -300,13 +549,17 @@ func (db *DB) DeleteScrapbook(ctx context.Context, userID, scrapbookID string) e
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeScrapbookNotFound)
 	}
 
 	return tx.Commit()
 }
 
+// PatchScrapbook renames the scrapbook. The default scrapbook can't be renamed.
 func (db *DB) PatchScrapbook(ctx context.Context, userID, scrapbookID, name string) error {
+	if err := db.ensureScrapbookMutable(ctx, userID, scrapbookID); err != nil {
+		return err
+	}
 	query := `UPDATE scrapbooks SET name = $1 WHERE id = $2 AND user_id = $3 AND is_default = false`
 	res, err := db.db.ExecContext(ctx, query, name, scrapbookID, userID)
 	if err != nil {
@@ -315,12 +568,30 @@ func (db *DB) PatchScrapbook(ctx context.Context, userID, scrapbookID, name stri
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeScrapbookNotFound)
+	}
+	return nil
+}
+
+// ensureScrapbookMutable tells a missing scrapbook from the default one, which is there to stay.
+func (db *DB) ensureScrapbookMutable(ctx context.Context, userID, scrapbookID string) error {
+	scrapbook, err := db.SelectMyScrapbook(ctx, userID, scrapbookID)
+	if err != nil {
+		return err
+	}
+	if scrapbook.IsDefault {
+		return apperror.New(apperror.CodeScrapbookDefaultImmutable)
 	}
 	return nil
 }
 
-func (db *DB) SelectScrapsOnScrapbook(ctx context.Context, userID, scrapbookID string) ([]internal.ScrapWithMessage, error) {
+// SelectScrapsOnScrapbook returns a page of the scraps in the scrapbook, newest first.
+func (db *DB) SelectScrapsOnScrapbook(ctx context.Context, userID, scrapbookID string, page internal.Page) ([]internal.ScrapWithMessage, internal.Cursors, error) {
+	createdAt, id, err := createdAtKey(page)
+	if err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	cmp, order := keyset(page, true)
 	query := `SELECT s.id, s.memo, s.created_at, m.chat_id, m.seq, m.content, m.role, m.created_at
 		FROM scraps AS s
 		INNER JOIN messages AS m
@@ -330,27 +601,30 @@ func (db *DB) SelectScrapsOnScrapbook(ctx context.Context, userID, scrapbookID s
 		INNER JOIN scrapbooks AS sb
 		ON ss.scrapbook_id = sb.id
 		WHERE sb.user_id = $1 AND sb.id = $2
-		ORDER BY s.created_at DESC`
-	rows, err := db.db.QueryContext(ctx, query, userID, scrapbookID)
+		AND ($3::timestamptz IS NULL OR (s.created_at, s.id) ` + cmp + ` ($3, $4))
+		ORDER BY s.created_at ` + order + `, s.id ` + order + `
+		LIMIT $5`
+	rows, err := db.db.QueryContext(ctx, query, userID, scrapbookID, createdAt, id, pageLimit(page))
 	if err != nil {
-		return nil, err
+		return nil, internal.Cursors{}, err
 	}
 	defer rows.Close()
 
-	var scraps []internal.ScrapWithMessage
-	for rows.Next() {
-		var scrap internal.ScrapWithMessage
-		var msg internal.Message
-		if err := rows.Scan(&scrap.ID, &scrap.Memo, &scrap.CreatedAt, &msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt); err != nil {
-			return nil, err
-		}
-		scrap.Message = &msg
-		scraps = append(scraps, scrap)
+	scraps, err := scanScraps(rows)
+	if err != nil {
+		return nil, internal.Cursors{}, err
 	}
-	return scraps, nil
+	scraps, cursors := internal.Paginate(scraps, page, scrapCursor)
+	return scraps, cursors, nil
 }
 
-func (db *DB) SelectMyScraps(ctx context.Context, userID string) ([]internal.ScrapWithMessage, error) {
+// SelectMyScraps returns a page of the scraps of the user, newest first.
+func (db *DB) SelectMyScraps(ctx context.Context, userID string, page internal.Page) ([]internal.ScrapWithMessage, internal.Cursors, error) {
+	createdAt, id, err := createdAtKey(page)
+	if err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	cmp, order := keyset(page, true)
 	query := `SELECT s.id, s.memo, s.created_at, m.chat_id, m.seq, m.content, m.role, m.created_at
 		FROM scraps AS s
 		INNER JOIN messages AS m
@@ -358,13 +632,24 @@ func (db *DB) SelectMyScraps(ctx context.Context, userID string) ([]internal.Scr
 		INNER JOIN chats AS c
 		ON m.chat_id = c.id
 		WHERE c.user_id = $1
-		ORDER BY s.created_at DESC`
-	rows, err := db.db.QueryContext(ctx, query, userID)
+		AND ($2::timestamptz IS NULL OR (s.created_at, s.id) ` + cmp + ` ($2, $3))
+		ORDER BY s.created_at ` + order + `, s.id ` + order + `
+		LIMIT $4`
+	rows, err := db.db.QueryContext(ctx, query, userID, createdAt, id, pageLimit(page))
 	if err != nil {
-		return nil, err
+		return nil, internal.Cursors{}, err
 	}
 	defer rows.Close()
 
+	scraps, err := scanScraps(rows)
+	if err != nil {
+		return nil, internal.Cursors{}, err
+	}
+	scraps, cursors := internal.Paginate(scraps, page, scrapCursor)
+	return scraps, cursors, nil
+}
+
+func scanScraps(rows *sql.Rows) ([]internal.ScrapWithMessage, error) {
 	var scraps []internal.ScrapWithMessage
 	for rows.Next() {
 		var scrap internal.ScrapWithMessage
@@ -378,6 +663,27 @@ func (db *DB) SelectMyScraps(ctx context.Context, userID string) ([]internal.Scr
 	return scraps, nil
 }
 
+func scrapCursor(scrap internal.ScrapWithMessage) internal.Cursor {
+	return internal.Cursor{CreatedAt: &scrap.CreatedAt, ID: scrap.ID}
+}
+
+func (db *DB) SelectMyScrap(ctx context.Context, userID, scrapID string) (internal.ScrapWithMessage, error) {
+	query := `SELECT s.id, s.memo, s.created_at, m.chat_id, m.seq, m.content, m.role, m.created_at
+		FROM scraps AS s
+		INNER JOIN messages AS m
+		ON s.message_chat_id = m.chat_id AND s.message_seq = m.seq 
+		INNER JOIN chats AS c
+		ON m.chat_id = c.id
+		WHERE c.user_id = $1 AND s.id = $2`
+	var scrap internal.ScrapWithMessage
+	var msg internal.Message
+	if err := db.db.QueryRowContext(ctx, query, userID, scrapID).Scan(&scrap.ID, &scrap.Memo, &scrap.CreatedAt, &msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt); err != nil {
+		return internal.ScrapWithMessage{}, notFound(err, apperror.CodeScrapNotFound)
+	}
+	scrap.Message = &msg
+	return scrap, nil
+}
+
 func (db *DB) InsertScrap(ctx context.Context, userID string, scrap internal.Scrap, msg internal.Message, scrapbookIDs []string) error {
 	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -397,7 +703,7 @@ func (db *DB) InsertScrap(ctx context.Context, userID string, scrap internal.Scr
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeMessageNotFound)
 	}
 
 	query = `INSERT INTO scraps_scrapbooks (scrap_id, scrapbook_id) 
@@ -412,12 +718,31 @@ func (db *DB) InsertScrap(ctx context.Context, userID string, scrap internal.Scr
 		if n, err := res.RowsAffected(); err != nil {
 			return err
 		} else if n == 0 {
-			return ErrUnauthorized
+			return apperror.New(apperror.CodeScrapbookNotFound)
 		}
 	}
 	return tx.Commit()
 }
 
+func (db *DB) PatchScrap(ctx context.Context, userID, scrapID, memo string) error {
+	query := `UPDATE scraps as s SET memo = $1
+		WHERE s.id = $2 AND 
+			(SELECT c.user_id FROM messages AS m
+			INNER JOIN chats AS c ON m.chat_id = c.id
+			WHERE m.chat_id = s.message_chat_id AND m.seq = s.message_seq) = $3`
+
+	res, err := db.db.ExecContext(ctx, query, memo, scrapID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return apperror.New(apperror.CodeScrapNotFound)
+	}
+	return nil
+}
+
 func (db *DB) DeleteScrap(ctx context.Context, userID, scrapID string) error {
 	query := `DELETE FROM scraps as s
 		WHERE s.id = $1 AND 
@@ -432,7 +757,7 @@ func (db *DB) DeleteScrap(ctx context.Context, userID, scrapID string) error {
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeScrapNotFound)
 	}
 	return nil
 }
@@ -469,12 +794,18 @@ func (db *DB) InsertScrapOnScrapbook(ctx context.Context, userID, scrapID, scrap
 		WHERE sb.user_id = $3 AND sb.id = $2`
 	res, err := db.db.ExecContext(ctx, query, scrapID, scrapbookID, userID)
 	if err != nil {
+		switch apperror.CodeOf(err) {
+		case apperror.CodeConflict:
+			return apperror.Wrap(apperror.CodeScrapAlreadyOnScrapbook, err)
+		case apperror.CodeNotFound:
+			return apperror.Wrap(apperror.CodeScrapNotFound, err)
+		}
 		return err
 	}
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeScrapbookNotFound)
 	}
 	return nil
 }
@@ -490,7 +821,23 @@ func (db *DB) DeleteScrapOnScrapbook(ctx context.Context, userID, scrapID, scrap
 	if n, err := res.RowsAffected(); err != nil {
 		return err
 	} else if n == 0 {
-		return ErrUnauthorized
+		return apperror.New(apperror.CodeScrapNotFound)
 	}
 	return nil
 }
+
+// notFound gives err the code of what was looked for if it is sql.ErrNoRows, which stays its cause.
+func notFound(err error, code apperror.Code) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return apperror.Wrap(code, err)
+	}
+	return err
+}
+
+// nonNil returns s, or an empty slice if it is nil, since pq sends a nil slice as null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+// testDB connects to the database named by GPTEA_TEST_DB, e.g. the one of devtools/local-db.sh at
+// "host=localhost port=5432 user=postgres password=password dbname=gptea sslmode=disable",
+// and skips the test without one.
+func testDB(t *testing.T) *DB {
+	dsn := os.Getenv("GPTEA_TEST_DB")
+	if dsn == "" {
+		t.Skip("GPTEA_TEST_DB is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db)
+}
+
+// testChat registers a user with a chat, both deleted after the test.
+func testChat(t *testing.T, db *DB) (string, internal.Chat) {
+	ctx := context.Background()
+	userID, err := internal.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Register(ctx, internal.RegisterInput{UserID: userID, CredentialType: "test", CredentialID: userID}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Resign(context.Background(), userID) })
+	chat, err := internal.NewChat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertChat(ctx, userID, *chat); err != nil {
+		t.Fatal(err)
+	}
+	return userID, *chat
+}
+
+func TestAssignSeqs(t *testing.T) {
+	msgs := []*internal.Message{{ParentSeq: 3}, {}, {}}
+
+	assignSeqs(msgs, 7)
+	for i, want := range []struct{ seq, parentSeq int }{{8, 3}, {9, 8}, {10, 9}} {
+		if msgs[i].Seq != want.seq || msgs[i].ParentSeq != want.parentSeq {
+			t.Errorf("message %d is seq %d after %d, want %d after %d", i, msgs[i].Seq, msgs[i].ParentSeq, want.seq, want.parentSeq)
+		}
+	}
+}
+
+func TestAppendTurnConcurrently(t *testing.T) {
+	db := testDB(t)
+	userID, chat := testChat(t, db)
+
+	const turns = 8
+	results := make([][]*internal.Message, turns)
+	errs := make([]error, turns)
+	var wg sync.WaitGroup
+	for i := 0; i < turns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			now := time.Now().UTC()
+			results[i] = []*internal.Message{
+				{ChatID: chat.ID, Content: "hello", Role: openai.ChatMessageRoleUser, CreatedAt: now},
+				{ChatID: chat.ID, Content: "hi", Role: openai.ChatMessageRoleAssistant, CreatedAt: now},
+			}
+			errs[i] = db.AppendTurn(context.Background(), userID, results[i]...)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for i, turn := range results {
+		if errs[i] != nil {
+			t.Fatalf("turn %d: %v", i, errs[i])
+		}
+		if turn[1].Seq != turn[0].Seq+1 || turn[1].ParentSeq != turn[0].Seq {
+			t.Errorf("turn %d is seqs %d and %d after %d, want the reply right after its message", i, turn[0].Seq, turn[1].Seq, turn[1].ParentSeq)
+		}
+		for _, msg := range turn {
+			if seen[msg.Seq] {
+				t.Errorf("seq %d assigned twice", msg.Seq)
+			}
+			seen[msg.Seq] = true
+		}
+	}
+	for seq := 1; seq <= 2*turns; seq++ {
+		if !seen[seq] {
+			t.Errorf("seq %d skipped", seq)
+		}
+	}
+	if last, err := db.SelectLastSeq(context.Background(), userID, chat.ID); err != nil || last != 2*turns {
+		t.Errorf("last seq is %d, %v, want %d", last, err, 2*turns)
+	}
+}
+
+func TestSelectMessagePathNewestFirst(t *testing.T) {
+	db := testDB(t)
+	userID, chat := testChat(t, db)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		now := time.Now().UTC()
+		turn := []*internal.Message{
+			{ChatID: chat.ID, ParentSeq: 2 * i, Content: "hello", Role: openai.ChatMessageRoleUser, CreatedAt: now},
+			{ChatID: chat.ID, Content: "hi", Role: openai.ChatMessageRoleAssistant, CreatedAt: now},
+		}
+		if err := db.AppendTurn(ctx, userID, turn...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	branch, err := db.SelectMessagePath(ctx, userID, chat.ID, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range branch {
+		if want := 4 - i; msg.Seq != want {
+			t.Errorf("message %d is seq %d, want %d", i, msg.Seq, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+// matches and score are the full text search of a column against $1, the query, $2, the query as a like pattern:
+// the words of the query, which the simple configuration splits on spaces without stemming, then for korean,
+// whose particles stick to words, the query anywhere in the column or a column word close to it by trigrams.
+// Both use the indexes of devtools/db.sql.
+func matches(column string) string {
+	return `(to_tsvector('simple', ` + column + `) @@ websearch_to_tsquery('simple', $1)
+		OR ` + column + ` ILIKE $2 OR $1 <% ` + column + `)`
+}
+
+func score(column string) string {
+	return `ts_rank(to_tsvector('simple', ` + column + `), websearch_to_tsquery('simple', $1)) + word_similarity($1, ` + column + `)`
+}
+
+// SearchMine returns the chats, messages and scraps of the user matching the keywords of query, best first,
+// skipping offset of them and returning up to limit. Tool calls and their results aren't searched.
+func (db *DB) SearchMine(ctx context.Context, userID, query string, filter internal.SearchFilter, limit, offset int) ([]internal.SearchResult, error) {
+	// every kind is ranked the same way, so the best limit + offset of each are enough to merge
+	n := limit + offset
+	args := []any{query, "%" + escapeLike(query) + "%", userID, filter.ChatID, filter.ScrapbookID, filter.From, filter.To, n}
+	var results []internal.SearchResult
+
+	if filter.Wants(internal.SearchResultChat) {
+		q := `SELECT c.id, c.name, c.created_at, c.model, c.temperature, c.top_p, c.max_tokens,
+			c.presence_penalty, c.frequency_penalty, c.system_prompt, c.use_scraps, c.head_seq, ` + score("c.name") + `
+			FROM chats AS c
+			WHERE c.user_id = $3 AND ` + matches("c.name") + `
+			AND ($4 = '' OR c.id = $4) AND $5 = ''
+			AND ($6::timestamptz IS NULL OR c.created_at >= $6) AND ($7::timestamptz IS NULL OR c.created_at < $7)
+			ORDER BY 13 DESC, c.created_at DESC
+			LIMIT $8`
+		rows, err := db.db.QueryContext(ctx, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var chat internal.Chat
+			res := internal.SearchResult{Type: internal.SearchResultChat, Chat: &chat}
+			if err := rows.Scan(&chat.ID, &chat.Name, &chat.CreatedAt, &chat.Model, &chat.Temperature, &chat.TopP, &chat.MaxTokens,
+				&chat.PresencePenalty, &chat.FrequencyPenalty, &chat.SystemPrompt, &chat.UseScraps, &chat.HeadSeq, &res.Score); err != nil {
+				return nil, err
+			}
+			results = append(results, res)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.Wants(internal.SearchResultMessage) {
+		q := `SELECT m.chat_id, m.seq, m.content, m.role, m.created_at, ` + score("m.content") + `
+			FROM messages AS m
+			INNER JOIN chats AS c
+			ON m.chat_id = c.id
+			WHERE c.user_id = $3 AND m.role IN ('user', 'assistant') AND ` + matches("m.content") + `
+			AND ($4 = '' OR m.chat_id = $4) AND $5 = ''
+			AND ($6::timestamptz IS NULL OR m.created_at >= $6) AND ($7::timestamptz IS NULL OR m.created_at < $7)
+			ORDER BY 6 DESC, m.created_at DESC
+			LIMIT $8`
+		rows, err := db.db.QueryContext(ctx, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var msg internal.Message
+			res := internal.SearchResult{Type: internal.SearchResultMessage, Message: &msg}
+			if err := rows.Scan(&msg.ChatID, &msg.Seq, &msg.Content, &msg.Role, &msg.CreatedAt, &res.Score); err != nil {
+				return nil, err
+			}
+			results = append(results, res)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.Wants(internal.SearchResultScrap) {
+		q := `SELECT s.id, s.memo, s.created_at, m.chat_id, m.seq, m.content, m.role, m.created_at, ` + score("s.memo") + `
+			FROM scraps AS s
+			INNER JOIN messages AS m
+			ON s.message_chat_id = m.chat_id AND s.message_seq = m.seq
+			INNER JOIN chats AS c
+			ON m.chat_id = c.id
+			WHERE c.user_id = $3 AND ` + matches("s.memo") + `
+			AND ($4 = '' OR m.chat_id = $4)
+			AND ($5 = '' OR EXISTS (SELECT 1 FROM scraps_scrapbooks AS ss WHERE ss.scrap_id = s.id AND ss.scrapbook_id = $5))
+			AND ($6::timestamptz IS NULL OR s.created_at >= $6) AND ($7::timestamptz IS NULL OR s.created_at < $7)
+			ORDER BY 9 DESC, s.created_at DESC
+			LIMIT $8`
+		rows, err := db.db.QueryContext(ctx, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			scrap := internal.ScrapWithMessage{Message: &internal.Message{}}
+			res := internal.SearchResult{Type: internal.SearchResultScrap, Scrap: &scrap}
+			if err := rows.Scan(&scrap.ID, &scrap.Memo, &scrap.CreatedAt,
+				&scrap.Message.ChatID, &scrap.Message.Seq, &scrap.Message.Content, &scrap.Message.Role, &scrap.Message.CreatedAt, &res.Score); err != nil {
+				return nil, err
+			}
+			results = append(results, res)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if offset >= len(results) {
+		return nil, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// escapeLike escapes the wildcards of LIKE in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
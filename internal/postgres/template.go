@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+func (db *DB) SelectMyTemplates(ctx context.Context, userID string) ([]internal.PromptTemplate, error) {
+	query := `SELECT id, name, content, variables, created_at FROM prompt_templates WHERE user_id = $1 ORDER BY created_at ASC`
+	rows, err := db.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []internal.PromptTemplate
+	for rows.Next() {
+		var template internal.PromptTemplate
+		var variables []byte
+		if err := rows.Scan(&template.ID, &template.Name, &template.Content, &variables, &template.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(variables, &template.Variables); err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+func (db *DB) SelectMyTemplate(ctx context.Context, userID, templateID string) (internal.PromptTemplate, error) {
+	query := `SELECT id, user_id, name, content, variables, created_at FROM prompt_templates WHERE id = $1`
+	var template internal.PromptTemplate
+	var templateUserID string
+	var variables []byte
+	if err := db.db.QueryRowContext(ctx, query, templateID).Scan(&template.ID, &templateUserID, &template.Name, &template.Content, &variables, &template.CreatedAt); err != nil {
+		return internal.PromptTemplate{}, notFound(err, apperror.CodeTemplateNotFound)
+	}
+	if templateUserID != userID {
+		return internal.PromptTemplate{}, apperror.New(apperror.CodeTemplateNotFound)
+	}
+	if err := json.Unmarshal(variables, &template.Variables); err != nil {
+		return internal.PromptTemplate{}, err
+	}
+	return template, nil
+}
+
+func (db *DB) InsertTemplate(ctx context.Context, userID string, inp internal.PromptTemplate) error {
+	variables, err := marshalVariables(inp.Variables)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO prompt_templates (id, user_id, name, content, variables, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = db.db.ExecContext(ctx, query, inp.ID, userID, inp.Name, inp.Content, variables, inp.CreatedAt)
+	return err
+}
+
+// PatchTemplate replaces the name, content and variables of the template.
+func (db *DB) PatchTemplate(ctx context.Context, userID string, inp internal.PromptTemplate) error {
+	variables, err := marshalVariables(inp.Variables)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE prompt_templates SET name = $1, content = $2, variables = $3 WHERE id = $4 AND user_id = $5`
+	res, err := db.db.ExecContext(ctx, query, inp.Name, inp.Content, variables, inp.ID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return apperror.New(apperror.CodeTemplateNotFound)
+	}
+	return nil
+}
+
+func (db *DB) DeleteTemplate(ctx context.Context, userID, templateID string) error {
+	query := `DELETE FROM prompt_templates WHERE id = $1 AND user_id = $2`
+	res, err := db.db.ExecContext(ctx, query, templateID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return apperror.New(apperror.CodeTemplateNotFound)
+	}
+	return nil
+}
+
+func marshalVariables(variables []internal.TemplateVariable) ([]byte, error) {
+	if variables == nil {
+		// a nil slice would be stored as json null
+		variables = []internal.TemplateVariable{}
+	}
+	return json.Marshal(variables)
+}
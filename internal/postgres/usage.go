@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+const dayLayout = "2006-01-02"
+
+// addUsage adds a generation to the usage of the user on the day, in utc, it was created.
+func addUsage(ctx context.Context, tx *sql.Tx, userID string, createdAt time.Time, messages int, gen internal.Generation) error {
+	query := `INSERT INTO usages (user_id, day, messages, prompt_tokens, completion_tokens) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, day) DO UPDATE SET messages = usages.messages + EXCLUDED.messages,
+		prompt_tokens = usages.prompt_tokens + EXCLUDED.prompt_tokens,
+		completion_tokens = usages.completion_tokens + EXCLUDED.completion_tokens`
+	_, err := tx.ExecContext(ctx, query, userID, createdAt.UTC().Format(dayLayout), messages, gen.PromptTokens, gen.CompletionTokens)
+	return err
+}
+
+// AddUsage adds usage to the usage of the user on the day, in utc, of at.
+// Messages add their usage when they are inserted, this is for calls that make no message, like summarizing.
+func (db *DB) AddUsage(ctx context.Context, userID string, at time.Time, usage internal.Usage) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	gen := internal.Generation{PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens}
+	if err := addUsage(ctx, tx, userID, at, usage.Messages, gen); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SelectUsageSince returns the usage of the user from the day, in utc, of since up to now.
+func (db *DB) SelectUsageSince(ctx context.Context, userID string, since time.Time) (internal.Usage, error) {
+	query := `SELECT COALESCE(SUM(messages), 0), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0)
+		FROM usages WHERE user_id = $1 AND day >= $2`
+	var usage internal.Usage
+	if err := db.db.QueryRowContext(ctx, query, userID, since.UTC().Format(dayLayout)).Scan(
+		&usage.Messages, &usage.PromptTokens, &usage.CompletionTokens); err != nil {
+		return internal.Usage{}, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/lib/pq"
+)
+
+func (db *DB) SelectMessageVersions(ctx context.Context, userID, chatID string, seq int) ([]internal.MessageVersion, error) {
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT chat_id, seq, version, content, created_at, model, finish_reason, prompt_tokens, completion_tokens, citations
+		FROM message_versions
+		WHERE chat_id = $1 AND seq = $2
+		ORDER BY version ASC`
+	rows, err := db.db.QueryContext(ctx, query, chatID, seq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []internal.MessageVersion
+	for rows.Next() {
+		var version internal.MessageVersion
+		if err := rows.Scan(&version.ChatID, &version.Seq, &version.Version, &version.Content, &version.CreatedAt,
+			&version.Model, &version.FinishReason, &version.PromptTokens, &version.CompletionTokens, (*pq.StringArray)(&version.Citations)); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// InsertMessageVersion adds msg as the next version of the message at its seq and makes it the active one.
+// msg is added to the usage of the user.
+func (db *DB) InsertMessageVersion(ctx context.Context, userID string, msg internal.Message) (internal.MessageVersion, error) {
+	chatID, seq := msg.ChatID, msg.Seq
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return internal.MessageVersion{}, err
+	}
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return internal.MessageVersion{}, err
+	}
+	defer tx.Rollback()
+
+	version := internal.MessageVersion{
+		ChatID:     chatID,
+		Seq:        seq,
+		Content:    msg.Content,
+		CreatedAt:  time.Now().UTC(),
+		Generation: msg.Generation,
+	}
+	// locks the message, so that concurrent regenerations get distinct versions
+	query := `SELECT version FROM messages WHERE chat_id = $1 AND seq = $2 FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, chatID, seq).Scan(new(int)); err != nil {
+		return internal.MessageVersion{}, err
+	}
+	citations := pq.Array(nonNil(version.Citations))
+	query = `INSERT INTO message_versions (chat_id, seq, version, content, created_at,
+		model, finish_reason, prompt_tokens, completion_tokens, citations)
+		SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3, $4, $5, $6, $7, $8, $9
+		FROM message_versions
+		WHERE chat_id = $1 AND seq = $2
+		RETURNING version`
+	if err := tx.QueryRowContext(ctx, query, chatID, seq, version.Content, version.CreatedAt,
+		version.Model, version.FinishReason, version.PromptTokens, version.CompletionTokens, citations).Scan(&version.Version); err != nil {
+		return internal.MessageVersion{}, err
+	}
+	query = `UPDATE messages SET content = $1, version = $2,
+		model = $3, finish_reason = $4, prompt_tokens = $5, completion_tokens = $6, citations = $7
+		WHERE chat_id = $8 AND seq = $9`
+	if _, err := tx.ExecContext(ctx, query, version.Content, version.Version,
+		version.Model, version.FinishReason, version.PromptTokens, version.CompletionTokens, citations, chatID, seq); err != nil {
+		return internal.MessageVersion{}, err
+	}
+	if err := addUsage(ctx, tx, userID, version.CreatedAt, 1, version.Generation); err != nil {
+		return internal.MessageVersion{}, err
+	}
+	return version, tx.Commit()
+}
+
+// ActivateMessageVersion makes version the active version of the message.
+func (db *DB) ActivateMessageVersion(ctx context.Context, userID, chatID string, seq, version int) error {
+	_, err := db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE messages AS m SET content = v.content, version = v.version,
+		model = v.model, finish_reason = v.finish_reason, prompt_tokens = v.prompt_tokens, completion_tokens = v.completion_tokens,
+		citations = v.citations
+		FROM message_versions AS v
+		WHERE m.chat_id = v.chat_id AND m.seq = v.seq
+		AND v.chat_id = $1 AND v.seq = $2 AND v.version = $3`
+	res, err := db.db.ExecContext(ctx, query, chatID, seq, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return apperror.New(apperror.CodeMessageVersionNotFound)
+	}
+	return nil
+}
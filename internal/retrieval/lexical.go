@@ -0,0 +1,126 @@
+// Package retrieval ranks the documents of a user by how relevant they are to a query.
+package retrieval
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Document is something of the user that can be retrieved, e.g. a scrap with its message.
+type Document struct {
+	ID   string
+	Text string
+}
+
+type Ranked struct {
+	Document
+	Score float64
+}
+
+// bm25 parameters, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Lexical ranks docs by BM25 of the terms of query, the documents themselves being the corpus,
+// and returns the best k with a score above zero, best first.
+// Korean has no spaces between a word and its particles, so Hangul is matched by character bigrams.
+func Lexical(query string, docs []Document, k int) []Ranked {
+	queryTerms := terms(query)
+	if len(queryTerms) == 0 || len(docs) == 0 {
+		return nil
+	}
+
+	frequencies := make([]map[string]int, len(docs))
+	lengths := make([]int, len(docs))
+	documentFrequency := map[string]int{}
+	total := 0
+	for i, doc := range docs {
+		frequencies[i] = map[string]int{}
+		for _, term := range terms(doc.Text) {
+			if frequencies[i][term] == 0 {
+				documentFrequency[term]++
+			}
+			frequencies[i][term]++
+			lengths[i]++
+		}
+		total += lengths[i]
+	}
+	avgLength := math.Max(float64(total)/float64(len(docs)), 1)
+
+	var ranked []Ranked
+	for i, doc := range docs {
+		var score float64
+		for _, term := range uniq(queryTerms) {
+			f := float64(frequencies[i][term])
+			if f == 0 {
+				continue
+			}
+			n := float64(documentFrequency[term])
+			idf := math.Log(1 + (float64(len(docs))-n+0.5)/(n+0.5))
+			score += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(lengths[i])/avgLength))
+		}
+		if score > 0 {
+			ranked = append(ranked, Ranked{Document: doc, Score: score})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+	if len(ranked) > k {
+		ranked = ranked[:k]
+	}
+	return ranked
+}
+
+// terms splits text into lowercase words, and runs of Hangul into their character bigrams.
+func terms(text string) []string {
+	var res []string
+	var word []rune
+	hangul := false
+	flush := func() {
+		switch {
+		case len(word) == 0:
+		case hangul && len(word) > 1:
+			for i := 0; i+1 < len(word); i++ {
+				res = append(res, string(word[i:i+2]))
+			}
+		default:
+			res = append(res, string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Hangul, r):
+			if !hangul {
+				flush()
+			}
+			hangul = true
+			word = append(word, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if hangul {
+				flush()
+			}
+			hangul = false
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return res
+}
+
+func uniq(terms []string) []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			res = append(res, term)
+		}
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+package retrieval
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Snippet returns about width runes of text around the first match of query, html escaped with every match in <mark>.
+// The words of query are matched anywhere, case insensitively, so that a korean word matches with its particles.
+// Failing that, the character bigrams of hangul words are matched. text is returned from its start if nothing matches.
+func Snippet(text, query string, width int) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		// lower casing changed the length, matches can't be mapped back
+		lower = runes
+	}
+	var words []string
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		// websearch syntax: quoted phrases match word by word here, and -word excludes the word
+		if word = strings.Trim(word, `"`); word != "" && word != "or" && !strings.HasPrefix(word, "-") {
+			words = append(words, word)
+		}
+	}
+	marked := mark(lower, words)
+	if !anyMarked(marked) {
+		var bigrams []string
+		for _, term := range terms(query) {
+			if len([]rune(term)) == 2 && unicode.Is(unicode.Hangul, []rune(term)[0]) {
+				bigrams = append(bigrams, term)
+			}
+		}
+		marked = mark(lower, bigrams)
+	}
+
+	start, end := 0, len(runes)
+	for i, m := range marked {
+		if m {
+			start = i - width/3
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start+width < end {
+		end = start + width
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			b.WriteString("<mark>")
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			b.WriteString("</mark>")
+		}
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// mark reports for every rune of text whether it is part of an occurrence of one of words.
+func mark(text []rune, words []string) []bool {
+	marked := make([]bool, len(text))
+	for _, word := range words {
+		w := []rune(word)
+		if len(w) == 0 {
+			continue
+		}
+		for i := 0; i+len(w) <= len(text); i++ {
+			if string(text[i:i+len(w)]) == word {
+				for j := i; j < i+len(w); j++ {
+					marked[j] = true
+				}
+			}
+		}
+	}
+	return marked
+}
+
+func anyMarked(marked []bool) bool {
+	for _, m := range marked {
+		if m {
+			return true
+		}
+	}
+	return false
+}
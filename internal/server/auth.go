@@ -1,15 +1,14 @@
 package server
 
 import (
-	"database/sql"
 	"errors"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/evergarden0412/gptea-api/internal"
-	"github.com/evergarden0412/gptea-api/internal/credential"
-	"github.com/evergarden0412/gptea-api/internal/postgres"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/kataras/golog"
 )
@@ -24,42 +23,46 @@ type credBody struct {
 // @Description Register a credential
 // @Param body body credBody true "body"
 // @Success 201 {object} messageResponse
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse "credential_invalid"
+// @Failure 409 {object} errorResponse "credential_already_registered"
+// @Failure 500 {object} errorResponse
 // @Router /auth/cred/register [post]
 // @Tags auth
 func (s *Server) handleRegister(ctx *gin.Context) {
 	var body credBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		golog.Error("handleRegister: bind json: ", err)
 		return
 	}
 
-	cred, err := credential.New(body.Cred)
+	cred, err := s.credentials(body.Cred)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeCredentialUnsupported, err))
 		golog.Error("handleRegister: new credential: ", err)
 		return
 	}
 	verifyResult, err := cred.Verify(ctx, body.AccessToken)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeCredentialInvalid, err))
 		golog.Error("handleRegister: verify: ", err)
 		return
 	}
 	userID, err := internal.NewID()
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleRegister: new user id: ", err)
 		return
 	}
 	now := time.Now().UTC()
-	if err := s.db.Register(ctx, postgres.RegisterInput{
+	if err := s.db.Register(ctx, internal.RegisterInput{
 		UserID:         userID,
 		CredentialType: verifyResult.CredentialProvider,
 		CredentialID:   verifyResult.CredentialID,
 		CreatedAt:      &now,
 	}); err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleRegister: register: ", err)
 		return
 	}
@@ -77,55 +80,53 @@ type signInHandlerOutput struct {
 // @Param body body credBody true "body"
 // @Success 200 {object} signInHandlerOutput
 // @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse "credential_invalid"
+// @Failure 404 {object} errorResponse "credential_not_registered"
 // @Failure 500 {object} errorResponse
 // @Router /auth/cred/sign-in [post]
 // @Tags auth
 func (s *Server) handleSignIn(ctx *gin.Context) {
 	var body credBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		return
 	}
 
-	cred, err := credential.New(body.Cred)
+	cred, err := s.credentials(body.Cred)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeCredentialUnsupported, err))
 		golog.Error("handleSignIn: new credential: ", err)
 		return
 	}
 	verifyResult, err := cred.Verify(ctx, body.AccessToken)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeCredentialInvalid, err))
 		golog.Error("handleSignIn: verify: ", err)
 		return
 	}
 
 	userID, err := s.db.SignIn(ctx, verifyResult.CredentialProvider, verifyResult.CredentialID)
-	if errors.Is(err, sql.ErrNoRows) {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
-		return
-	}
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+	if err != nil {
+		respondError(ctx, err)
 		golog.Error("handleSignIn: sign in: ", err)
 		return
 	}
 
 	at, err := s.a.IssueAccessToken(userID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleSignIn: issue access token: ", err)
 		return
 	}
 	rt, err := s.a.IssueRefreshToken(at.ID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleSignIn: issue refresh token: ", err)
 		return
 	}
 	if err := s.db.UpsertRefreshToken(ctx, at.Subject, rt.ID); err != nil {
 		golog.Error("handleSignIn: upsert refresh token: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 	ctx.JSON(http.StatusOK, signInHandlerOutput{
@@ -148,58 +149,62 @@ type tokenResponse struct {
 // @Security RefreshTokenAuth
 // @Success 200 {object} signInHandlerOutput
 // @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
 // @Failure 500 {object} errorResponse
 // @Router /auth/token/refresh [post]
 // @tags token
 func (s *Server) handleRefreshToken(ctx *gin.Context) {
 	var header tokenHeader
 	if err := ctx.ShouldBindHeader(&header); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		golog.Error("handleRefreshToken: bind header: ", err)
 		return
 	}
 	atStr, found := strings.CutPrefix(header.Authorization, "Bearer ")
 	if !found {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: "no bearer prefix"})
+		respondError(ctx, apperror.New(apperror.CodeTokenMissing))
 		golog.Error("handleRefreshToken: cut prefix: not found")
 		return
 	}
 	if atStr == "" || header.XRefreshToken == "" {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: "no token"})
+		respondError(ctx, apperror.New(apperror.CodeTokenMissing))
 		golog.Error("handleRefreshToken: no token")
 		return
 	}
 
 	at, err := s.a.VerifyAccessTokenForRefresh(atStr)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeTokenInvalid, err))
 		golog.Error("handleRefreshToken: verify access token: ", err)
 		return
 	}
 	rt, err := s.a.VerifyRefreshToken(header.XRefreshToken)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeTokenInvalid, err))
 		golog.Error("handleRefreshToken: verify refresh token: ", err)
 		return
 	}
 	if exists, err := s.db.IsRefreshTokenExists(ctx, at.Subject, rt.ID); err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleRefreshToken: exists refresh token: ", err)
 		return
 	} else if !exists {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: "refresh token not in db"})
+		respondError(ctx, apperror.New(apperror.CodeRefreshTokenRevoked))
 		golog.Error("handleRefreshToken: refresh token not in db")
 		return
 	}
 
 	newAT, newRT, err := s.a.RefreshAccessToken(at, rt)
+	if errors.Is(err, auth.ErrTokensNotMatch) {
+		err = apperror.Wrap(apperror.CodeTokenInvalid, err)
+	}
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleRefreshToken: refresh: ", err)
 		return
 	}
 	if err := s.db.UpsertRefreshToken(ctx, newAT.Subject, newRT.ID); err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleRefreshToken: upsert refresh token: ", err)
 		return
 	}
@@ -224,7 +229,7 @@ func (s *Server) handleLogout(ctx *gin.Context) {
 
 	if err := s.db.Logout(ctx, userID); err != nil {
 		golog.Error("handleLogout: delete refresh token: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -243,7 +248,7 @@ func (s *Server) handleDeleteMe(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
 
 	if err := s.db.Resign(ctx, userID); err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handleDeleteMe: delete user: ", err)
 		return
 	}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/credential"
+)
+
+// fakeCredential verifies any token but "bad" as the account of the same ID at its provider.
+type fakeCredential struct {
+	provider string
+}
+
+func (c fakeCredential) Verify(ctx context.Context, token string) (credential.VerifyResult, error) {
+	if token == "bad" {
+		return credential.VerifyResult{}, credential.ErrFailedVerify
+	}
+	return credential.VerifyResult{CredentialProvider: c.provider, CredentialID: token}, nil
+}
+
+// fakeCredentials makes the server verify the tokens of naver with fakeCredential instead of asking naver.
+func (ts *testServer) fakeCredentials() {
+	ts.s.credentials = func(provider string) (credential.Credential, error) {
+		if provider != credential.ProviderNaver {
+			return nil, credential.ErrUnknownProvider
+		}
+		return fakeCredential{provider: provider}, nil
+	}
+}
+
+// refresh exchanges the tokens for new ones, which the response has with status.
+func (ts *testServer) refresh(status int, tokens signInHandlerOutput) *signInHandlerOutput {
+	ts.t.Helper()
+	rec := ts.must(status, tokens.AccessToken, "POST", "/auth/token/refresh", nil, "X-Refresh-Token", tokens.RefreshToken)
+	if status != http.StatusOK {
+		return nil
+	}
+	refreshed := decode[signInHandlerOutput](ts.t, rec)
+	return &refreshed
+}
+
+func TestAuthFlow(t *testing.T) {
+	ts := newTestServer(t)
+	ts.fakeCredentials()
+	cred := credBody{Cred: credential.ProviderNaver, AccessToken: "alice"}
+
+	ts.must(http.StatusCreated, "", "POST", "/auth/cred/register", cred)
+	tokens := decode[signInHandlerOutput](t, ts.must(http.StatusOK, "", "POST", "/auth/cred/sign-in", cred))
+	ts.must(http.StatusOK, tokens.AccessToken, "GET", "/me/chats", nil)
+
+	refreshed := ts.refresh(http.StatusOK, tokens)
+	ts.must(http.StatusOK, refreshed.AccessToken, "GET", "/me/chats", nil)
+	// a refresh token is good for one refresh
+	ts.refresh(http.StatusUnauthorized, tokens)
+
+	ts.must(http.StatusNoContent, refreshed.AccessToken, "POST", "/auth/cred/logout", nil)
+	rec := ts.must(http.StatusUnauthorized, refreshed.AccessToken, "POST", "/auth/token/refresh", nil, "X-Refresh-Token", refreshed.RefreshToken)
+	if code := decode[errorResponse](t, rec).Code; code != apperror.CodeRefreshTokenRevoked {
+		t.Errorf("refresh after logout got %s, want %s", code, apperror.CodeRefreshTokenRevoked)
+	}
+
+	// signing in again starts over
+	tokens = decode[signInHandlerOutput](t, ts.must(http.StatusOK, "", "POST", "/auth/cred/sign-in", cred))
+	ts.refresh(http.StatusOK, tokens)
+}
+
+func TestAuthCredentialErrors(t *testing.T) {
+	ts := newTestServer(t)
+	ts.fakeCredentials()
+	ts.must(http.StatusCreated, "", "POST", "/auth/cred/register", credBody{Cred: credential.ProviderNaver, AccessToken: "alice"})
+
+	tests := []struct {
+		name string
+		path string
+		body credBody
+		want apperror.Code
+	}{
+		{"register twice", "/auth/cred/register", credBody{Cred: credential.ProviderNaver, AccessToken: "alice"}, apperror.CodeCredentialAlreadyRegistered},
+		{"register unsupported", "/auth/cred/register", credBody{Cred: "myspace", AccessToken: "bob"}, apperror.CodeCredentialUnsupported},
+		{"register unverified", "/auth/cred/register", credBody{Cred: credential.ProviderNaver, AccessToken: "bad"}, apperror.CodeCredentialInvalid},
+		{"sign in unregistered", "/auth/cred/sign-in", credBody{Cred: credential.ProviderNaver, AccessToken: "bob"}, apperror.CodeCredentialNotRegistered},
+		{"sign in unsupported", "/auth/cred/sign-in", credBody{Cred: "myspace", AccessToken: "alice"}, apperror.CodeCredentialUnsupported},
+		{"sign in unverified", "/auth/cred/sign-in", credBody{Cred: credential.ProviderNaver, AccessToken: "bad"}, apperror.CodeCredentialInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do("", "POST", tt.path, tt.body)
+			if code := decode[errorResponse](t, rec).Code; code != tt.want {
+				t.Errorf("got %d %s, want %s", rec.Code, code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/authz"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// authorize responds with 404 unless the user may act on the resources in the path:
+// the chat, or the message at seq in it, the scrap, the scrapbook and the template. GET reads them, other methods write them.
+func (s *Server) authorize(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	resources, err := pathResources(ctx)
+	if err != nil {
+		golog.Error("authorize: path resources: ", err)
+		respondError(ctx, err)
+		return
+	}
+	action := authz.ActionWrite
+	if ctx.Request.Method == http.MethodGet {
+		action = authz.ActionRead
+	}
+	if err := s.authz.Authorize(ctx, userID, action, resources...); err != nil {
+		golog.Error("authorize: ", err)
+		respondError(ctx, err)
+		return
+	}
+}
+
+func pathResources(ctx *gin.Context) ([]authz.Resource, error) {
+	var resources []authz.Resource
+	if chatID := ctx.Param("chatID"); chatID != "" {
+		if ctx.Param("seq") == "" {
+			resources = append(resources, authz.Chat(chatID))
+		} else {
+			seq, err := strconv.Atoi(ctx.Param("seq"))
+			if err != nil {
+				return nil, apperror.Invalid(err)
+			}
+			resources = append(resources, authz.Message(chatID, seq))
+		}
+	}
+	if scrapID := ctx.Param("scrapID"); scrapID != "" {
+		resources = append(resources, authz.Scrap(scrapID))
+	}
+	if scrapbookID := ctx.Param("scrapbookID"); scrapbookID != "" {
+		resources = append(resources, authz.Scrapbook(scrapbookID))
+	}
+	if templateID := ctx.Param("templateID"); templateID != "" {
+		resources = append(resources, authz.Template(templateID))
+	}
+	return resources, nil
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/credential"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+)
+
+type routeRule int
+
+const (
+	// public routes are open to anyone.
+	public routeRule = iota
+	// user routes need an access token and act on nothing but the user's own resources.
+	user
+	// owned routes need an access token and answer 404 for the resources in their path the user doesn't own.
+	owned
+)
+
+// routeRules is the access rule of every route Install adds, by its method and path.
+var routeRules = map[string]routeRule{
+	"GET /ping2":                                         public,
+	"POST /auth/cred/register":                           public,
+	"POST /auth/cred/sign-in":                            public,
+	"POST /auth/cred/logout":                             user,
+	"POST /auth/token/refresh":                           public,
+	"DELETE /me":                                         user,
+	"GET /me/usage":                                      user,
+	"GET /swagger/*any":                                  public,
+	"GET /me/chats":                                      user,
+	"GET /me/chats/:chatID":                              owned,
+	"POST /me/chats":                                     user,
+	"PATCH /me/chats/:chatID":                            owned,
+	"DELETE /me/chats/:chatID":                           owned,
+	"GET /me/chats/:chatID/summary":                      owned,
+	"PUT /me/chats/:chatID/branch":                       owned,
+	"DELETE /me/chats/:chatID/generation":                owned,
+	"POST /me/chats/:chatID/title:generate":              owned,
+	"GET /me/chats/:chatID/messages":                     owned,
+	"POST /me/chats/:chatID/messages":                    owned,
+	"GET /me/chats/:chatID/jobs/:jobID":                  owned,
+	"PATCH /me/chats/:chatID/messages/:seq":              owned,
+	"POST /me/chats/:chatID/messages/:seq/regenerate":    owned,
+	"GET /me/chats/:chatID/messages/:seq/versions":       owned,
+	"POST /me/chats/:chatID/messages/:seq/edit":          owned,
+	"GET /me/templates":                                  user,
+	"GET /me/templates/:templateID":                      owned,
+	"POST /me/templates":                                 user,
+	"PATCH /me/templates/:templateID":                    owned,
+	"DELETE /me/templates/:templateID":                   owned,
+	"GET /me/scrapbooks":                                 user,
+	"GET /me/scrapbooks/:scrapbookID":                    owned,
+	"POST /me/scrapbooks":                                user,
+	"DELETE /me/scrapbooks/:scrapbookID":                 owned,
+	"PATCH /me/scrapbooks/:scrapbookID":                  owned,
+	"GET /me/scrapbooks/:scrapbookID/scraps":             owned,
+	"GET /me/scraps":                                     user,
+	"POST /me/scraps":                                    user,
+	"PATCH /me/scraps/:scrapID":                          owned,
+	"DELETE /me/scraps/:scrapID":                         owned,
+	"GET /me/scraps/:scrapID/scrapbooks":                 owned,
+	"POST /me/scraps/:scrapID/scrapbooks/:scrapbookID":   owned,
+	"DELETE /me/scraps/:scrapID/scrapbooks/:scrapbookID": owned,
+	"GET /me/search":                                     user,
+	"GET /me/search/semantic":                            user,
+}
+
+func TestRoutesHaveRules(t *testing.T) {
+	ts := newTestServer(t)
+
+	installed := map[string]bool{}
+	for _, route := range ts.router.Routes() {
+		key := route.Method + " " + route.Path
+		installed[key] = true
+		rule, ok := routeRules[key]
+		if !ok {
+			t.Errorf("route %s has no rule in routeRules", key)
+			continue
+		}
+		if rule != owned && strings.Contains(route.Path, "/:") {
+			t.Errorf("route %s has resources in its path, want it owned", key)
+		}
+	}
+	for key := range routeRules {
+		if !installed[key] && key != "GET /swagger/*any" {
+			t.Errorf("rule for %s, which isn't installed", key)
+		}
+	}
+}
+
+func TestRoutesOfOthers(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := ts.register("alice"), ts.register("bob")
+	chatID := ts.createChat(alice, "tea")
+	ts.postMessage(alice, chatID, "hello")
+	scrapbookID := ts.createScrapbook(alice, "recipes")
+	scrap := ts.createScrap(alice, chatID, 2, "hi", scrapbookID)
+	template := decode[internal.PromptTemplate](t, ts.must(http.StatusCreated, alice, "POST", "/me/templates", templateBody{Name: "greet", Content: "hello"}))
+	// the resources of alice, which bob mustn't find
+	path := strings.NewReplacer(
+		":chatID", chatID,
+		":seq", "2",
+		":jobID", "job",
+		":scrapID", scrap.ID,
+		":scrapbookID", scrapbookID,
+		":templateID", template.ID,
+	)
+
+	for _, route := range ts.router.Routes() {
+		key := route.Method + " " + route.Path
+		rule := routeRules[key]
+		if rule == public {
+			continue
+		}
+		t.Run(key, func(t *testing.T) {
+			if rec := ts.do("", route.Method, path.Replace(route.Path), nil); rec.Code != http.StatusUnauthorized {
+				t.Errorf("got %d without a token, want 401", rec.Code)
+			}
+			if rule != owned {
+				return
+			}
+			if rec := ts.do(bob, route.Method, path.Replace(route.Path), nil); rec.Code != http.StatusNotFound {
+				t.Errorf("got %d %s for another user, want 404", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// heldJobs is a job queue whose jobs wait until the test runs them.
+type heldJobs struct{}
+
+func (heldJobs) Enqueue(ctx context.Context, jobID string) error {
+	return nil
+}
+
+// routeCase is a request that succeeds on a route, with what it is answered with.
+type routeCase struct {
+	path   string
+	body   any
+	header []string
+	status int
+}
+
+// ownerRouteCases signs alice in on ts and gives her a chat with two exchanges, the second answered by a job,
+// its summary and a reply being generated in it, a template, a scrap in her default scrapbook and recipes, and a scrapbook desserts without it.
+// It returns her tokens and a request of hers succeeding on every route, by its method and path.
+func ownerRouteCases(t *testing.T, ts *testServer) (signInHandlerOutput, map[string]routeCase) {
+	t.Helper()
+	ts.fakeCredentials()
+	ts.s.UseEmbedder(embedding.NewFake())
+	ts.s.UseJobQueue(heldJobs{})
+	cred := credBody{Cred: credential.ProviderNaver, AccessToken: "alice"}
+	ts.must(http.StatusCreated, "", "POST", "/auth/cred/register", cred)
+	tokens := decode[signInHandlerOutput](t, ts.must(http.StatusOK, "", "POST", "/auth/cred/sign-in", cred))
+	alice := tokens.AccessToken
+	at, err := ts.a.VerifyAccessToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatID := ts.createChat(alice, "tea")
+	chat := "/me/chats/" + chatID
+	ts.postMessage(alice, chatID, "hello")
+	job := decode[internal.Job](t, ts.must(http.StatusAccepted, alice, "POST", chat+"/messages",
+		messageBody{Content: "green tea"}, "Prefer", "respond-async"))
+	if err := ts.s.RunJob(context.Background(), job.ID); err != nil {
+		t.Fatal(err)
+	}
+	// as if a worker was generating a reply in the chat
+	if err := ts.db.InsertGeneration(context.Background(), "generation", chatID, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	summary := internal.ChatSummary{ChatID: chatID, LastSeq: 2, Content: "alice said hello"}
+	if err := ts.db.InsertChatSummary(context.Background(), at.Subject, summary); err != nil {
+		t.Fatal(err)
+	}
+	template := decode[internal.PromptTemplate](t, ts.must(http.StatusCreated, alice, "POST", "/me/templates", templateBody{Name: "greet", Content: "hello"}))
+	recipes := ts.createScrapbook(alice, "recipes")
+	desserts := ts.createScrapbook(alice, "desserts")
+	scrap := ts.createScrap(alice, chatID, 2, "hi", ts.defaultScrapbook(alice), recipes)
+
+	return tokens, map[string]routeCase{
+		"GET /ping2":               {path: "/ping2", status: http.StatusOK},
+		"POST /auth/cred/register": {path: "/auth/cred/register", body: credBody{Cred: credential.ProviderNaver, AccessToken: "bob"}, status: http.StatusCreated},
+		"POST /auth/cred/sign-in":  {path: "/auth/cred/sign-in", body: cred, status: http.StatusOK},
+		"POST /auth/cred/logout":   {path: "/auth/cred/logout", status: http.StatusNoContent},
+		"POST /auth/token/refresh": {path: "/auth/token/refresh", header: []string{"X-Refresh-Token", tokens.RefreshToken}, status: http.StatusOK},
+		"DELETE /me":               {path: "/me", status: http.StatusNoContent},
+		"GET /me/usage":            {path: "/me/usage", status: http.StatusOK},
+		"GET /swagger/*any":        {path: "/swagger/doc.json", status: http.StatusOK},
+		// chat
+		"GET /me/chats":                         {path: "/me/chats", status: http.StatusOK},
+		"GET /me/chats/:chatID":                 {path: chat, status: http.StatusOK},
+		"POST /me/chats":                        {path: "/me/chats", body: chatBody{Name: "coffee"}, status: http.StatusCreated},
+		"PATCH /me/chats/:chatID":               {path: chat, body: chatBody{Name: "green tea"}, status: http.StatusNoContent},
+		"DELETE /me/chats/:chatID":              {path: chat, status: http.StatusNoContent},
+		"GET /me/chats/:chatID/summary":         {path: chat + "/summary", status: http.StatusOK},
+		"PUT /me/chats/:chatID/branch":          {path: chat + "/branch", body: branchBody{Seq: 2}, status: http.StatusNoContent},
+		"DELETE /me/chats/:chatID/generation":   {path: chat + "/generation", status: http.StatusNoContent},
+		"POST /me/chats/:chatID/title:generate": {path: chat + "/title:generate", status: http.StatusOK},
+		// message
+		"GET /me/chats/:chatID/messages":                  {path: chat + "/messages", status: http.StatusOK},
+		"POST /me/chats/:chatID/messages":                 {path: chat + "/messages", body: messageBody{Content: "bye"}, status: http.StatusCreated},
+		"GET /me/chats/:chatID/jobs/:jobID":               {path: chat + "/jobs/" + job.ID, status: http.StatusOK},
+		"PATCH /me/chats/:chatID/messages/:seq":           {path: chat + "/messages/2", body: patchMessageBody{Version: 1}, status: http.StatusNoContent},
+		"POST /me/chats/:chatID/messages/:seq/regenerate": {path: chat + "/messages/4/regenerate", status: http.StatusCreated},
+		"GET /me/chats/:chatID/messages/:seq/versions":    {path: chat + "/messages/2/versions", status: http.StatusOK},
+		"POST /me/chats/:chatID/messages/:seq/edit":       {path: chat + "/messages/3/edit", body: messageBody{Content: "black tea"}, status: http.StatusCreated},
+		// template
+		"GET /me/templates":                {path: "/me/templates", status: http.StatusOK},
+		"GET /me/templates/:templateID":    {path: "/me/templates/" + template.ID, status: http.StatusOK},
+		"POST /me/templates":               {path: "/me/templates", body: templateBody{Name: "bye", Content: "bye"}, status: http.StatusCreated},
+		"PATCH /me/templates/:templateID":  {path: "/me/templates/" + template.ID, body: templateBody{Name: "hi", Content: "hi"}, status: http.StatusNoContent},
+		"DELETE /me/templates/:templateID": {path: "/me/templates/" + template.ID, status: http.StatusNoContent},
+		// scrapbook
+		"GET /me/scrapbooks":                     {path: "/me/scrapbooks", status: http.StatusOK},
+		"GET /me/scrapbooks/:scrapbookID":        {path: "/me/scrapbooks/" + recipes, status: http.StatusOK},
+		"POST /me/scrapbooks":                    {path: "/me/scrapbooks", body: scrapbookBody{Name: "drinks"}, status: http.StatusCreated},
+		"DELETE /me/scrapbooks/:scrapbookID":     {path: "/me/scrapbooks/" + recipes, status: http.StatusNoContent},
+		"PATCH /me/scrapbooks/:scrapbookID":      {path: "/me/scrapbooks/" + recipes, body: scrapbookBody{Name: "drinks"}, status: http.StatusNoContent},
+		"GET /me/scrapbooks/:scrapbookID/scraps": {path: "/me/scrapbooks/" + recipes + "/scraps", status: http.StatusOK},
+		// scrap
+		"GET /me/scraps": {path: "/me/scraps", status: http.StatusOK},
+		"POST /me/scraps": {path: "/me/scraps", body: postScrapBody{ChatID: chatID, Seq: 4, Memo: "tea", ScrapbookIDs: []string{recipes}},
+			status: http.StatusCreated},
+		"PATCH /me/scraps/:scrapID":                          {path: "/me/scraps/" + scrap.ID, body: patchScrapBody{Memo: "hello"}, status: http.StatusNoContent},
+		"DELETE /me/scraps/:scrapID":                         {path: "/me/scraps/" + scrap.ID, status: http.StatusNoContent},
+		"GET /me/scraps/:scrapID/scrapbooks":                 {path: "/me/scraps/" + scrap.ID + "/scrapbooks", status: http.StatusOK},
+		"POST /me/scraps/:scrapID/scrapbooks/:scrapbookID":   {path: "/me/scraps/" + scrap.ID + "/scrapbooks/" + desserts, status: http.StatusCreated},
+		"DELETE /me/scraps/:scrapID/scrapbooks/:scrapbookID": {path: "/me/scraps/" + scrap.ID + "/scrapbooks/" + recipes, status: http.StatusNoContent},
+		// search
+		"GET /me/search":          {path: "/me/search?q=tea", status: http.StatusOK},
+		"GET /me/search/semantic": {path: "/me/search/semantic?q=tea", status: http.StatusOK},
+	}
+}
+
+func TestRoutesOfOwners(t *testing.T) {
+	for _, route := range newTestServer(t).router.Routes() {
+		key := route.Method + " " + route.Path
+		t.Run(key, func(t *testing.T) {
+			// every request starts over, so the ones deleting don't take away what the others need
+			ts := newTestServer(t)
+			tokens, cases := ownerRouteCases(t, ts)
+			c, ok := cases[key]
+			if !ok {
+				t.Fatal("no request in ownerRouteCases")
+			}
+			rec := ts.do(tokens.AccessToken, route.Method, c.path, c.body, c.header...)
+			if rec.Code != c.status {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, c.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+var errNotEditable = apperror.New(apperror.CodeMessageNotEditable)
+
+// handleEditMyMessage godoc
+// @summary Edit my message
+// @description Ask the user message at seq again with new content, and get response when chatbot finishes processing.
+// @description The edited message starts a new branch next to the original one, with the same history before it,
+// @description and the new branch becomes the active one. The original branch is kept and can be checked out again.
+// @description The body is as in posting a message, content or a prompt template with variables.
+// @description With `Accept: text/event-stream` the response is streamed as in posting a message.
+// @tags messages
+// @security AccessTokenAuth
+// @produce json
+// @produce text/event-stream
+// @param chatID path string true "chatID"
+// @param seq path int true "seq of the user message"
+// @param Accept header string false "text/event-stream to stream the reply"
+// @param body body messageBody true "body"
+// @success 200 {object} deltaEvent "text/event-stream"
+// @success 201 {object} replyResponse
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 409 {object} errorResponse
+// @failure 422 {object} moderationErrorResponse
+// @failure 429 {object} quotaExceededResponse
+// @failure 500 {object} errorResponse
+// @failure 503 {object} errorResponse
+// @header 503 {integer} Retry-After "seconds to wait before retrying"
+// @router /me/chats/{chatID}/messages/{seq}/edit [post]
+func (s *Server) handleEditMyMessage(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+	seq, err := strconv.Atoi(ctx.Param("seq"))
+	if err != nil {
+		golog.Error("handleEditMyMessage: parse seq: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+	var body messageBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		golog.Error("handleEditMyMessage: bind json: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	chat, err := s.db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		golog.Error("handleEditMyMessage: select chat: ", err)
+		respondError(ctx, err)
+		return
+	}
+	branch, err := s.db.SelectMessagePath(ctx, userID, chatID, seq)
+	if err != nil {
+		golog.Error("handleEditMyMessage: select message path: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if len(branch) == 0 {
+		golog.Error("handleEditMyMessage: ", errMessageNotFound)
+		respondError(ctx, errMessageNotFound)
+		return
+	}
+	if branch[0].Role != chatbot.GetUserMessageRole() {
+		golog.Error("handleEditMyMessage: ", errNotEditable)
+		respondError(ctx, errNotEditable)
+		return
+	}
+
+	if !s.ensureNoUnfinishedJob(ctx, chatID) {
+		return
+	}
+	if !s.enforceQuota(ctx, userID) {
+		return
+	}
+	content, ok := s.renderMessage(ctx, userID, body)
+	if !ok {
+		return
+	}
+	if !s.moderateInput(ctx, userID, chatID, content) {
+		return
+	}
+	// the edited message goes under the same parent as the original
+	chat.HeadSeq = branch[0].ParentSeq
+	conv, err := s.loadConversation(ctx, userID, chat, content)
+	if err != nil {
+		golog.Error("handleEditMyMessage: load conversation: ", err)
+		respondChatbotError(ctx, err)
+		return
+	}
+	if wantsEventStream(ctx) {
+		s.streamMyMessage(ctx, userID, conv, content, body.TemplateID)
+		return
+	}
+	inMsg, outMsgs, err := s.c.SendChat(ctx, conv, content)
+	if err != nil {
+		golog.Error("handleEditMyMessage: send chat: ", err)
+		respondChatbotError(ctx, err)
+		return
+	}
+	inMsg.TemplateID = body.TemplateID
+	verdicts := s.moderateOutput(ctx, apperror.Lang(ctx.GetHeader("Accept-Language")), outMsgs...)
+	if err := s.insertMessages(ctx, userID, inMsg, outMsgs...); err != nil {
+		golog.Error("handleEditMyMessage: insert messages: ", err)
+		respondError(ctx, err)
+		return
+	}
+	s.auditOutput(ctx, userID, verdicts)
+	outMsg := outMsgs[len(outMsgs)-1]
+
+	ctx.JSON(http.StatusCreated, newReplyResponse(outMsg))
+}
+
+type branchBody struct {
+	Seq int `json:"seq" binding:"required,min=1" example:"3"`
+}
+
+// handleCheckoutMyBranch godoc
+// @summary Checkout a branch of my chat
+// @description Make the branch through the message at seq the active one.
+// @description Its newest message becomes the head of the chat, which new messages follow.
+// @tags chats
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @param body body branchBody true "body"
+// @success 204
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/chats/{chatID}/branch [put]
+func (s *Server) handleCheckoutMyBranch(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+	var body branchBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		golog.Error("handleCheckoutMyBranch: bind json: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	if err := s.db.CheckoutBranch(ctx, userID, chatID, body.Seq); err != nil {
+		golog.Error("handleCheckoutMyBranch: checkout branch: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
@@ -1,17 +1,58 @@
 package server
 
 import (
-	"database/sql"
 	"net/http"
 
 	"github.com/evergarden0412/gptea-api/internal"
-	"github.com/evergarden0412/gptea-api/internal/postgres"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
 	"github.com/gin-gonic/gin"
 	"github.com/kataras/golog"
 )
 
 type chatBody struct {
 	Name string `json:"name"`
+
+	// generation settings, left unchanged when omitted
+	Model            *string  `json:"model" example:"gpt-3.5-turbo-0613"`
+	Temperature      *float32 `json:"temperature" example:"1"`
+	TopP             *float32 `json:"topP" example:"1"`
+	MaxTokens        *int     `json:"maxTokens" example:"1000"`
+	PresencePenalty  *float32 `json:"presencePenalty" example:"0"`
+	FrequencyPenalty *float32 `json:"frequencyPenalty" example:"0"`
+	SystemPrompt     *string  `json:"systemPrompt" example:"You are a kind tutor."`
+	UseScraps        *bool    `json:"useScraps" example:"true"`
+}
+
+// applyTo sets the fields given in the body on chat.
+func (b chatBody) applyTo(chat *internal.Chat) {
+	if b.Name != "" {
+		chat.Name = b.Name
+	}
+	if b.Model != nil {
+		chat.Model = *b.Model
+	}
+	if b.Temperature != nil {
+		chat.Temperature = *b.Temperature
+	}
+	if b.TopP != nil {
+		chat.TopP = *b.TopP
+	}
+	if b.MaxTokens != nil {
+		chat.MaxTokens = *b.MaxTokens
+	}
+	if b.PresencePenalty != nil {
+		chat.PresencePenalty = *b.PresencePenalty
+	}
+	if b.FrequencyPenalty != nil {
+		chat.FrequencyPenalty = *b.FrequencyPenalty
+	}
+	if b.SystemPrompt != nil {
+		chat.SystemPrompt = *b.SystemPrompt
+	}
+	if b.UseScraps != nil {
+		chat.UseScraps = *b.UseScraps
+	}
 }
 
 // handlePostMyChat godoc
@@ -19,30 +60,37 @@ type chatBody struct {
 // @description Post my chat
 // @tags chats
 // @security AccessTokenAuth
+// @param Idempotency-Key header string false "unique per request, a retry with it gets the first response back"
 // @param body body chatBody true "body"
 // @success 201 {object} messageResponse
 // @failure 400 {object} errorResponse
+// @failure 409 {object} errorResponse
 // @failure 500 {object} errorResponse
 // @router /me/chats [post]
 func (s *Server) handlePostMyChat(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
 	var body chatBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		golog.Error("handlePostMyChat: bind json: ", err)
 		return
 	}
 
 	chat, err := internal.NewChat()
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handlePostMyChat: new chat: ", err)
 		return
 	}
-	chat.Name = body.Name
+	body.applyTo(chat)
+	if err := chatbot.ValidateSettings(*chat); err != nil {
+		respondError(ctx, apperror.Invalid(err))
+		golog.Error("handlePostMyChat: validate settings: ", err)
+		return
+	}
 
 	if err := s.db.InsertChat(ctx, userID, *chat); err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		golog.Error("handlePostMyChat: insert chat: ", err)
 		return
 	}
@@ -52,13 +100,17 @@ func (s *Server) handlePostMyChat(ctx *gin.Context) {
 
 type chatsResponse struct {
 	Chats []internal.Chat `json:"chats"`
+	pageResponse
 }
 
 // handleGetMyChats godoc
 // @summary Get my chats
-// @description Get my chats in descending order of created_at
+// @description Get a page of my chats in descending order of created_at
 // @tags chats
 // @security AccessTokenAuth
+// @param limit query int false "max items, 50 by default and at most 100"
+// @param cursor query string false "nextCursor or prevCursor of the previous page"
+// @param direction query string false "next (default) or prev, the way of the cursor"
 // @success 200 {object} chatsResponse
 // @failure 400 {object} errorResponse
 // @failure 401 {object} errorResponse
@@ -66,17 +118,21 @@ type chatsResponse struct {
 // @router /me/chats [get]
 func (s *Server) handleGetMyChats(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
+	page, ok := pageParams(ctx, "handleGetMyChats")
+	if !ok {
+		return
+	}
 
-	chats, err := s.db.SelectMyChats(ctx, userID)
+	chats, cursors, err := s.db.SelectMyChats(ctx, userID, page)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
 		golog.Error("handleGetMyChats: select chats: ", err)
+		respondError(ctx, err)
 		return
 	}
 	chatsForResp := make([]internal.Chat, len(chats))
 	copy(chatsForResp, chats)
 
-	ctx.JSON(http.StatusOK, chatsResponse{Chats: chatsForResp})
+	ctx.JSON(http.StatusOK, chatsResponse{Chats: chatsForResp, pageResponse: newPageResponse(cursors)})
 }
 
 // handleGetMyChat godoc
@@ -84,7 +140,7 @@ func (s *Server) handleGetMyChats(ctx *gin.Context) {
 // @description Get my chat
 // @tags chats
 // @security AccessTokenAuth
-// @success 200 {object} internal.Chat 
+// @success 200 {object} internal.Chat
 // @failure 400 {object} errorResponse
 // @failure 401 {object} errorResponse
 // @failure 404 {object} errorResponse
@@ -95,22 +151,19 @@ func (s *Server) handleGetMyChat(ctx *gin.Context) {
 	chatID := ctx.Param("chatID")
 
 	chat, err := s.db.SelectMyChat(ctx, userID, chatID)
-	if err == sql.ErrNoRows {
-		ctx.JSON(http.StatusNotFound, errorResponse{Error: err.Error()})
+	if err != nil {
+		respondError(ctx, err)
 		golog.Error("handleGetMyChat: select chat: ", err)
 		return
 	}
-	if err != nil { 
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
-		golog.Error("handleGetMyChats: select chats: ", err)
-		return
-	}
 
 	ctx.JSON(http.StatusOK, chat)
 }
+
 // handlePatchMyChat godoc
 // @summary Patch my chat
-// @description Patch my chat name
+// @description Patch my chat name, generation settings and system prompt.
+// @description With useScraps, replies are grounded in my scraps most relevant to each message and cite them.
 // @tags chats
 // @security AccessTokenAuth
 // @param chatID path string true "chatID"
@@ -118,6 +171,7 @@ func (s *Server) handleGetMyChat(ctx *gin.Context) {
 // @success 204
 // @failure 400 {object} errorResponse
 // @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
 // @failure 500 {object} errorResponse
 // @router /me/chats/{chatID} [patch]
 func (s *Server) handlePatchMyChat(ctx *gin.Context) {
@@ -126,21 +180,26 @@ func (s *Server) handlePatchMyChat(ctx *gin.Context) {
 	var body chatBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
 		golog.Error("handlePatchMyChat: bind json: ", err)
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	chat, err := s.db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		golog.Error("handlePatchMyChat: select chat: ", err)
+		respondError(ctx, err)
+		return
+	}
+	body.applyTo(&chat)
+	if err := chatbot.ValidateSettings(chat); err != nil {
+		golog.Error("handlePatchMyChat: validate settings: ", err)
+		respondError(ctx, apperror.Invalid(err))
 		return
 	}
 
-	if err := s.db.PatchChat(ctx, userID, internal.Chat{
-		ID:   chatID,
-		Name: body.Name,
-	}); err != nil {
+	if err := s.db.PatchChat(ctx, userID, chat); err != nil {
 		golog.Error("handlePatchMyChat: update chat: ", err)
-		switch err {
-		case postgres.ErrUnauthorized:
-			ctx.JSON(http.StatusUnauthorized, errorResponse{Error: err.Error()})
-		default:
-			ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
-		}
+		respondError(ctx, err)
 		return
 	}
 
@@ -164,12 +223,7 @@ func (s *Server) handleDeleteMyChat(ctx *gin.Context) {
 
 	if err := s.db.DeleteChat(ctx, userID, chatID); err != nil {
 		golog.Error("handleDeleteMyChat: delete chat: ", err)
-		switch err {
-		case postgres.ErrUnauthorized:
-			ctx.JSON(http.StatusUnauthorized, errorResponse{Error: err.Error()})
-		default:
-			ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
-		}
+		respondError(ctx, err)
 		return
 	}
 
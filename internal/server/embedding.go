@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+	"github.com/kataras/golog"
+)
+
+// embedTimeout bounds embedding what was just saved
+const embedTimeout = 5 * time.Second
+
+// UseEmbedder embeds messages and scraps as they are saved, so that they can be searched by meaning.
+// Without an embedder, semantic search is unavailable.
+func (s *Server) UseEmbedder(e embedding.Embedder) {
+	s.embedder = e
+}
+
+// embedMessages saves the embeddings of msgs, which have to be saved already.
+// A message left without one is only missing from semantic search until the backfill, so failing is just logged.
+func (s *Server) embedMessages(ctx context.Context, msgs ...*internal.Message) {
+	if s.embedder == nil {
+		return
+	}
+	var texts []string
+	var embedded []*internal.Message
+	for _, msg := range msgs {
+		if text := embedding.MessageText(*msg); text != "" {
+			texts = append(texts, text)
+			embedded = append(embedded, msg)
+		}
+	}
+	if len(texts) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, embedTimeout)
+	defer cancel()
+	vectors, err := s.embedder.Embed(ctx, texts)
+	if err != nil {
+		golog.Error("embedMessages: embed: ", err)
+		return
+	}
+	for i, msg := range embedded {
+		if err := s.db.UpsertMessageEmbedding(ctx, msg.ChatID, msg.Seq, s.embedder.Model(), vectors[i]); err != nil {
+			golog.Error("embedMessages: upsert message embedding: ", err)
+			return
+		}
+	}
+}
+
+// embedMessage embeds the message at seq again, its content having changed.
+func (s *Server) embedMessage(ctx context.Context, userID, chatID string, seq int) {
+	if s.embedder == nil {
+		return
+	}
+	path, err := s.db.SelectMessagePath(ctx, userID, chatID, seq)
+	if err != nil {
+		golog.Error("embedMessage: select message path: ", err)
+		return
+	}
+	if len(path) == 0 {
+		return
+	}
+	msg := internal.Message{ChatID: chatID, Seq: seq, Content: path[0].Content, Role: path[0].Role}
+	s.embedMessages(ctx, &msg)
+}
+
+// embedScrap saves the embedding of the scrap, from its memo and the scrapped message. Failing is just logged.
+func (s *Server) embedScrap(ctx context.Context, userID, scrapID string) {
+	if s.embedder == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, embedTimeout)
+	defer cancel()
+	scrap, err := s.db.SelectMyScrap(ctx, userID, scrapID)
+	if err != nil {
+		golog.Error("embedScrap: select scrap: ", err)
+		return
+	}
+	vectors, err := s.embedder.Embed(ctx, []string{embedding.ScrapText(scrap)})
+	if err != nil {
+		golog.Error("embedScrap: embed: ", err)
+		return
+	}
+	if err := s.db.UpsertScrapEmbedding(ctx, scrap.ID, s.embedder.Model(), vectors[0]); err != nil {
+		golog.Error("embedScrap: upsert scrap embedding: ", err)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// cancelPollInterval is how often a generation checks whether it was cancelled from another process.
+// One cancelled in the same process stops right away.
+const cancelPollInterval = time.Second
+
+// finishReasonCancelled marks a reply cut off because the user cancelled it.
+const finishReasonCancelled = "cancelled"
+
+var errGenerationCancelled = apperror.New(apperror.CodeGenerationCancelled)
+
+type localGeneration struct {
+	chatID string
+	cancel context.CancelCauseFunc
+}
+
+// trackGeneration returns ctx for generating a reply in the chat, which handleCancelMyGeneration cancels
+// with errGenerationCancelled. done has to be called once generation is over.
+// Generation goes on untracked if it can't be tracked, it just can't be cancelled then.
+func (s *Server) trackGeneration(ctx context.Context, chatID string) (genCtx context.Context, done func()) {
+	genCtx, cancel := context.WithCancelCause(ctx)
+	id, err := internal.NewID()
+	if err == nil {
+		err = s.db.InsertGeneration(ctx, id, chatID, time.Now().UTC())
+	}
+	if err != nil {
+		golog.Error("trackGeneration: insert generation: ", err)
+		return genCtx, func() { cancel(nil) }
+	}
+	s.generations.Store(id, localGeneration{chatID: chatID, cancel: cancel})
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cancelPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-genCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			cancelled, err := s.db.SelectGenerationCancelled(genCtx, id)
+			if err != nil {
+				if genCtx.Err() == nil {
+					golog.Error("trackGeneration: select generation cancelled: ", err)
+				}
+				continue
+			}
+			if cancelled {
+				cancel(errGenerationCancelled)
+				return
+			}
+		}
+	}()
+
+	return genCtx, func() {
+		close(stop)
+		s.generations.Delete(id)
+		cancel(nil)
+		finishCtx, cancelFinish := context.WithTimeout(context.Background(), persistTimeout)
+		defer cancelFinish()
+		if err := s.db.FinishGeneration(finishCtx, id); err != nil {
+			golog.Error("trackGeneration: finish generation: ", err)
+		}
+	}
+}
+
+// generationCancelled reports whether genCtx of trackGeneration was cancelled by the user.
+func generationCancelled(genCtx context.Context) bool {
+	return errors.Is(context.Cause(genCtx), errGenerationCancelled)
+}
+
+// markCancelled marks the reply cut off at the end of out, generated for in, as cancelled.
+// A tool call cut off is dropped by the chatbot, so out may end with a tool result instead, or be empty
+// if nothing came yet. An empty reply is added then, so that the turn still ends with one.
+func markCancelled(in *internal.Message, out []*internal.Message) []*internal.Message {
+	if len(out) > 0 && out[len(out)-1].Role == chatbot.GetAssistantMessageRole() {
+		out[len(out)-1].FinishReason = finishReasonCancelled
+		return out
+	}
+	last := in
+	if len(out) > 0 {
+		last = out[len(out)-1]
+	}
+	return append(out, &internal.Message{
+		ChatID:     last.ChatID,
+		Seq:        last.Seq + 1,
+		ParentSeq:  last.Seq,
+		Role:       chatbot.GetAssistantMessageRole(),
+		CreatedAt:  time.Now().UTC(),
+		Generation: internal.Generation{FinishReason: finishReasonCancelled},
+	})
+}
+
+// handleCancelMyGeneration godoc
+// @summary Cancel my generation
+// @description Stop the reply being streamed or generated in the background in my chat.
+// @description What was generated so far is saved with finishReason `cancelled`.
+// @description Replies generated within the request, without streaming, can't be cancelled.
+// @tags messages
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @success 204
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/chats/{chatID}/generation [delete]
+func (s *Server) handleCancelMyGeneration(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+
+	// generations can't outlast a job, older ones are left over from a worker that died
+	if err := s.db.CancelGenerations(ctx, userID, chatID, time.Now().UTC().Add(-jobTimeout)); err != nil {
+		golog.Error("handleCancelMyGeneration: cancel generations: ", err)
+		respondError(ctx, err)
+		return
+	}
+	// the ones running in this process needn't wait for their next poll
+	s.generations.Range(func(_, value any) bool {
+		if generation := value.(localGeneration); generation.chatID == chatID {
+			generation.cancel(errGenerationCancelled)
+		}
+		return true
+	})
+
+	ctx.Status(http.StatusNoContent)
+}
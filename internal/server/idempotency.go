@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	// defaultIdempotencyKeyTTL is how long a response is kept for retries with its Idempotency-Key, see SetIdempotencyKeyTTL
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+	// idempotentRequestTimeout is how long a request may run before a retry with its key runs it again,
+	// the process running it having died. Replies can be streamed for that long.
+	idempotentRequestTimeout = jobTimeout
+	maxIdempotencyKeyLength  = 255
+)
+
+var (
+	errIdempotencyKeyTooLong    = apperror.New(apperror.CodeIdempotencyKeyTooLong)
+	errIdempotencyKeyReused     = apperror.New(apperror.CodeIdempotencyKeyReused)
+	errIdempotentRequestRunning = apperror.New(apperror.CodeIdempotentRequestRunning)
+)
+
+// SetIdempotencyKeyTTL sets how long a response is kept for retries with its Idempotency-Key.
+func (s *Server) SetIdempotencyKeyTTL(ttl time.Duration) {
+	s.idempotencyKeyTTL = ttl
+}
+
+// idempotencyRecorder keeps a copy of the response it writes.
+type idempotencyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes a request with an Idempotency-Key header run once: a retry with the same key gets the
+// response of the first request back, with Idempotent-Replayed: true. A retry while the first is running,
+// or with the same key for another request, gets 409. Only successful responses are kept, a request that
+// failed runs again, streamed ones included, which fail after their 200 with an "error" event.
+// Requests without the header run as usual.
+func (s *Server) idempotent(ctx *gin.Context) {
+	key := ctx.GetHeader("Idempotency-Key")
+	if key == "" {
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		golog.Error("idempotent: ", errIdempotencyKeyTooLong)
+		respondError(ctx, errIdempotencyKeyTooLong)
+		return
+	}
+	userID := ctx.GetString("userID")
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		golog.Error("idempotent: read body: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.New()
+	hash.Write([]byte(ctx.Request.Method + " " + ctx.Request.URL.Path + "\n"))
+	hash.Write(body)
+
+	ttl := s.idempotencyKeyTTL
+	if ttl == 0 {
+		ttl = defaultIdempotencyKeyTTL
+	}
+	now := time.Now().UTC()
+	req := internal.IdempotentRequest{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	prev, claimed, err := s.db.ClaimIdempotentRequest(ctx, req, now.Add(-idempotentRequestTimeout))
+	if err != nil {
+		golog.Error("idempotent: claim idempotent request: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if !claimed {
+		switch {
+		case prev.RequestHash != req.RequestHash:
+			golog.Error("idempotent: ", errIdempotencyKeyReused)
+			respondError(ctx, errIdempotencyKeyReused)
+		case prev.Status == internal.IdempotentRequestRunning:
+			golog.Error("idempotent: ", errIdempotentRequestRunning)
+			respondError(ctx, errIdempotentRequestRunning)
+		default:
+			if prev.ResponseLocation != "" {
+				ctx.Header("Location", prev.ResponseLocation)
+			}
+			ctx.Header("Idempotent-Replayed", "true")
+			ctx.Data(prev.ResponseStatus, prev.ResponseContentType, prev.ResponseBody)
+			ctx.Abort()
+		}
+		return
+	}
+
+	recorder := &idempotencyRecorder{ResponseWriter: ctx.Writer}
+	ctx.Writer = recorder
+	ctx.Next()
+
+	// the client may be gone, which is when the response is needed most
+	persistCtx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	status := recorder.Status()
+	if status < http.StatusOK || status >= http.StatusMultipleChoices || ctx.GetBool(contextKeyStreamFailed) {
+		if err := s.db.ReleaseIdempotentRequest(persistCtx, userID, key); err != nil {
+			golog.Error("idempotent: release idempotent request: ", err)
+		}
+		return
+	}
+	req.ResponseStatus = status
+	req.ResponseContentType = recorder.Header().Get("Content-Type")
+	req.ResponseLocation = recorder.Header().Get("Location")
+	req.ResponseBody = recorder.body.Bytes()
+	if err := s.db.FinishIdempotentRequest(persistCtx, req); err != nil {
+		golog.Error("idempotent: finish idempotent request: ", err)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	ts.bot.Script("first", "second")
+	path := "/me/chats/" + chatID + "/messages"
+
+	first := ts.must(http.StatusCreated, alice, "POST", path, messageBody{Content: "hello"}, "Idempotency-Key", "k1")
+	replay := ts.must(http.StatusCreated, alice, "POST", path, messageBody{Content: "hello"}, "Idempotency-Key", "k1")
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry isn't marked Idempotent-Replayed")
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("first request is marked Idempotent-Replayed")
+	}
+	if replay.Body.String() != first.Body.String() {
+		t.Errorf("retry got %s, want the response of the first request %s", replay.Body, first.Body)
+	}
+	if msgs := decode[messagesResponse](t, ts.must(http.StatusOK, alice, "GET", path, nil)).Messages; len(msgs) != 2 {
+		t.Errorf("chat has %d messages after a retry, want the 2 of one turn", len(msgs))
+	}
+
+	rec := ts.must(http.StatusConflict, alice, "POST", path, messageBody{Content: "bye"}, "Idempotency-Key", "k1")
+	if code := decode[errorResponse](t, rec).Code; code != apperror.CodeIdempotencyKeyReused {
+		t.Errorf("got %s, want %s", code, apperror.CodeIdempotencyKeyReused)
+	}
+	if reply := ts.postMessage(alice, chatID, "bye"); reply != "second" {
+		t.Errorf("reply without a key is %q, want a new one", reply)
+	}
+}
+
+func TestIdempotentStreamFailed(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	path := "/me/chats/" + chatID + "/messages"
+	header := []string{"Idempotency-Key", "k1", "Accept", "text/event-stream"}
+
+	// the stream breaks after 200 went out with its first delta
+	ts.sent.failStreams(errors.New("connection reset"))
+	failed := ts.must(http.StatusOK, alice, "POST", path, messageBody{Content: "hello"}, header...)
+	sseData(t, failed.Body.String(), "error")
+
+	ts.sent.failStreams(nil)
+	retry := ts.must(http.StatusOK, alice, "POST", path, messageBody{Content: "hello"}, header...)
+	if retry.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry got the failed stream replayed: %s", retry.Body)
+	}
+	sseData(t, retry.Body.String(), "done")
+
+	replay := ts.must(http.StatusOK, alice, "POST", path, messageBody{Content: "hello"}, header...)
+	if replay.Header().Get("Idempotent-Replayed") != "true" || !strings.Contains(replay.Body.String(), "event:done") {
+		t.Errorf("retry after the stream succeeded got %s, want it replayed", replay.Body)
+	}
+}
+
+func TestIdempotencyKeyOfOthers(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := ts.register("alice"), ts.register("bob")
+
+	ts.must(http.StatusCreated, alice, "POST", "/me/scrapbooks", scrapbookBody{Name: "recipes"}, "Idempotency-Key", "k1")
+	rec := ts.must(http.StatusCreated, bob, "POST", "/me/scrapbooks", scrapbookBody{Name: "recipes"}, "Idempotency-Key", "k1")
+	if rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("bob got the response of alice replayed")
+	}
+	if scrapbooks := decode[scrapbooksResponse](t, ts.must(http.StatusOK, bob, "GET", "/me/scrapbooks", nil)).Scrapbooks; len(scrapbooks) != 2 {
+		t.Errorf("bob has %d scrapbooks, want the default and recipes", len(scrapbooks))
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/evergarden0412/gptea-api/internal/jobs"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// jobTimeout bounds generating a reply in the background, it has to be shorter than the timeout of the worker.
+// A job not finished after that is taken for failed, its worker having died with it.
+const jobTimeout = 4 * time.Minute
+
+var errJobUnfinished = apperror.New(apperror.CodeChatBusy)
+
+// UseJobQueue lets posted messages be answered in the background by the worker of q, see RunJob.
+func (s *Server) UseJobQueue(q jobs.Queue) {
+	s.jobs = q
+}
+
+// wantsAsync reports whether the client prefers the reply to be generated in the background.
+// The preference is ignored without a job queue.
+func (s *Server) wantsAsync(ctx *gin.Context) bool {
+	return s.jobs != nil && strings.Contains(ctx.GetHeader("Prefer"), "respond-async")
+}
+
+// ensureNoUnfinishedJob responds with 409 and reports false if the chat is still answering in the background.
+// A message added meanwhile would be answered without the reply, which would then go on another branch.
+func (s *Server) ensureNoUnfinishedJob(ctx *gin.Context, chatID string) bool {
+	job, err := s.db.SelectUnfinishedJob(ctx, chatID, time.Now().UTC().Add(-jobTimeout))
+	switch err {
+	case nil:
+		golog.Error("ensureNoUnfinishedJob: ", errJobUnfinished, " ", job.ID)
+		respondError(ctx, errJobUnfinished)
+		return false
+	case sql.ErrNoRows:
+		return true
+	default:
+		golog.Error("ensureNoUnfinishedJob: select unfinished job: ", err)
+		respondError(ctx, err)
+		return false
+	}
+}
+
+// postMyMessageAsync saves the message with a job answering it and responds with 202 and the job.
+func (s *Server) postMyMessageAsync(ctx *gin.Context, userID string, chat internal.Chat, content, templateID string) {
+	lastSeq, err := s.db.SelectLastSeq(ctx, userID, chat.ID)
+	if err != nil {
+		golog.Error("handlePostMyMessage: select last seq: ", err)
+		respondError(ctx, err)
+		return
+	}
+	inMsg := chatbot.NewUserMessage(chatbot.Conversation{Chat: chat, LastSeq: lastSeq}, content)
+	inMsg.TemplateID = templateID
+	job, err := internal.NewJob(userID, chat.ID, inMsg.Seq)
+	if err != nil {
+		golog.Error("handlePostMyMessage: new job: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if err := s.db.InsertMessageWithJob(ctx, userID, inMsg, job); err != nil {
+		golog.Error("handlePostMyMessage: insert message with job: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if err := s.jobs.Enqueue(ctx, job.ID); err != nil {
+		golog.Error("handlePostMyMessage: enqueue job: ", err)
+		if err := s.db.FailJob(ctx, job.ID, string(apperror.CodeUnavailable)); err != nil {
+			golog.Error("handlePostMyMessage: fail job: ", err)
+		}
+		respondError(ctx, apperror.Wrap(apperror.CodeUnavailable, err))
+		return
+	}
+
+	ctx.Header("Location", "/me/chats/"+chat.ID+"/jobs/"+job.ID)
+	ctx.JSON(http.StatusAccepted, job)
+}
+
+// RunJob answers the message of the job and records the outcome on it.
+// It is called by the worker the job queue delivers to, and does nothing if the job was started already.
+func (s *Server) RunJob(ctx context.Context, jobID string) error {
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout)
+	defer cancel()
+	job, err := s.db.SelectJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	started, err := s.db.StartJob(ctx, jobID)
+	if err != nil || !started {
+		return err
+	}
+	replySeq, runErr := s.runJob(ctx, job)
+
+	// the job may have run out of time, the outcome is still recorded
+	persistCtx, cancelPersist := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancelPersist()
+	if runErr != nil {
+		golog.Error("RunJob: ", runErr)
+		return s.db.FailJob(persistCtx, jobID, string(apperror.CodeOf(chatbotError(runErr))))
+	}
+	return s.db.FinishJob(persistCtx, jobID, replySeq)
+}
+
+func (s *Server) runJob(ctx context.Context, job internal.Job) (int, error) {
+	chat, err := s.db.SelectMyChat(ctx, job.UserID, job.ChatID)
+	if err != nil {
+		return 0, err
+	}
+	branch, err := s.db.SelectMessagePath(ctx, job.UserID, job.ChatID, job.Seq)
+	if err != nil {
+		return 0, err
+	}
+	if len(branch) == 0 {
+		return 0, errMessageNotFound
+	}
+	prompt := branch[0]
+	inMsg := &internal.Message{
+		ChatID:     prompt.ChatID,
+		Seq:        prompt.Seq,
+		ParentSeq:  prompt.ParentSeq,
+		Content:    prompt.Content,
+		Role:       prompt.Role,
+		TemplateID: prompt.TemplateID,
+		CreatedAt:  prompt.CreatedAt,
+	}
+	// the conversation ends right before the message, which is saved already
+	chat.HeadSeq = inMsg.ParentSeq
+	conv, err := s.loadConversation(ctx, job.UserID, chat, inMsg.Content)
+	if err != nil {
+		return 0, err
+	}
+	genCtx, done := s.trackGeneration(ctx, job.ChatID)
+	outMsgs, err := s.c.Answer(genCtx, conv, inMsg)
+	cancelled := generationCancelled(genCtx)
+	done()
+	if cancelled {
+		// the user stopped the reply, what there is of it is kept as the reply
+		outMsgs = markCancelled(inMsg, outMsgs)
+	} else if err != nil {
+		return 0, err
+	}
+	// nobody asked in a language, the client polls for the reply later
+	verdicts := s.moderateOutput(ctx, apperror.LangEnglish, outMsgs...)
+	if err := s.db.AppendTurn(ctx, job.UserID, outMsgs...); err != nil {
+		return 0, err
+	}
+	s.auditOutput(ctx, job.UserID, verdicts)
+	s.embedMessages(ctx, append([]*internal.Message{inMsg}, outMsgs...)...)
+	outMsg := outMsgs[len(outMsgs)-1]
+	// nobody waits on the worker but the polling client, which gets the name with the reply
+	s.autoTitle(ctx, job.UserID, chat, inMsg, outMsg)
+	return outMsg.Seq, nil
+}
+
+// handleGetMyJob godoc
+// @summary Get my job
+// @description Get the job answering a message posted with `Prefer: respond-async`.
+// @description Once its status is `done`, the reply is the message at replySeq. A `failed` job has the code of the reason in error.
+// @tags messages
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @param jobID path string true "jobID"
+// @success 200 {object} internal.Job
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/chats/{chatID}/jobs/{jobID} [get]
+func (s *Server) handleGetMyJob(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+	jobID := ctx.Param("jobID")
+
+	job, err := s.db.SelectMyJob(ctx, userID, chatID, jobID)
+	if err != nil {
+		golog.Error("handleGetMyJob: select job: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if !job.Finished() && time.Since(job.UpdatedAt) > jobTimeout {
+		// the worker died without recording the outcome
+		if err := s.db.FailJob(ctx, job.ID, string(apperror.CodeJobTimedOut)); err != nil {
+			golog.Error("handleGetMyJob: fail job: ", err)
+			respondError(ctx, err)
+			return
+		}
+		job.Status = internal.JobStatusFailed
+		job.Error = string(apperror.CodeJobTimedOut)
+	}
+
+	ctx.JSON(http.StatusOK, job)
+}
@@ -1,9 +1,9 @@
 package server
 
 import (
-	"net/http"
 	"strings"
 
+	"github.com/evergarden0412/gptea-api/internal/apperror"
 	"github.com/gin-gonic/gin"
 	"github.com/kataras/golog"
 )
@@ -21,25 +21,25 @@ func (s *Server) ensureUser(ctx *gin.Context) {
 	var header tokenHeader
 	if err := ctx.ShouldBindHeader(&header); err != nil {
 		golog.Error("ensureUser: bind header:", err)
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		return
 	}
 	atStr, found := strings.CutPrefix(header.Authorization, "Bearer ")
 	if !found {
 		golog.Error("ensureUser: cut prefix: not found")
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse{Error: "no bearer prefix"})
+		respondError(ctx, apperror.New(apperror.CodeTokenMissing))
 		return
 	}
 	if atStr == "" {
 		golog.Error("ensureUser: no access token")
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse{Error: "no access token"})
+		respondError(ctx, apperror.New(apperror.CodeTokenMissing))
 		return
 	}
 
 	at, err := s.a.VerifyAccessToken(atStr)
 	if err != nil {
 		golog.Error("ensureUser: verify access token:", err)
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Wrap(apperror.CodeTokenInvalid, err))
 		return
 	}
 
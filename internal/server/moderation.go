@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/evergarden0412/gptea-api/internal/moderation"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+type moderationErrorResponse struct {
+	errorResponse
+	Categories []string `json:"categories" example:"profanity"`
+}
+
+// moderateInput responds with 422 if content, sent by the user to the chat, is flagged, and reports whether to go on.
+// Moderation failing lets the content through, a moderation outage shouldn't take the chats down.
+func (s *Server) moderateInput(ctx *gin.Context, userID, chatID, content string) bool {
+	if s.mod == nil {
+		return true
+	}
+	verdict, err := s.mod.Moderate(ctx, content)
+	if err != nil {
+		golog.Error("moderateInput: moderate: ", err)
+		return true
+	}
+	s.audit(ctx, userID, chatID, 0, internal.ModerationStageInput, verdict, content)
+	if verdict.Flagged {
+		golog.Error("moderateInput: flagged: ", verdict.Categories)
+		status, resp := newErrorResponse(ctx, apperror.New(apperror.CodeMessageFlagged))
+		ctx.JSON(status, moderationErrorResponse{errorResponse: resp, Categories: verdict.Categories})
+		return false
+	}
+	return true
+}
+
+// outputVerdict is the verdict of moderation on a reply, audited once the reply is saved with its seq.
+type outputVerdict struct {
+	msg     *internal.Message
+	verdict moderation.Verdict
+	// content is what the reply said before it was withheld
+	content string
+}
+
+// moderateOutput withholds the replies among msgs that are flagged, replacing their content
+// with the message of apperror.CodeReplyWithheld in lang. A withheld reply keeps the content_filter finish reason,
+// so that clients can tell it apart. The verdicts go to auditOutput once msgs are saved.
+func (s *Server) moderateOutput(ctx context.Context, lang string, msgs ...*internal.Message) []outputVerdict {
+	if s.mod == nil {
+		return nil
+	}
+	var verdicts []outputVerdict
+	for _, msg := range msgs {
+		if msg.Role != chatbot.GetAssistantMessageRole() || msg.Content == "" {
+			continue
+		}
+		verdict, err := s.mod.Moderate(ctx, msg.Content)
+		if err != nil {
+			golog.Error("moderateOutput: moderate: ", err)
+			continue
+		}
+		verdicts = append(verdicts, outputVerdict{msg: msg, verdict: verdict, content: msg.Content})
+		if verdict.Flagged {
+			msg.Content = apperror.Message(apperror.CodeReplyWithheld, lang)
+			msg.FinishReason = "content_filter"
+		}
+	}
+	return verdicts
+}
+
+// withheld reports whether moderateOutput withheld a reply.
+func withheld(verdicts []outputVerdict) bool {
+	for _, v := range verdicts {
+		if v.verdict.Flagged {
+			return true
+		}
+	}
+	return false
+}
+
+// auditOutput records the verdicts of moderateOutput, once their replies are saved with the seqs they got.
+func (s *Server) auditOutput(ctx context.Context, userID string, verdicts []outputVerdict) {
+	for _, v := range verdicts {
+		s.audit(ctx, userID, v.msg.ChatID, v.msg.Seq, internal.ModerationStageOutput, v.verdict, v.content)
+	}
+}
+
+// audit records a decision of moderation. The content is kept only if it was flagged, for reviewing the decision,
+// so that what is let through isn't kept a second time, out of reach of deleting the chat.
+func (s *Server) audit(ctx context.Context, userID, chatID string, seq int, stage string, verdict moderation.Verdict, content string) {
+	if !verdict.Flagged {
+		content = ""
+	}
+	err := s.db.InsertModerationAudit(ctx, internal.ModerationAudit{
+		UserID:     userID,
+		ChatID:     chatID,
+		Seq:        seq,
+		Stage:      stage,
+		Flagged:    verdict.Flagged,
+		Categories: verdict.Categories,
+		Moderator:  verdict.Moderator,
+		Content:    content,
+		CreatedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		golog.Error("audit: insert moderation audit: ", err)
+	}
+}
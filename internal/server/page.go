@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+var (
+	errBadPageLimit = apperror.New(apperror.CodeBadPageLimit)
+	errBadDirection = apperror.New(apperror.CodeBadPageDirection)
+)
+
+// pageResponse has the cursors to the pages around a page of a list, missing where there is none.
+type pageResponse struct {
+	NextCursor string `json:"nextCursor,omitempty" example:"eyJzZXEiOjQxfQ"`
+	PrevCursor string `json:"prevCursor,omitempty" example:"eyJzZXEiOjkwfQ"`
+}
+
+func newPageResponse(cursors internal.Cursors) pageResponse {
+	return pageResponse{NextCursor: cursors.Next, PrevCursor: cursors.Prev}
+}
+
+// pageParams reads the limit, cursor and direction of a page of a list, responding with 400 and reporting false if they are bad.
+// Without a cursor, the page is the start of the list, or its end going prev.
+func pageParams(ctx *gin.Context, handler string) (internal.Page, bool) {
+	page := internal.Page{Limit: defaultPageLimit, Direction: ctx.Query("direction")}
+	if value := ctx.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageLimit {
+			golog.Error(handler, ": ", errBadPageLimit)
+			respondError(ctx, errBadPageLimit)
+			return internal.Page{}, false
+		}
+		page.Limit = n
+	}
+	switch page.Direction {
+	case "", internal.DirectionNext, internal.DirectionPrev:
+	default:
+		golog.Error(handler, ": ", errBadDirection)
+		respondError(ctx, errBadDirection)
+		return internal.Page{}, false
+	}
+	cursor, err := internal.DecodeCursor(ctx.Query("cursor"))
+	if err != nil {
+		golog.Error(handler, ": decode cursor: ", err)
+		respondError(ctx, err)
+		return internal.Page{}, false
+	}
+	page.Cursor = cursor
+	return page, true
+}
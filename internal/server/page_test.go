@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestGetMyMessagesPages(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	for _, content := range []string{"one", "two", "three"} {
+		ts.postMessage(alice, chatID, content)
+	}
+	path := "/me/chats/" + chatID + "/messages?limit=2"
+
+	var pages []messagesResponse
+	seen := map[int]bool{}
+	for cursor := ""; ; {
+		page := decode[messagesResponse](t, ts.must(http.StatusOK, alice, "GET", path+"&cursor="+url.QueryEscape(cursor), nil))
+		if len(page.Messages) == 0 || len(page.Messages) > 2 {
+			t.Fatalf("page %d has %d messages, want 1 or 2", len(pages), len(page.Messages))
+		}
+		for _, msg := range page.Messages {
+			if seen[msg.Seq] {
+				t.Errorf("seq %d on two pages", msg.Seq)
+			}
+			seen[msg.Seq] = true
+		}
+		pages = append(pages, page)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 6 {
+		t.Errorf("paged through %d messages, want all 6", len(seen))
+	}
+	if pages[0].PrevCursor != "" {
+		t.Error("first page has a prevCursor")
+	}
+
+	// going prev from the last page gives the one before it back
+	last := pages[len(pages)-1]
+	prev := decode[messagesResponse](t, ts.must(http.StatusOK, alice, "GET", path+"&direction=prev&cursor="+url.QueryEscape(last.PrevCursor), nil))
+	want := pages[len(pages)-2].Messages
+	if len(prev.Messages) != len(want) {
+		t.Fatalf("page before the last has %d messages, want %d", len(prev.Messages), len(want))
+	}
+	for i := range want {
+		if prev.Messages[i].Seq != want[i].Seq {
+			t.Errorf("message %d of the page before the last is seq %d, want %d", i, prev.Messages[i].Seq, want[i].Seq)
+		}
+	}
+}
+
+func TestPageParamsBad(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+
+	for _, query := range []string{"limit=0", "limit=101", "limit=many", "direction=up", "cursor=%21"} {
+		ts.must(http.StatusBadRequest, alice, "GET", "/me/chats?"+query, nil)
+	}
+}
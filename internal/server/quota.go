@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Quota limits how much a user can generate per day and per month, in utc.
+// A limit of 0 is no limit.
+type Quota struct {
+	DailyMessages   int
+	DailyTokens     int
+	MonthlyMessages int
+	MonthlyTokens   int
+}
+
+type periodUsage struct {
+	Since time.Time `json:"since" example:"2023-07-01T00:00:00Z"`
+	internal.Usage
+	MessageQuota int `json:"messageQuota" example:"100"`  // 0 for no limit
+	TokenQuota   int `json:"tokenQuota" example:"100000"` // 0 for no limit
+	// null for no limit
+	RemainingMessages *int `json:"remainingMessages" example:"88"`
+	RemainingTokens   *int `json:"remainingTokens" example:"95500"`
+}
+
+func newPeriodUsage(since time.Time, usage internal.Usage, messageQuota, tokenQuota int) periodUsage {
+	return periodUsage{
+		Since:             since,
+		Usage:             usage,
+		MessageQuota:      messageQuota,
+		TokenQuota:        tokenQuota,
+		RemainingMessages: remaining(messageQuota, usage.Messages),
+		RemainingTokens:   remaining(tokenQuota, usage.Tokens()),
+	}
+}
+
+func remaining(quota, used int) *int {
+	if quota == 0 {
+		return nil
+	}
+	left := quota - used
+	if left < 0 {
+		left = 0
+	}
+	return &left
+}
+
+// exceeded reports whether nothing is left of one of the quotas.
+func (u periodUsage) exceeded() bool {
+	return u.RemainingMessages != nil && *u.RemainingMessages == 0 ||
+		u.RemainingTokens != nil && *u.RemainingTokens == 0
+}
+
+type usageResponse struct {
+	Day   periodUsage `json:"day"`
+	Month periodUsage `json:"month"`
+}
+
+type quotaExceededResponse struct {
+	errorResponse
+	Day   periodUsage `json:"day"`
+	Month periodUsage `json:"month"`
+}
+
+func (s *Server) usage(ctx *gin.Context, userID string) (usageResponse, error) {
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	day, err := s.db.SelectUsageSince(ctx, userID, dayStart)
+	if err != nil {
+		return usageResponse{}, err
+	}
+	month, err := s.db.SelectUsageSince(ctx, userID, monthStart)
+	if err != nil {
+		return usageResponse{}, err
+	}
+	return usageResponse{
+		Day:   newPeriodUsage(dayStart, day, s.quota.DailyMessages, s.quota.DailyTokens),
+		Month: newPeriodUsage(monthStart, month, s.quota.MonthlyMessages, s.quota.MonthlyTokens),
+	}, nil
+}
+
+// enforceQuota responds with 429 and the usage of the user if a quota is used up, and reports whether to go on.
+// Tokens are only known after generating, so the reply that crosses the token quota still goes through.
+func (s *Server) enforceQuota(ctx *gin.Context, userID string) bool {
+	usage, err := s.usage(ctx, userID)
+	if err != nil {
+		golog.Error("enforceQuota: usage: ", err)
+		respondError(ctx, err)
+		return false
+	}
+	if usage.Day.exceeded() || usage.Month.exceeded() {
+		golog.Error("enforceQuota: quota exceeded: ", userID)
+		status, resp := newErrorResponse(ctx, apperror.New(apperror.CodeQuotaExceeded))
+		ctx.JSON(status, quotaExceededResponse{errorResponse: resp, Day: usage.Day, Month: usage.Month})
+		return false
+	}
+	return true
+}
+
+// addUsage records the usage of calls that make no message, summaries and titles.
+// A failure only leaves them uncounted, so it is logged and not returned.
+func (s *Server) addUsage(ctx context.Context, userID string, usage internal.Usage) {
+	if usage.Tokens() == 0 {
+		return
+	}
+	if err := s.db.AddUsage(ctx, userID, time.Now().UTC(), usage); err != nil {
+		golog.Error("addUsage: ", err)
+	}
+}
+
+// handleGetMyUsage godoc
+// @summary Get my usage
+// @description Get how much I generated today and this month, in utc, against my quotas.
+// @description Every generated reply counts, regenerated ones included. So do the tokens of summarizing and naming my chats.
+// @tags users
+// @security AccessTokenAuth
+// @success 200 {object} usageResponse
+// @failure 401 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/usage [get]
+func (s *Server) handleGetMyUsage(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+
+	usage, err := s.usage(ctx, userID)
+	if err != nil {
+		golog.Error("handleGetMyUsage: usage: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, usage)
+}
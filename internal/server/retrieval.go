@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/evergarden0412/gptea-api/internal/retrieval"
+	"github.com/kataras/golog"
+)
+
+const (
+	// maxReferences is the most scraps given to the chatbot for a message
+	maxReferences = 3
+	// maxReferenceLength keeps a long scrapped message from taking over the context window, in runes
+	maxReferenceLength = 1500
+	// maxReferenceCandidates bounds the scraps ranked for a message, the newest ones
+	maxReferenceCandidates = 200
+)
+
+// retrieveScraps returns the scraps of the user most relevant to content, if the chat uses scraps.
+// Only the newest maxReferenceCandidates scraps of userID are searched, which keeps a message of a user
+// with years of scraps as quick as the others. Retrieval failing leaves the reply ungrounded rather than failing it.
+func (s *Server) retrieveScraps(ctx context.Context, userID string, chat internal.Chat, content string) []chatbot.Reference {
+	if !chat.UseScraps {
+		return nil
+	}
+	scraps, _, err := s.db.SelectMyScraps(ctx, userID, internal.Page{Limit: maxReferenceCandidates})
+	if err != nil {
+		golog.Error("retrieveScraps: select my scraps: ", err)
+		return nil
+	}
+	docs := make([]retrieval.Document, len(scraps))
+	byID := map[string]internal.ScrapWithMessage{}
+	for i, scrap := range scraps {
+		text := scrap.Memo
+		if scrap.Message != nil {
+			text += "\n" + scrap.Message.Content
+		}
+		docs[i] = retrieval.Document{ID: scrap.ID, Text: text}
+		byID[scrap.ID] = scrap
+	}
+	var refs []chatbot.Reference
+	for _, ranked := range retrieval.Lexical(content, docs, maxReferences) {
+		refs = append(refs, chatbot.Reference{ID: ranked.ID, Content: trimRunes(scrapText(byID[ranked.ID]), maxReferenceLength)})
+	}
+	return refs
+}
+
+// scrapText is how a scrap is shown to the chatbot: the memo, then the scrapped message.
+func scrapText(scrap internal.ScrapWithMessage) string {
+	text := "Memo: " + scrap.Memo
+	if scrap.Message != nil {
+		text += "\nMessage: " + scrap.Message.Content
+	}
+	return text
+}
+
+func trimRunes(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sseData returns the data of the last event named event in the server-sent events of body.
+func sseData(t *testing.T, body, event string) string {
+	t.Helper()
+	var data string
+	found := false
+	for _, block := range strings.Split(body, "\n\n") {
+		lines := strings.Split(block, "\n")
+		if len(lines) == 2 && lines[0] == "event:"+event && strings.HasPrefix(lines[1], "data:") {
+			data, found = strings.TrimPrefix(lines[1], "data:"), true
+		}
+	}
+	if !found {
+		t.Fatalf("no %s event in %q", event, body)
+	}
+	return data
+}
+
+func TestReplyCitesScraps(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.register("alice")
+	chatID := ts.createChat(token, "tea")
+	useScraps := true
+	ts.must(http.StatusNoContent, token, "PATCH", "/me/chats/"+chatID, chatBody{Name: "tea", UseScraps: &useScraps})
+	ts.bot.Script("Green tea steeps at 80°C.")
+	ts.postMessage(token, chatID, "How hot for green tea?")
+	scrap := ts.createScrap(token, chatID, 2, "green tea temperature", ts.defaultScrapbook(token))
+	want := []string{scrap.ID}
+
+	ts.bot.Script("At 80°C [scrap:" + scrap.ID + "].")
+	rec := ts.must(http.StatusCreated, token, "POST", "/me/chats/"+chatID+"/messages", messageBody{Content: "green tea temperature?"})
+	if got := decode[replyResponse](t, rec).Citations; !reflect.DeepEqual(got, want) {
+		t.Errorf("citations = %v, want %v", got, want)
+	}
+
+	ts.bot.Script("Still 80°C [scrap:" + scrap.ID + "].")
+	rec = ts.must(http.StatusOK, token, "POST", "/me/chats/"+chatID+"/messages", messageBody{Content: "green tea temperature again?"},
+		"Accept", "text/event-stream")
+	var done replyResponse
+	if err := json.Unmarshal([]byte(sseData(t, rec.Body.String(), "done")), &done); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(done.Citations, want) {
+		t.Errorf("done citations = %v, want %v", done.Citations, want)
+	}
+}
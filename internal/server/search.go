@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/authz"
+	"github.com/evergarden0412/gptea-api/internal/retrieval"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 50
+	// snippetWidth is about how long a snippet of keyword search is, in runes
+	snippetWidth = 160
+)
+
+var (
+	errEmptyQuery             = apperror.New(apperror.CodeSearchQueryEmpty)
+	errBadSearchLimit         = apperror.Invalid(errors.New("limit has to be between 1 and " + strconv.Itoa(maxSearchLimit)))
+	errBadSearchOffset        = apperror.Invalid(errors.New("offset has to be a non negative number"))
+	errBadSearchType          = apperror.Invalid(errors.New("type has to be chat, message or scrap"))
+	errBadSearchTime          = apperror.Invalid(errors.New("from and to have to be dates like 2023-07-01 or times in RFC 3339"))
+	errSemanticSearchDisabled = apperror.New(apperror.CodeSemanticSearchDisabled)
+)
+
+type searchResponse struct {
+	Results []internal.SearchResult `json:"results"`
+	// NextOffset is the offset of the next page, missing on the last one
+	NextOffset *int `json:"nextOffset,omitempty" example:"10"`
+}
+
+// searchParams reads the query q and the limit of a search, responding with 400 and reporting false if they are bad.
+func searchParams(ctx *gin.Context, handler string) (string, int, bool) {
+	q := ctx.Query("q")
+	if q == "" {
+		golog.Error(handler, ": ", errEmptyQuery)
+		respondError(ctx, errEmptyQuery)
+		return "", 0, false
+	}
+	limit := defaultSearchLimit
+	if value := ctx.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			golog.Error(handler, ": ", errBadSearchLimit)
+			respondError(ctx, errBadSearchLimit)
+			return "", 0, false
+		}
+		limit = n
+	}
+	return q, limit, true
+}
+
+// handleSearchMySemantic godoc
+// @summary Search my scraps and messages by meaning
+// @description Get my scraps and messages closest in meaning to q, best first, scored by cosine similarity.
+// @description Scraps match on their memo and the scrapped message. Tool calls and their results aren't searched.
+// @tags search
+// @security AccessTokenAuth
+// @param q query string true "query"
+// @param limit query int false "max results, 10 by default and at most 50"
+// @success 200 {object} searchResponse
+// @failure 400 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @failure 501 {object} errorResponse
+// @router /me/search/semantic [get]
+func (s *Server) handleSearchMySemantic(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	q, limit, ok := searchParams(ctx, "handleSearchMySemantic")
+	if !ok {
+		return
+	}
+	if s.embedder == nil {
+		golog.Error("handleSearchMySemantic: ", errSemanticSearchDisabled)
+		respondError(ctx, errSemanticSearchDisabled)
+		return
+	}
+
+	vectors, err := s.embedder.Embed(ctx, []string{q})
+	if err != nil {
+		golog.Error("handleSearchMySemantic: embed: ", err)
+		respondError(ctx, err)
+		return
+	}
+	model := s.embedder.Model()
+	scraps, err := s.db.SearchMyScrapsByEmbedding(ctx, userID, model, vectors[0], limit)
+	if err != nil {
+		golog.Error("handleSearchMySemantic: search scraps: ", err)
+		respondError(ctx, err)
+		return
+	}
+	messages, err := s.db.SearchMyMessagesByEmbedding(ctx, userID, model, vectors[0], limit)
+	if err != nil {
+		golog.Error("handleSearchMySemantic: search messages: ", err)
+		respondError(ctx, err)
+		return
+	}
+	// both are scored by cosine similarity, so they merge
+	results := append(scraps, messages...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	if results == nil {
+		results = []internal.SearchResult{}
+	}
+
+	ctx.JSON(http.StatusOK, searchResponse{Results: results})
+}
+
+// parseSearchTime reads a time of the filters of handleSearchMine, nil if it is empty.
+func parseSearchTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, errBadSearchTime
+}
+
+// handleSearchMine godoc
+// @summary Search my chats, messages and scraps by keyword
+// @description Get my chats by name, messages by content and scraps by memo matching the keywords of q, best first.
+// @description q takes the web search syntax: "quoted phrases", -excluded words and or.
+// @description Korean matches inside words too, so 광합성 finds 광합성은, and close spellings match by trigrams.
+// @description Every result has a snippet of the matching text, html escaped with the matches in `<mark>`.
+// @description Filtering by scrapbook returns scraps only. Tool calls and their results aren't searched.
+// @tags search
+// @security AccessTokenAuth
+// @param q query string true "query"
+// @param type query string false "chat, message or scrap, comma separated, all of them by default"
+// @param chatID query string false "the chat, its messages and the scraps of its messages"
+// @param scrapbookID query string false "the scraps in the scrapbook"
+// @param from query string false "created at or after, a date or an RFC 3339 time"
+// @param to query string false "created before, a date or an RFC 3339 time"
+// @param limit query int false "max results, 10 by default and at most 50"
+// @param offset query int false "results to skip, nextOffset of the previous page"
+// @success 200 {object} searchResponse
+// @failure 400 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/search [get]
+func (s *Server) handleSearchMine(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	q, limit, ok := searchParams(ctx, "handleSearchMine")
+	if !ok {
+		return
+	}
+	offset := 0
+	if value := ctx.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			golog.Error("handleSearchMine: ", errBadSearchOffset)
+			respondError(ctx, errBadSearchOffset)
+			return
+		}
+		offset = n
+	}
+	filter := internal.SearchFilter{
+		ChatID:      ctx.Query("chatID"),
+		ScrapbookID: ctx.Query("scrapbookID"),
+	}
+	if value := ctx.Query("type"); value != "" {
+		for _, t := range strings.Split(value, ",") {
+			switch t {
+			case internal.SearchResultChat, internal.SearchResultMessage, internal.SearchResultScrap:
+				filter.Types = append(filter.Types, t)
+			default:
+				golog.Error("handleSearchMine: ", errBadSearchType)
+				respondError(ctx, errBadSearchType)
+				return
+			}
+		}
+	}
+	var err error
+	if filter.From, err = parseSearchTime(ctx.Query("from")); err == nil {
+		filter.To, err = parseSearchTime(ctx.Query("to"))
+	}
+	if err != nil {
+		golog.Error("handleSearchMine: parse time: ", err)
+		respondError(ctx, err)
+		return
+	}
+	var scopes []authz.Resource
+	if filter.ChatID != "" {
+		scopes = append(scopes, authz.Chat(filter.ChatID))
+	}
+	if filter.ScrapbookID != "" {
+		scopes = append(scopes, authz.Scrapbook(filter.ScrapbookID))
+	}
+	if err := s.authz.Authorize(ctx, userID, authz.ActionRead, scopes...); err != nil {
+		golog.Error("handleSearchMine: authorize: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	// one more than asked tells whether there is a next page
+	results, err := s.db.SearchMine(ctx, userID, q, filter, limit+1, offset)
+	if err != nil {
+		golog.Error("handleSearchMine: search: ", err)
+		respondError(ctx, err)
+		return
+	}
+	resp := searchResponse{Results: []internal.SearchResult{}}
+	if len(results) > limit {
+		results = results[:limit]
+		next := offset + limit
+		resp.NextOffset = &next
+	}
+	for _, res := range results {
+		switch res.Type {
+		case internal.SearchResultChat:
+			res.Snippet = retrieval.Snippet(res.Chat.Name, q, snippetWidth)
+		case internal.SearchResultMessage:
+			res.Snippet = retrieval.Snippet(res.Message.Content, q, snippetWidth)
+		case internal.SearchResultScrap:
+			res.Snippet = retrieval.Snippet(res.Scrap.Memo, q, snippetWidth)
+		}
+		resp.Results = append(resp.Results, res)
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
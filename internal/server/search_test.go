@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+)
+
+func TestSearchMySemanticRanksByMeaning(t *testing.T) {
+	ts := newTestServer(t)
+	ts.s.UseEmbedder(embedding.NewFake())
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	ts.bot.Script("Steep green tea at 80 degrees for two minutes.", "Paris is the capital of France.")
+	ts.postMessage(alice, chatID, "How long do I steep green tea?")
+	ts.postMessage(alice, chatID, "What is the capital of France?")
+	ts.createScrap(alice, chatID, 2, "green tea steeping", ts.defaultScrapbook(alice))
+
+	rec := ts.must(http.StatusOK, alice, "GET", "/me/search/semantic?q=steep+green+tea", nil)
+	results := decode[searchResponse](t, rec).Results
+	if len(results) == 0 {
+		t.Fatal("found nothing")
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Errorf("result %d scores %f, over %f of the one before", i, results[i].Score, results[i-1].Score)
+		}
+	}
+	var top string
+	switch results[0].Type {
+	case internal.SearchResultScrap:
+		top = results[0].Scrap.Memo
+	case internal.SearchResultMessage:
+		top = results[0].Message.Content
+	}
+	if !strings.Contains(strings.ToLower(top), "green tea") {
+		t.Errorf("top result is %s %q, want one about green tea", results[0].Type, top)
+	}
+	for _, res := range results {
+		if res.Type == internal.SearchResultMessage && strings.Contains(res.Message.Content, "France") && res.Score >= results[0].Score {
+			t.Errorf("message about France scores %f, as high as the top result", res.Score)
+		}
+	}
+}
+
+func TestSearchMySemanticLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.s.UseEmbedder(embedding.NewFake())
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	for _, content := range []string{"green tea", "black tea", "oolong tea"} {
+		ts.postMessage(alice, chatID, content)
+	}
+
+	rec := ts.must(http.StatusOK, alice, "GET", "/me/search/semantic?q=tea&limit=2", nil)
+	if results := decode[searchResponse](t, rec).Results; len(results) != 2 {
+		t.Errorf("got %d results, want the limit of 2", len(results))
+	}
+}
+
+func TestSearchMySemanticOnlyMine(t *testing.T) {
+	ts := newTestServer(t)
+	ts.s.UseEmbedder(embedding.NewFake())
+	alice, bob := ts.register("alice"), ts.register("bob")
+	ts.postMessage(alice, ts.createChat(alice, "tea"), "green tea")
+
+	rec := ts.must(http.StatusOK, bob, "GET", "/me/search/semantic?q=green+tea", nil)
+	if results := decode[searchResponse](t, rec).Results; len(results) != 0 {
+		t.Errorf("bob found %d results of alice", len(results))
+	}
+}
+
+func TestSearchMySemanticWithoutEmbedder(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+
+	rec := ts.must(http.StatusNotImplemented, alice, "GET", "/me/search/semantic?q=tea", nil)
+	if code := decode[errorResponse](t, rec).Code; code != apperror.CodeSemanticSearchDisabled {
+		t.Errorf("got %s, want %s", code, apperror.CodeSemanticSearchDisabled)
+	}
+}
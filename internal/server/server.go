@@ -1,15 +1,25 @@
 package server
 
 import (
-	"database/sql"
+	"context"
+	"errors"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	_ "github.com/evergarden0412/gptea-api/docs"
 	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
 	"github.com/evergarden0412/gptea-api/internal/auth"
+	"github.com/evergarden0412/gptea-api/internal/authz"
 	"github.com/evergarden0412/gptea-api/internal/chatbot"
-	"github.com/evergarden0412/gptea-api/internal/postgres"
+	"github.com/evergarden0412/gptea-api/internal/credential"
+	"github.com/evergarden0412/gptea-api/internal/embedding"
+	"github.com/evergarden0412/gptea-api/internal/jobs"
+	"github.com/evergarden0412/gptea-api/internal/moderation"
 	"github.com/gin-gonic/gin"
 	"github.com/kataras/golog"
 	swaggerFiles "github.com/swaggo/files"
@@ -17,16 +27,35 @@ import (
 )
 
 type Server struct {
-	c  *chatbot.Chatbot
-	a  *auth.Authenticator
-	db *postgres.DB
+	c     *chatbot.Chatbot
+	a     *auth.Authenticator
+	db    Store
+	authz *authz.Authorizer
+	quota Quota
+	// mod checks messages before and replies after generation, nil to skip moderation
+	mod moderation.Moderator
+	// jobs answers messages in the background, nil to always answer within the request
+	jobs jobs.Queue
+	// generations running in this process by id, see trackGeneration
+	generations sync.Map
+	// embedder embeds messages and scraps for semantic search, nil to go without
+	embedder embedding.Embedder
+	// idempotencyKeyTTL is how long responses are kept for retries, see idempotent
+	idempotencyKeyTTL time.Duration
+	// credentials returns the credential of a provider, which verifies its tokens, credential.New but in tests
+	credentials func(provider string) (credential.Credential, error)
 }
 
-func New(a *auth.Authenticator, chatbot *chatbot.Chatbot, db *postgres.DB) *Server {
+func New(a *auth.Authenticator, chatbot *chatbot.Chatbot, db Store, quota Quota, mod moderation.Moderator) *Server {
 	return &Server{
-		a:  a,
-		c:  chatbot,
-		db: db,
+		a:     a,
+		c:     chatbot,
+		db:    db,
+		authz: authz.New(db),
+		quota: quota,
+		mod:   mod,
+
+		credentials: credential.New,
 	}
 }
 
@@ -34,8 +63,72 @@ type messageResponse struct {
 	Message string `json:"message" example:"Hello, World!"`
 }
 
+// replyResponse is the reply of the chatbot to a message.
+type replyResponse struct {
+	Message string `json:"message" example:"Hello, World!"`
+	// Citations are the scraps of the user the reply cites, missing if it cites none
+	Citations []string `json:"citations,omitempty" example:"Hjejwerhj"`
+}
+
+func newReplyResponse(msg *internal.Message) replyResponse {
+	return replyResponse{Message: msg.Content, Citations: msg.Citations}
+}
+
+// errorResponse tells what went wrong, see apperror for the codes.
 type errorResponse struct {
-	Error string `json:"error" example:"error message"`
+	Code apperror.Code `json:"code" example:"chat_not_found"`
+	// Error is the message for the code, in the language of Accept-Language (en or ko)
+	Error string `json:"error" example:"The chat was not found."`
+	// Detail says what was wrong with the request, for invalid_request
+	Detail string `json:"detail,omitempty" example:"temperature must be between 0 and 2"`
+}
+
+// newErrorResponse returns the response for err with its status. What caused err is left to the logs.
+func newErrorResponse(ctx *gin.Context, err error) (int, errorResponse) {
+	code := apperror.CodeOf(err)
+	return apperror.Status(code), errorResponse{
+		Code:   code,
+		Error:  apperror.Message(code, apperror.Lang(ctx.GetHeader("Accept-Language"))),
+		Detail: apperror.DetailOf(err),
+	}
+}
+
+// respondError responds with the status and message for the code of err.
+func respondError(ctx *gin.Context, err error) {
+	ctx.AbortWithStatusJSON(newErrorResponse(ctx, err))
+}
+
+// chatbotError gives an error of the chatbot its code.
+func chatbotError(err error) error {
+	var unavailable *chatbot.UnavailableError
+	switch {
+	case errors.Is(err, chatbot.ErrPromptTooLong):
+		return apperror.Wrap(apperror.CodePromptTooLong, err)
+	case errors.As(err, &unavailable), errors.Is(err, chatbot.ErrNoChoices):
+		return apperror.Wrap(apperror.CodeChatbotUnavailable, err)
+	}
+	return err
+}
+
+// respondChatbotError responds with the status for an error of the chatbot.
+// Unavailability is a 503 telling the client when to retry.
+func respondChatbotError(ctx *gin.Context, err error) {
+	var unavailable *chatbot.UnavailableError
+	if errors.As(err, &unavailable) {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(unavailable.RetryAfter.Seconds()))))
+	}
+	respondError(ctx, chatbotError(err))
+}
+
+// insertMessages persists in with the messages generated for it as one turn, see Messages.AppendTurn.
+// Their seqs are set to the ones they were saved with.
+func (s *Server) insertMessages(ctx context.Context, userID string, in *internal.Message, out ...*internal.Message) error {
+	turn := append([]*internal.Message{in}, out...)
+	if err := s.db.AppendTurn(ctx, userID, turn...); err != nil {
+		return err
+	}
+	s.embedMessages(ctx, turn...)
+	return nil
 }
 
 // @title GPTea API
@@ -57,29 +150,49 @@ func (s *Server) Install(handle func(string, string, ...gin.HandlerFunc) gin.IRo
 	handle("POST", "/auth/cred/logout", s.ensureUser, s.handleLogout)
 	handle("POST", "/auth/token/refresh", s.handleRefreshToken)
 	handle("DELETE", "/me", s.ensureUser, s.handleDeleteMe)
+	handle("GET", "/me/usage", s.ensureUser, s.handleGetMyUsage)
 	// chat
 	handle("GET", "/me/chats", s.ensureUser, s.handleGetMyChats)
-	handle("GET", "/me/chats/:chatID", s.ensureUser, s.handleGetMyChat)
-	handle("POST", "/me/chats", s.ensureUser, s.handlePostMyChat)
-	handle("PATCH", "/me/chats/:chatID", s.ensureUser, s.handlePatchMyChat)
-	handle("DELETE", "/me/chats/:chatID", s.ensureUser, s.handleDeleteMyChat)
+	handle("GET", "/me/chats/:chatID", s.ensureUser, s.authorize, s.handleGetMyChat)
+	handle("POST", "/me/chats", s.ensureUser, s.idempotent, s.handlePostMyChat)
+	handle("PATCH", "/me/chats/:chatID", s.ensureUser, s.authorize, s.handlePatchMyChat)
+	handle("DELETE", "/me/chats/:chatID", s.ensureUser, s.authorize, s.handleDeleteMyChat)
+	handle("GET", "/me/chats/:chatID/summary", s.ensureUser, s.authorize, s.handleGetMyChatSummary)
+	handle("PUT", "/me/chats/:chatID/branch", s.ensureUser, s.authorize, s.handleCheckoutMyBranch)
+	handle("DELETE", "/me/chats/:chatID/generation", s.ensureUser, s.authorize, s.handleCancelMyGeneration)
+	handle("POST", "/me/chats/:chatID/title:generate", customMethod("generate"), s.ensureUser, s.authorize, s.handleGenerateMyChatTitle)
 	// message
-	handle("GET", "/me/chats/:chatID/messages", s.ensureUser, s.handleGetMyMessages)
-	handle("POST", "/me/chats/:chatID/messages", s.ensureUser, s.handlePostMyMessage)
+	handle("GET", "/me/chats/:chatID/messages", s.ensureUser, s.authorize, s.handleGetMyMessages)
+	handle("POST", "/me/chats/:chatID/messages", s.ensureUser, s.authorize, s.idempotent, s.handlePostMyMessage)
+	handle("GET", "/me/chats/:chatID/jobs/:jobID", s.ensureUser, s.authorize, s.handleGetMyJob)
+	handle("PATCH", "/me/chats/:chatID/messages/:seq", s.ensureUser, s.authorize, s.handlePatchMyMessage)
+	handle("POST", "/me/chats/:chatID/messages/:seq/regenerate", s.ensureUser, s.authorize, s.handleRegenerateMyMessage)
+	handle("GET", "/me/chats/:chatID/messages/:seq/versions", s.ensureUser, s.authorize, s.handleGetMyMessageVersions)
+	handle("POST", "/me/chats/:chatID/messages/:seq/edit", s.ensureUser, s.authorize, s.handleEditMyMessage)
+	// template
+	handle("GET", "/me/templates", s.ensureUser, s.handleGetMyTemplates)
+	handle("GET", "/me/templates/:templateID", s.ensureUser, s.authorize, s.handleGetMyTemplate)
+	handle("POST", "/me/templates", s.ensureUser, s.handlePostMyTemplate)
+	handle("PATCH", "/me/templates/:templateID", s.ensureUser, s.authorize, s.handlePatchMyTemplate)
+	handle("DELETE", "/me/templates/:templateID", s.ensureUser, s.authorize, s.handleDeleteMyTemplate)
 	// scrapbook
 	handle("GET", "/me/scrapbooks", s.ensureUser, s.handleGetMyScrapbooks)
-	handle("GET", "/me/scrapbooks/:scrapbookID", s.ensureUser, s.handleGetMyScrapbook)
-	handle("POST", "/me/scrapbooks", s.ensureUser, s.handlePostMyScrapbook)
-	handle("DELETE", "/me/scrapbooks/:scrapbookID", s.ensureUser, s.handleDeleteMyScrapbook)
-	handle("PATCH", "/me/scrapbooks/:scrapbookID", s.ensureUser, s.handlePatchMyScrapbook)
+	handle("GET", "/me/scrapbooks/:scrapbookID", s.ensureUser, s.authorize, s.handleGetMyScrapbook)
+	handle("POST", "/me/scrapbooks", s.ensureUser, s.idempotent, s.handlePostMyScrapbook)
+	handle("DELETE", "/me/scrapbooks/:scrapbookID", s.ensureUser, s.authorize, s.handleDeleteMyScrapbook)
+	handle("PATCH", "/me/scrapbooks/:scrapbookID", s.ensureUser, s.authorize, s.handlePatchMyScrapbook)
 	// scrap
-	handle("GET", "/me/scrapbooks/:scrapbookID/scraps", s.ensureUser, s.handleGetScrapsOnScrapbook)
+	handle("GET", "/me/scrapbooks/:scrapbookID/scraps", s.ensureUser, s.authorize, s.handleGetScrapsOnScrapbook)
 	handle("GET", "/me/scraps", s.ensureUser, s.handleGetMyScraps)
-	handle("POST", "/me/scraps", s.ensureUser, s.handlePostMyScrap)
-	handle("DELETE", "/me/scraps/:scrapID", s.ensureUser, s.handleDeleteMyScrap)
-	handle("GET", "/me/scraps/:scrapID/scrapbooks", s.ensureUser, s.handleGetMyScrapbooksOnScrap)
-	handle("POST", "/me/scraps/:scrapID/scrapbooks/:scrapbookID", s.ensureUser, s.handlePostScrapOnScrapbook)
-	handle("DELETE", "/me/scraps/:scrapID/scrapbooks/:scrapbookID", s.ensureUser, s.handleDeleteScrapOnScrapbook)
+	handle("POST", "/me/scraps", s.ensureUser, s.idempotent, s.handlePostMyScrap)
+	handle("PATCH", "/me/scraps/:scrapID", s.ensureUser, s.authorize, s.handlePatchMyScrap)
+	handle("DELETE", "/me/scraps/:scrapID", s.ensureUser, s.authorize, s.handleDeleteMyScrap)
+	handle("GET", "/me/scraps/:scrapID/scrapbooks", s.ensureUser, s.authorize, s.handleGetMyScrapbooksOnScrap)
+	handle("POST", "/me/scraps/:scrapID/scrapbooks/:scrapbookID", s.ensureUser, s.authorize, s.handlePostScrapOnScrapbook)
+	handle("DELETE", "/me/scraps/:scrapID/scrapbooks/:scrapbookID", s.ensureUser, s.authorize, s.handleDeleteScrapOnScrapbook)
+	// search
+	handle("GET", "/me/search", s.ensureUser, s.handleSearchMine)
+	handle("GET", "/me/search/semantic", s.ensureUser, s.handleSearchMySemantic)
 	if os.Getenv("ENV") != "prod" {
 		handle("GET", "/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	}
@@ -91,14 +204,21 @@ func (s *Server) handlePing(c *gin.Context) {
 
 type messagesResponse struct {
 	Messages []internal.MessageWithScrap `json:"messages"`
+	pageResponse
 }
 
 // handleGetMyMessages godoc
 // @summary Get my messages
-// @description Get my messages in descending order of created_at
+// @description Get the messages on the active branch of my chat, from its head back to the first message.
+// @description Every message carries its parentSeq and the siblingSeqs of the messages sharing that parent,
+// @description so the other branches can be shown and checked out.
+// @description The first page is the latest messages, nextCursor pages back to older ones and prevCursor forward to newer ones.
 // @tags messages
 // @security AccessTokenAuth
 // @param chatID path string true "chatID"
+// @param limit query int false "max items, 50 by default and at most 100"
+// @param cursor query string false "nextCursor or prevCursor of the previous page"
+// @param direction query string false "next (default) or prev, the way of the cursor"
 // @success 200 {object} messagesResponse
 // @failure 400 {object} errorResponse
 // @failure 500 {object} errorResponse
@@ -106,11 +226,15 @@ type messagesResponse struct {
 func (s *Server) handleGetMyMessages(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
 	chatID := ctx.Param("chatID")
+	page, ok := pageParams(ctx, "handleGetMyMessages")
+	if !ok {
+		return
+	}
 
-	messages, err := s.db.GetMyMessages(ctx, userID, chatID)
+	messages, cursors, err := s.db.GetMyMessages(ctx, userID, chatID, page)
 	if err != nil {
 		golog.Error("handleGetMyMessages: get messages: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -119,81 +243,151 @@ func (s *Server) handleGetMyMessages(ctx *gin.Context) {
 		messagesResp[i] = *message
 	}
 
-	ctx.JSON(http.StatusOK, messagesResponse{Messages: messagesResp})
+	ctx.JSON(http.StatusOK, messagesResponse{Messages: messagesResp, pageResponse: newPageResponse(cursors)})
 }
 
+// messageBody is either the content of the message, or a prompt template to render it from with variables.
 type messageBody struct {
-	Content string `json:"content"`
+	Content    string            `json:"content"`
+	TemplateID string            `json:"templateID" example:"builtin-quiz"`
+	Variables  map[string]string `json:"variables"`
 }
 
 // handlePostMyMessage godoc
 // @summary Post my message
-// @description Post my message and get response when chatbot finishes processing
+// @description Post my message and get response when chatbot finishes processing.
+// @description A chat without a name is named after its first exchange.
+// @description In a chat using scraps, my scraps relevant to the message are given to the chatbot,
+// @description and the reply lists the ones it cites in citations.
+// @description The chatbot may call tools on my data while answering, the calls and their results are saved
+// @description as `function_call` and `function` messages ahead of the reply.
+// @description A message flagged by moderation is rejected with 422, a reply flagged by moderation is withheld:
+// @description its content is replaced and its finishReason is `content_filter`.
+// @description Instead of content, a templateID with variables renders the message from a prompt template,
+// @description which the message records. A required variable missing is rejected with 400.
+// @description With `Accept: text/event-stream` the response is streamed as server-sent events instead:
+// @description `delta` events carry pieces of the reply, followed by a single `done` event with the reply as in the 201 response, or an `error` event.
+// @description A streamed reply withheld by moderation is taken back with a `retract` event before `done` brings the replacement.
+// @description With `Prefer: respond-async` the message is saved and answered in the background instead:
+// @description the response is 202 with the job answering it, which can be polled at the Location header.
+// @description While a job of the chat is unfinished, posting to it is rejected with 409.
+// @description A retry with the Idempotency-Key of a posted message gets the first response back, marked `Idempotent-Replayed: true`,
+// @description instead of posting it again. A retry while the first is running, or reusing the key for another message, gets 409.
 // @tags messages
 // @security AccessTokenAuth
+// @produce json
+// @produce text/event-stream
 // @param chatID path string true "chatID"
+// @param Accept header string false "text/event-stream to stream the reply"
+// @param Prefer header string false "respond-async to answer in the background"
+// @param Idempotency-Key header string false "unique per request, a retry with it gets the first response back"
 // @param body body messageBody true "body"
-// @success 201 {object} messageResponse
+// @success 200 {object} deltaEvent "text/event-stream"
+// @success 201 {object} replyResponse
+// @success 202 {object} internal.Job
+// @header 202 {string} Location "the job"
 // @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 409 {object} errorResponse
+// @failure 422 {object} moderationErrorResponse
+// @failure 429 {object} quotaExceededResponse
 // @failure 500 {object} errorResponse
+// @failure 503 {object} errorResponse
+// @header 503 {integer} Retry-After "seconds to wait before retrying"
 // @router /me/chats/{chatID}/messages [post]
 func (s *Server) handlePostMyMessage(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
 	chatID := ctx.Param("chatID")
 	var body messageBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		golog.Error("handlePostMyMessage: bind json: ", err)
 		return
 	}
 
-	history, err := s.db.GetMyMessages(ctx, userID, chatID)
+	chat, err := s.db.SelectMyChat(ctx, userID, chatID)
 	if err != nil {
-		golog.Error("handlePostMyMessage: get history: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		golog.Error("handlePostMyMessage: select chat: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if !s.ensureNoUnfinishedJob(ctx, chatID) {
 		return
 	}
-	inMsg, outMsg, err := s.c.SendChat(ctx, chatID, history, body.Content)
+	if !s.enforceQuota(ctx, userID) {
+		return
+	}
+	content, ok := s.renderMessage(ctx, userID, body)
+	if !ok {
+		return
+	}
+	if !s.moderateInput(ctx, userID, chatID, content) {
+		return
+	}
+	if s.wantsAsync(ctx) {
+		s.postMyMessageAsync(ctx, userID, chat, content, body.TemplateID)
+		return
+	}
+	conv, err := s.loadConversation(ctx, userID, chat, content)
 	if err != nil {
-		golog.Error("handlePostMyMessage: send chat: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		golog.Error("handlePostMyMessage: load conversation: ", err)
+		respondChatbotError(ctx, err)
 		return
 	}
-	if err := s.db.InsertMessage(ctx, userID, *inMsg); err != nil {
-		golog.Error("handlePostMyMessage: insert message: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+	if wantsEventStream(ctx) {
+		s.streamMyMessage(ctx, userID, conv, content, body.TemplateID)
 		return
 	}
-	if err := s.db.InsertMessage(ctx, userID, *outMsg); err != nil {
-		golog.Error("handlePostMyMessage: insert message: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+	inMsg, outMsgs, err := s.c.SendChat(ctx, conv, content)
+	if err != nil {
+		golog.Error("handlePostMyMessage: send chat: ", err)
+		respondChatbotError(ctx, err)
+		return
+	}
+	inMsg.TemplateID = body.TemplateID
+	verdicts := s.moderateOutput(ctx, apperror.Lang(ctx.GetHeader("Accept-Language")), outMsgs...)
+	if err := s.insertMessages(ctx, userID, inMsg, outMsgs...); err != nil {
+		golog.Error("handlePostMyMessage: insert messages: ", err)
+		respondError(ctx, err)
 		return
 	}
+	s.auditOutput(ctx, userID, verdicts)
+	outMsg := outMsgs[len(outMsgs)-1]
+	s.autoTitle(ctx, userID, chat, inMsg, outMsg)
 
-	ctx.JSON(http.StatusCreated, messageResponse{Message: outMsg.Content})
+	ctx.JSON(http.StatusCreated, newReplyResponse(outMsg))
 }
 
 type scrapbooksResponse struct {
 	Scrapbooks []internal.Scrapbook `json:"scrapbooks"`
+	pageResponse
 }
 
 // handleGetMyScrapbooks godoc
 //
 //	@summary Get my scrapbooks
-//	@description Get my scrapbooks
+//	@description Get a page of my scrapbooks, oldest first
 //	@tags scrapbooks
 //	@security AccessTokenAuth
+//	@param limit query int false "max items, 50 by default and at most 100"
+//	@param cursor query string false "nextCursor or prevCursor of the previous page"
+//	@param direction query string false "next (default) or prev, the way of the cursor"
 //	@success 200 {object} scrapbooksResponse
 //	@failure 400 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scrapbooks [get]
 func (s *Server) handleGetMyScrapbooks(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
+	page, ok := pageParams(ctx, "handleGetMyScrapbooks")
+	if !ok {
+		return
+	}
 
-	scrapbooks, err := s.db.SelectMyScrapbooks(ctx, userID)
+	scrapbooks, cursors, err := s.db.SelectMyScrapbooks(ctx, userID, page)
 	if err != nil {
 		golog.Error("handleGetMyScrapbooks: select my scrapbooks: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -201,7 +395,7 @@ func (s *Server) handleGetMyScrapbooks(ctx *gin.Context) {
 	for i, scrapbook := range scrapbooks {
 		scrapbooksResp[i] = scrapbook
 	}
-	ctx.JSON(http.StatusOK, scrapbooksResponse{Scrapbooks: scrapbooksResp})
+	ctx.JSON(http.StatusOK, scrapbooksResponse{Scrapbooks: scrapbooksResp, pageResponse: newPageResponse(cursors)})
 }
 
 // handleGetMyScrapbook godoc
@@ -210,9 +404,9 @@ func (s *Server) handleGetMyScrapbooks(ctx *gin.Context) {
 //	@description Get my scrapbook
 //	@tags scrapbooks
 //	@security AccessTokenAuth
-//	@success 200 {object} internal.Scrapbook 
+//	@success 200 {object} internal.Scrapbook
 //	@failure 400 {object} errorResponse
-// 	@failure 404 {object} errorResponse
+//	@failure 404 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scrapbooks/{scrapbookID} [get]
 func (s *Server) handleGetMyScrapbook(ctx *gin.Context) {
@@ -220,19 +414,15 @@ func (s *Server) handleGetMyScrapbook(ctx *gin.Context) {
 	scrapbookID := ctx.Param("scrapbookID")
 
 	scrapbook, err := s.db.SelectMyScrapbook(ctx, userID, scrapbookID)
-	if err == sql.ErrNoRows {
-		golog.Error("handleGetMyScrapbook: select my scrapbook: ", err)
-		ctx.JSON(http.StatusNotFound, errorResponse{Error: err.Error()})
-		return
-	}
 	if err != nil {
-		golog.Error("handleGetMyScrapbooks: select my scrapbooks: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		golog.Error("handleGetMyScrapbook: select my scrapbook: ", err)
+		respondError(ctx, err)
 		return
 	}
 
 	ctx.JSON(http.StatusOK, scrapbook)
 }
+
 type scrapbookBody struct {
 	Name string `json:"name"`
 }
@@ -243,9 +433,11 @@ type scrapbookBody struct {
 //	@description post new scrapbook
 //	@tags scrapbooks
 //	@security AccessTokenAuth
+//	@param Idempotency-Key header string false "unique per request, a retry with it gets the first response back"
 //	@param body body scrapbookBody true "body"
 //	@success 201
 //	@failure 400 {object} errorResponse
+//	@failure 409 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scrapbooks [post]
 func (s *Server) handlePostMyScrapbook(ctx *gin.Context) {
@@ -253,7 +445,7 @@ func (s *Server) handlePostMyScrapbook(ctx *gin.Context) {
 	var body scrapbookBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
 		golog.Error("handlePostMyScrapbook: bind json: ", err)
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		return
 	}
 	scrapbook := internal.Scrapbook{
@@ -261,13 +453,13 @@ func (s *Server) handlePostMyScrapbook(ctx *gin.Context) {
 	}
 	if err := scrapbook.Assign(); err != nil {
 		golog.Error("handlePostMyScrapbook: assign: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
 	if err := s.db.InsertScrapbook(ctx, userID, scrapbook); err != nil {
 		golog.Error("handlePostMyScrapbook: insert scrapbook: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -283,6 +475,8 @@ func (s *Server) handlePostMyScrapbook(ctx *gin.Context) {
 //	@param scrapbookID path string true "scrapbookID"
 //	@success 204
 //	@failure 400 {object} errorResponse
+//	@failure 403 {object} errorResponse "scrapbook_default_immutable"
+//	@failure 404 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scrapbooks/{scrapbookID} [delete]
 func (s *Server) handleDeleteMyScrapbook(ctx *gin.Context) {
@@ -291,7 +485,7 @@ func (s *Server) handleDeleteMyScrapbook(ctx *gin.Context) {
 
 	if err := s.db.DeleteScrapbook(ctx, userID, scrapbookID); err != nil {
 		golog.Error("handleDeleteMyScrapbook: delete scrapbook: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -308,6 +502,8 @@ func (s *Server) handleDeleteMyScrapbook(ctx *gin.Context) {
 //	@param body body scrapbookBody true "body"
 //	@success 204
 //	@failure 400 {object} errorResponse
+//	@failure 403 {object} errorResponse "scrapbook_default_immutable"
+//	@failure 404 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scrapbooks/{scrapbookID} [patch]
 func (s *Server) handlePatchMyScrapbook(ctx *gin.Context) {
@@ -316,13 +512,13 @@ func (s *Server) handlePatchMyScrapbook(ctx *gin.Context) {
 	var body scrapbookBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
 		golog.Error("handlePatchMyScrapbook: bind json: ", err)
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		return
 	}
 
 	if err := s.db.PatchScrapbook(ctx, userID, scrapbookID, body.Name); err != nil {
 		golog.Error("handlePatchMyScrapbook: patch scrapbook: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -331,15 +527,19 @@ func (s *Server) handlePatchMyScrapbook(ctx *gin.Context) {
 
 type scrapsResponse struct {
 	Scraps []internal.ScrapWithMessage `json:"scraps"`
+	pageResponse
 }
 
 // handleGetScrapsOnScrapbook godoc
 //
 //	@summary get scraps on scrapbook
-//	@description get scraps on scrapbook
+//	@description get a page of the scraps on scrapbook, newest first
 //	@tags scraps
 //	@security AccessTokenAuth
 //	@param scrapbookID path string true "scrapbookID"
+//	@param limit query int false "max items, 50 by default and at most 100"
+//	@param cursor query string false "nextCursor or prevCursor of the previous page"
+//	@param direction query string false "next (default) or prev, the way of the cursor"
 //	@success 200 {object} scrapsResponse
 //	@failure 400 {object} errorResponse
 //	@failure 500 {object} errorResponse
@@ -347,11 +547,15 @@ type scrapsResponse struct {
 func (s *Server) handleGetScrapsOnScrapbook(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
 	scrapbookID := ctx.Param("scrapbookID")
+	page, ok := pageParams(ctx, "handleGetScrapsOnScrapbook")
+	if !ok {
+		return
+	}
 
-	scraps, err := s.db.SelectScrapsOnScrapbook(ctx, userID, scrapbookID)
+	scraps, cursors, err := s.db.SelectScrapsOnScrapbook(ctx, userID, scrapbookID, page)
 	if err != nil {
 		golog.Error("handleGetScrapsOnScrapbook: select scraps on scrapbook: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -359,7 +563,7 @@ func (s *Server) handleGetScrapsOnScrapbook(ctx *gin.Context) {
 	for i, scrap := range scraps {
 		scrapsResp[i] = scrap
 	}
-	ctx.JSON(http.StatusOK, scrapsResponse{Scraps: scrapsResp})
+	ctx.JSON(http.StatusOK, scrapsResponse{Scraps: scrapsResp, pageResponse: newPageResponse(cursors)})
 }
 
 type postScrapBody struct {
@@ -372,20 +576,27 @@ type postScrapBody struct {
 // handleGetMyScraps godoc
 //
 //	@summary get my scraps
-//	@description get all my scraps
+//	@description get a page of my scraps, newest first
 //	@tags scraps
 //	@security AccessTokenAuth
+//	@param limit query int false "max items, 50 by default and at most 100"
+//	@param cursor query string false "nextCursor or prevCursor of the previous page"
+//	@param direction query string false "next (default) or prev, the way of the cursor"
 //	@success 200 {object} scrapsResponse
 //	@failure 400 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scraps [get]
 func (s *Server) handleGetMyScraps(ctx *gin.Context) {
 	userID := ctx.GetString("userID")
+	page, ok := pageParams(ctx, "handleGetMyScraps")
+	if !ok {
+		return
+	}
 
-	scraps, err := s.db.SelectMyScraps(ctx, userID)
+	scraps, cursors, err := s.db.SelectMyScraps(ctx, userID, page)
 	if err != nil {
 		golog.Error("handleGetMyScraps: select my scraps: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -393,7 +604,7 @@ func (s *Server) handleGetMyScraps(ctx *gin.Context) {
 	for i, scrap := range scraps {
 		scrapsResp[i] = scrap
 	}
-	ctx.JSON(http.StatusOK, scrapsResponse{Scraps: scrapsResp})
+	ctx.JSON(http.StatusOK, scrapsResponse{Scraps: scrapsResp, pageResponse: newPageResponse(cursors)})
 }
 
 // handlePostMyScrap godoc
@@ -402,9 +613,11 @@ func (s *Server) handleGetMyScraps(ctx *gin.Context) {
 //	@description post new scrap, store in default scrapbook
 //	@tags scraps
 //	@security AccessTokenAuth
+//	@param Idempotency-Key header string false "unique per request, a retry with it gets the first response back"
 //	@param body body postScrapBody true "body"
 //	@success 201
 //	@failure 400 {object} errorResponse
+//	@failure 409 {object} errorResponse
 //	@failure 500 {object} errorResponse
 //	@router /me/scraps [post]
 func (s *Server) handlePostMyScrap(ctx *gin.Context) {
@@ -412,7 +625,7 @@ func (s *Server) handlePostMyScrap(ctx *gin.Context) {
 	var body postScrapBody
 	if err := ctx.ShouldBindJSON(&body); err != nil {
 		golog.Error("handlePostMyScrap: bind json: ", err)
-		ctx.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		respondError(ctx, apperror.Invalid(err))
 		return
 	}
 
@@ -425,18 +638,70 @@ func (s *Server) handlePostMyScrap(ctx *gin.Context) {
 	}
 	if err := scrap.Assign(); err != nil {
 		golog.Error("handlePostMyScrap: assign: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
+		return
+	}
+	if err := s.authz.Authorize(ctx, userID, authz.ActionRead, authz.Message(msg.ChatID, msg.Seq)); err != nil {
+		golog.Error("handlePostMyScrap: authorize message: ", err)
+		respondError(ctx, err)
+		return
+	}
+	scrapbooks := make([]authz.Resource, 0, len(body.ScrapbookIDs))
+	for _, scrapbookID := range body.ScrapbookIDs {
+		scrapbooks = append(scrapbooks, authz.Scrapbook(scrapbookID))
+	}
+	if err := s.authz.Authorize(ctx, userID, authz.ActionWrite, scrapbooks...); err != nil {
+		golog.Error("handlePostMyScrap: authorize scrapbooks: ", err)
+		respondError(ctx, err)
 		return
 	}
 	if err := s.db.InsertScrap(ctx, userID, scrap, msg, body.ScrapbookIDs); err != nil {
 		golog.Error("handlePostMyScrap: insert scrap: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
+	s.embedScrap(ctx, userID, scrap.ID)
 
 	ctx.Status(http.StatusCreated)
 }
 
+type patchScrapBody struct {
+	Memo string `json:"memo"`
+}
+
+// handlePatchMyScrap godoc
+//
+//	@summary patch scrap
+//	@description patch the memo of scrap
+//	@tags scraps
+//	@security AccessTokenAuth
+//	@param scrapID path string true "scrapID"
+//	@param body body patchScrapBody true "body"
+//	@success 204
+//	@failure 400 {object} errorResponse
+//	@failure 401 {object} errorResponse
+//	@failure 500 {object} errorResponse
+//	@router /me/scraps/{scrapID} [patch]
+func (s *Server) handlePatchMyScrap(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	scrapID := ctx.Param("scrapID")
+	var body patchScrapBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		golog.Error("handlePatchMyScrap: bind json: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	if err := s.db.PatchScrap(ctx, userID, scrapID, body.Memo); err != nil {
+		golog.Error("handlePatchMyScrap: patch scrap: ", err)
+		respondError(ctx, err)
+		return
+	}
+	s.embedScrap(ctx, userID, scrapID)
+
+	ctx.Status(http.StatusNoContent)
+}
+
 // handleDeleteMyScrap godoc
 //
 //	@summary delete scrap
@@ -454,7 +719,7 @@ func (s *Server) handleDeleteMyScrap(ctx *gin.Context) {
 
 	if err := s.db.DeleteScrap(ctx, userID, scrapID); err != nil {
 		golog.Error("handleDeleteMyScrap: delete scrap: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -479,7 +744,7 @@ func (s *Server) handleGetMyScrapbooksOnScrap(ctx *gin.Context) {
 	scrapbooks, err := s.db.SelectMyScrapbooksOnScrap(ctx, userID, scrapID)
 	if err != nil {
 		golog.Error("handleGetMyScrapbooksOnScrap: select my scrapbooks on scrap: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -509,7 +774,7 @@ func (s *Server) handlePostScrapOnScrapbook(ctx *gin.Context) {
 
 	if err := s.db.InsertScrapOnScrapbook(ctx, userID, scrapID, scrapbookID); err != nil {
 		golog.Error("handlePostMyScrapOnScrapbook: insert scrap on scrapbook: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
@@ -535,7 +800,7 @@ func (s *Server) handleDeleteScrapOnScrapbook(ctx *gin.Context) {
 
 	if err := s.db.DeleteScrapOnScrapbook(ctx, userID, scrapID, scrapbookID); err != nil {
 		golog.Error("handleDeleteScrapOnScrapbook: delete scrap on scrapbook: ", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		respondError(ctx, err)
 		return
 	}
 
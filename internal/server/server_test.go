@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/auth"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/evergarden0412/gptea-api/internal/memory"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// handlers log every error they respond with, which the tests provoke on purpose
+	golog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testServer is a Server on memory.DB and chatbot.Fake, with its routes installed the way main does.
+type testServer struct {
+	t      *testing.T
+	s      *Server
+	db     *memory.DB
+	bot    *chatbot.Fake
+	sent   *recorder
+	a      *auth.Authenticator
+	router *gin.Engine
+}
+
+// recorder records the requests the chatbot sends to the provider of testServer.
+type recorder struct {
+	chatbot.Provider
+	mu   sync.Mutex
+	reqs []openai.ChatCompletionRequest
+	// streamErr fails the streams after their first chunk, see failStreams
+	streamErr error
+}
+
+func (r *recorder) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	r.mu.Lock()
+	r.reqs = append(r.reqs, req)
+	r.mu.Unlock()
+	return r.Provider.CreateChatCompletion(ctx, req)
+}
+
+func (r *recorder) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chatbot.Stream, error) {
+	r.mu.Lock()
+	r.reqs = append(r.reqs, req)
+	streamErr := r.streamErr
+	r.mu.Unlock()
+	stream, err := r.Provider.CreateChatCompletionStream(ctx, req)
+	if err != nil || streamErr == nil {
+		return stream, err
+	}
+	return &failingStream{Stream: stream, err: streamErr}, nil
+}
+
+// failStreams makes the streams started from now on fail with err after their first chunk, nil lets them finish.
+func (r *recorder) failStreams(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streamErr = err
+}
+
+// failingStream is a stream cut off with err after its first chunk.
+type failingStream struct {
+	chatbot.Stream
+	err  error
+	sent bool
+}
+
+func (s *failingStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if s.sent {
+		return openai.ChatCompletionStreamResponse{}, s.err
+	}
+	s.sent = true
+	return s.Stream.Recv()
+}
+
+func (r *recorder) last() openai.ChatCompletionRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reqs[len(r.reqs)-1]
+}
+
+func newTestServer(t *testing.T) *testServer {
+	a := auth.New(auth.AuthenticatorConfig{
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: time.Hour,
+		AccessTokenKey:  []byte("access"),
+		RefreshTokenKey: []byte("refresh"),
+	})
+	db := memory.New()
+	bot := chatbot.NewFake()
+	sent := &recorder{Provider: bot}
+	c := chatbot.New(sent)
+	s := New(a, c, db, Quota{}, nil)
+	c.RegisterTools(s.Tools()...)
+	router := gin.New()
+	s.Install(router.Handle)
+	return &testServer{t: t, s: s, db: db, bot: bot, sent: sent, a: a, router: router}
+}
+
+// register adds the user with their default scrapbook and returns an access token of theirs.
+func (ts *testServer) register(userID string) string {
+	ts.t.Helper()
+	err := ts.db.Register(context.Background(), internal.RegisterInput{UserID: userID, CredentialType: "test", CredentialID: userID})
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	at, err := ts.a.IssueAccessToken(userID)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return at.Signed()
+}
+
+// do sends the request with body, in json unless it is nil, as the user of token, without one if it is empty.
+func (ts *testServer) do(token, method, path string, body any, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	ts.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// must sends the request like do and fails the test unless it is answered with status.
+func (ts *testServer) must(status int, token, method, path string, body any, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	rec := ts.do(token, method, path, body, header...)
+	if rec.Code != status {
+		ts.t.Fatalf("%s %s: got %d %s, want %d", method, path, rec.Code, rec.Body, status)
+	}
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body, err)
+	}
+	return v
+}
+
+// createChat creates a chat named name, which keeps it from being named after its first reply, and returns its ID.
+func (ts *testServer) createChat(token, name string) string {
+	ts.t.Helper()
+	ts.must(http.StatusCreated, token, "POST", "/me/chats", chatBody{Name: name})
+	chats := decode[chatsResponse](ts.t, ts.must(http.StatusOK, token, "GET", "/me/chats", nil))
+	for _, chat := range chats.Chats {
+		if chat.Name == name {
+			return chat.ID
+		}
+	}
+	ts.t.Fatalf("chat %s not created", name)
+	return ""
+}
+
+// postMessage posts content to the chat and returns the reply.
+func (ts *testServer) postMessage(token, chatID, content string) string {
+	ts.t.Helper()
+	rec := ts.must(http.StatusCreated, token, "POST", "/me/chats/"+chatID+"/messages", messageBody{Content: content})
+	return decode[messageResponse](ts.t, rec).Message
+}
+
+// defaultScrapbook returns the ID of the default scrapbook of the user of token.
+func (ts *testServer) defaultScrapbook(token string) string {
+	ts.t.Helper()
+	scrapbooks := decode[scrapbooksResponse](ts.t, ts.must(http.StatusOK, token, "GET", "/me/scrapbooks", nil))
+	for _, scrapbook := range scrapbooks.Scrapbooks {
+		if scrapbook.IsDefault {
+			return scrapbook.ID
+		}
+	}
+	ts.t.Fatal("no default scrapbook")
+	return ""
+}
+
+// createScrapbook creates a scrapbook named name and returns its ID.
+func (ts *testServer) createScrapbook(token, name string) string {
+	ts.t.Helper()
+	ts.must(http.StatusCreated, token, "POST", "/me/scrapbooks", scrapbookBody{Name: name})
+	scrapbooks := decode[scrapbooksResponse](ts.t, ts.must(http.StatusOK, token, "GET", "/me/scrapbooks", nil))
+	for _, scrapbook := range scrapbooks.Scrapbooks {
+		if scrapbook.Name == name {
+			return scrapbook.ID
+		}
+	}
+	ts.t.Fatalf("scrapbook %s not created", name)
+	return ""
+}
+
+// createScrap scraps the message at seq of the chat into the scrapbooks and returns the scrap.
+func (ts *testServer) createScrap(token, chatID string, seq int, memo string, scrapbookIDs ...string) internal.ScrapWithMessage {
+	ts.t.Helper()
+	ts.must(http.StatusCreated, token, "POST", "/me/scraps", postScrapBody{ChatID: chatID, Seq: seq, Memo: memo, ScrapbookIDs: scrapbookIDs})
+	scraps := decode[scrapsResponse](ts.t, ts.must(http.StatusOK, token, "GET", "/me/scraps", nil))
+	for _, scrap := range scraps.Scraps {
+		if scrap.Message != nil && scrap.Message.ChatID == chatID && scrap.Message.Seq == seq {
+			return scrap
+		}
+	}
+	ts.t.Fatalf("scrap of %s %d not created", chatID, seq)
+	return internal.ScrapWithMessage{}
+}
+
+func TestPostMyMessageConcurrently(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+
+	const turns = 2
+	var wg sync.WaitGroup
+	for i := 0; i < turns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.do(alice, "POST", "/me/chats/"+chatID+"/messages", messageBody{Content: "hello"})
+		}()
+	}
+	wg.Wait()
+
+	// whichever branch each turn went on, its message and reply take the next two seqs
+	for seq := 1; seq <= 2*turns; seq++ {
+		branch, err := ts.db.SelectMessagePath(context.Background(), "alice", chatID, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(branch) == 0 || branch[0].Seq != seq {
+			t.Fatalf("no message at seq %d", seq)
+		}
+		msg := branch[0]
+		switch {
+		case seq%2 == 1 && msg.Role != openai.ChatMessageRoleUser:
+			t.Errorf("message at seq %d is from %s, want the user", seq, msg.Role)
+		case seq%2 == 0 && (msg.Role != openai.ChatMessageRoleAssistant || msg.ParentSeq != seq-1):
+			t.Errorf("message at seq %d is from %s after %d, want the reply to %d", seq, msg.Role, msg.ParentSeq, seq-1)
+		}
+	}
+	if last, err := ts.db.SelectLastSeq(context.Background(), "alice", chatID); err != nil || last != 2*turns {
+		t.Errorf("last seq is %d, %v, want %d", last, err, 2*turns)
+	}
+}
+
+func TestChatOfOthers(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := ts.register("alice"), ts.register("bob")
+	chatID := ts.createChat(alice, "tea")
+	ts.postMessage(alice, chatID, "hello")
+
+	ts.must(http.StatusNotFound, bob, "GET", "/me/chats/"+chatID, nil)
+	ts.must(http.StatusNotFound, bob, "GET", "/me/chats/"+chatID+"/messages", nil)
+	ts.must(http.StatusNotFound, bob, "POST", "/me/chats/"+chatID+"/messages", messageBody{Content: "hi"})
+	ts.must(http.StatusNotFound, bob, "PATCH", "/me/chats/"+chatID, chatBody{Name: "coffee"})
+	ts.must(http.StatusNotFound, bob, "DELETE", "/me/chats/"+chatID, nil)
+	if chats := decode[chatsResponse](t, ts.must(http.StatusOK, bob, "GET", "/me/chats", nil)).Chats; len(chats) != 0 {
+		t.Errorf("bob has %d chats, want none of alice's", len(chats))
+	}
+
+	chat := decode[internal.Chat](t, ts.must(http.StatusOK, alice, "GET", "/me/chats/"+chatID, nil))
+	if chat.Name != "tea" {
+		t.Errorf("chat is named %q after bob renamed it, want tea", chat.Name)
+	}
+	if msgs := decode[messagesResponse](t, ts.must(http.StatusOK, alice, "GET", "/me/chats/"+chatID+"/messages", nil)).Messages; len(msgs) != 2 {
+		t.Errorf("chat has %d messages after bob posted to it, want alice's 2", len(msgs))
+	}
+}
+
+func TestPostMyScrapOfOthers(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := ts.register("alice"), ts.register("bob")
+	chatID := ts.createChat(alice, "tea")
+	ts.postMessage(alice, chatID, "hello")
+
+	ts.must(http.StatusNotFound, bob, "POST", "/me/scraps", postScrapBody{ChatID: chatID, Seq: 2, ScrapbookIDs: []string{ts.defaultScrapbook(bob)}})
+	ts.must(http.StatusNotFound, alice, "POST", "/me/scraps", postScrapBody{ChatID: chatID, Seq: 2, ScrapbookIDs: []string{ts.defaultScrapbook(bob)}})
+	if scraps := decode[scrapsResponse](t, ts.must(http.StatusOK, alice, "GET", "/me/scraps", nil)).Scraps; len(scraps) != 0 {
+		t.Errorf("alice has %d scraps, want none", len(scraps))
+	}
+}
+
+func TestPostMyScrapNeedsScrapbook(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	ts.postMessage(alice, chatID, "hello")
+
+	ts.must(http.StatusBadRequest, alice, "POST", "/me/scraps", postScrapBody{ChatID: chatID, Seq: 2})
+	ts.must(http.StatusNotFound, alice, "POST", "/me/scraps", postScrapBody{ChatID: chatID, Seq: 3, ScrapbookIDs: []string{ts.defaultScrapbook(alice)}})
+}
+
+func TestDefaultScrapbookStays(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	scrapbookID := ts.defaultScrapbook(alice)
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		ts.must(http.StatusForbidden, alice, "DELETE", "/me/scrapbooks/"+scrapbookID, nil),
+		ts.must(http.StatusForbidden, alice, "PATCH", "/me/scrapbooks/"+scrapbookID, scrapbookBody{Name: "mine"}),
+	} {
+		if code := decode[errorResponse](t, rec).Code; code != apperror.CodeScrapbookDefaultImmutable {
+			t.Errorf("got %s, want %s", code, apperror.CodeScrapbookDefaultImmutable)
+		}
+	}
+	if id := ts.defaultScrapbook(alice); id != scrapbookID {
+		t.Errorf("default scrapbook is %s, want %s still", id, scrapbookID)
+	}
+}
+
+func TestDeleteMyScrapbookDeletesItsScraps(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	ts.postMessage(alice, chatID, "hello")
+	ts.postMessage(alice, chatID, "bye")
+	scrapbookID := ts.createScrapbook(alice, "recipes")
+	only := ts.createScrap(alice, chatID, 2, "only here", scrapbookID)
+	shared := ts.createScrap(alice, chatID, 4, "also in the default", scrapbookID, ts.defaultScrapbook(alice))
+
+	scraps := decode[scrapsResponse](t, ts.must(http.StatusOK, alice, "GET", "/me/scrapbooks/"+scrapbookID+"/scraps", nil)).Scraps
+	if len(scraps) != 2 {
+		t.Fatalf("scrapbook has %d scraps, want 2", len(scraps))
+	}
+	ts.must(http.StatusNoContent, alice, "DELETE", "/me/scrapbooks/"+scrapbookID, nil)
+
+	ts.must(http.StatusNotFound, alice, "GET", "/me/scrapbooks/"+scrapbookID, nil)
+	ts.must(http.StatusNotFound, alice, "GET", "/me/scraps/"+only.ID+"/scrapbooks", nil)
+	scrapbooks := decode[scrapbooksResponse](t, ts.must(http.StatusOK, alice, "GET", "/me/scraps/"+shared.ID+"/scrapbooks", nil)).Scrapbooks
+	if len(scrapbooks) != 1 || !scrapbooks[0].IsDefault {
+		t.Errorf("shared scrap is on %v, want the default scrapbook only", scrapbooks)
+	}
+}
+
+// downProvider is a completion api answering every call with 503.
+type downProvider struct{}
+
+func (downProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return openai.ChatCompletionResponse{}, &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}
+}
+
+func (downProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chatbot.Stream, error) {
+	return nil, &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}
+}
+
+func TestChatbotUnavailable(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	ts.sent.Provider = chatbot.NewResilient(downProvider{}, chatbot.ResilienceConfig{
+		MaxRetries:       1,
+		BaseBackoff:      time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		CallTimeout:      time.Second,
+		FailureThreshold: 2,
+		OpenDuration:     30 * time.Second,
+	})
+	path := "/me/chats/" + chatID + "/messages"
+
+	tests := []struct {
+		name       string
+		header     []string
+		retryAfter string
+	}{
+		{"retries run out", nil, "1"},
+		{"streamed", []string{"Accept", "text/event-stream"}, "1"},
+		// the circuit opened after the two failed calls
+		{"circuit open", nil, "30"},
+	}
+	for _, tt := range tests {
+		rec := ts.must(http.StatusServiceUnavailable, alice, "POST", path, messageBody{Content: "hello"}, tt.header...)
+		if code := decode[errorResponse](t, rec).Code; code != apperror.CodeChatbotUnavailable {
+			t.Errorf("%s: got %s, want %s", tt.name, code, apperror.CodeChatbotUnavailable)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: Retry-After is %q, want %q", tt.name, got, tt.retryAfter)
+		}
+	}
+	if msgs := decode[messagesResponse](t, ts.must(http.StatusOK, alice, "GET", path, nil)).Messages; len(msgs) != 0 {
+		t.Errorf("chat has %d messages, want none saved for the failed ones", len(msgs))
+	}
+}
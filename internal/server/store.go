@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/authz"
+)
+
+// Store is where the server keeps its data, postgres.DB in production and memory.DB in tests.
+// Implementations report what is missing or not allowed with the apperror codes of postgres.DB,
+// and delete what depends on a deleted row the way the cascades of devtools/db.sql do.
+type Store interface {
+	Users
+	RefreshTokens
+	Chats
+	Messages
+	Jobs
+	Generations
+	Scrapbooks
+	Scraps
+	Templates
+	Usages
+	ModerationAudits
+	IdempotentRequests
+	Searches
+	authz.Owners
+}
+
+type Users interface {
+	// Register adds the user with the credential and their default scrapbook.
+	Register(ctx context.Context, inp internal.RegisterInput) error
+	// SignIn returns the user the credential was registered by.
+	SignIn(ctx context.Context, credentialType, credentialID string) (string, error)
+	// Resign deletes the user with everything they own.
+	Resign(ctx context.Context, userID string) error
+}
+
+type RefreshTokens interface {
+	IsRefreshTokenExists(ctx context.Context, userID, tokenID string) (bool, error)
+	// UpsertRefreshToken replaces the refresh token of the user, who has one at most.
+	UpsertRefreshToken(ctx context.Context, userID, tokenID string) error
+	// Logout deletes the refresh token of the user.
+	Logout(ctx context.Context, userID string) error
+}
+
+type Chats interface {
+	SelectMyChats(ctx context.Context, userID string, page internal.Page) ([]internal.Chat, internal.Cursors, error)
+	SelectMyChat(ctx context.Context, userID, chatID string) (internal.Chat, error)
+	InsertChat(ctx context.Context, userID string, inp internal.Chat) error
+	PatchChat(ctx context.Context, userID string, inp internal.Chat) error
+	DeleteChat(ctx context.Context, userID, chatID string) error
+	CheckoutBranch(ctx context.Context, userID, chatID string, seq int) error
+	SelectChatSummaryBefore(ctx context.Context, userID, chatID string, seq int) (internal.ChatSummary, error)
+	InsertChatSummary(ctx context.Context, userID string, inp internal.ChatSummary) error
+}
+
+type Messages interface {
+	GetMyMessages(ctx context.Context, userID, chatID string, page internal.Page) ([]*internal.MessageWithScrap, internal.Cursors, error)
+	SelectMessagePath(ctx context.Context, userID, chatID string, seq int) ([]*internal.MessageWithScrap, error)
+	SelectLastSeq(ctx context.Context, userID, chatID string) (int, error)
+	AppendTurn(ctx context.Context, userID string, msgs ...*internal.Message) error
+	SelectMessageVersions(ctx context.Context, userID, chatID string, seq int) ([]internal.MessageVersion, error)
+	InsertMessageVersion(ctx context.Context, userID string, msg internal.Message) (internal.MessageVersion, error)
+	ActivateMessageVersion(ctx context.Context, userID, chatID string, seq, version int) error
+}
+
+type Jobs interface {
+	InsertMessageWithJob(ctx context.Context, userID string, msg *internal.Message, job *internal.Job) error
+	SelectJob(ctx context.Context, jobID string) (internal.Job, error)
+	SelectMyJob(ctx context.Context, userID, chatID, jobID string) (internal.Job, error)
+	SelectUnfinishedJob(ctx context.Context, chatID string, since time.Time) (internal.Job, error)
+	StartJob(ctx context.Context, jobID string) (bool, error)
+	FinishJob(ctx context.Context, jobID string, replySeq int) error
+	FailJob(ctx context.Context, jobID, reason string) error
+}
+
+type Generations interface {
+	InsertGeneration(ctx context.Context, generationID, chatID string, startedAt time.Time) error
+	FinishGeneration(ctx context.Context, generationID string) error
+	SelectGenerationCancelled(ctx context.Context, generationID string) (bool, error)
+	CancelGenerations(ctx context.Context, userID, chatID string, since time.Time) error
+}
+
+type Scrapbooks interface {
+	SelectMyScrapbooks(ctx context.Context, userID string, page internal.Page) ([]internal.Scrapbook, internal.Cursors, error)
+	SelectMyScrapbook(ctx context.Context, userID, scrapbookID string) (internal.Scrapbook, error)
+	InsertScrapbook(ctx context.Context, userID string, inp internal.Scrapbook) error
+	DeleteScrapbook(ctx context.Context, userID, scrapbookID string) error
+	PatchScrapbook(ctx context.Context, userID, scrapbookID, name string) error
+	SelectScrapsOnScrapbook(ctx context.Context, userID, scrapbookID string, page internal.Page) ([]internal.ScrapWithMessage, internal.Cursors, error)
+}
+
+type Scraps interface {
+	SelectMyScraps(ctx context.Context, userID string, page internal.Page) ([]internal.ScrapWithMessage, internal.Cursors, error)
+	SelectMyScrap(ctx context.Context, userID, scrapID string) (internal.ScrapWithMessage, error)
+	InsertScrap(ctx context.Context, userID string, scrap internal.Scrap, msg internal.Message, scrapbookIDs []string) error
+	PatchScrap(ctx context.Context, userID, scrapID, memo string) error
+	DeleteScrap(ctx context.Context, userID, scrapID string) error
+	SelectMyScrapbooksOnScrap(ctx context.Context, userID, scrapID string) ([]internal.Scrapbook, error)
+	InsertScrapOnScrapbook(ctx context.Context, userID, scrapID, scrapbookID string) error
+	DeleteScrapOnScrapbook(ctx context.Context, userID, scrapID, scrapbookID string) error
+}
+
+type Templates interface {
+	SelectMyTemplates(ctx context.Context, userID string) ([]internal.PromptTemplate, error)
+	SelectMyTemplate(ctx context.Context, userID, templateID string) (internal.PromptTemplate, error)
+	InsertTemplate(ctx context.Context, userID string, inp internal.PromptTemplate) error
+	PatchTemplate(ctx context.Context, userID string, inp internal.PromptTemplate) error
+	DeleteTemplate(ctx context.Context, userID, templateID string) error
+}
+
+type Usages interface {
+	// AddUsage adds the usage of calls that make no message, messages add theirs when they are appended.
+	AddUsage(ctx context.Context, userID string, at time.Time, usage internal.Usage) error
+	SelectUsageSince(ctx context.Context, userID string, since time.Time) (internal.Usage, error)
+}
+
+type ModerationAudits interface {
+	InsertModerationAudit(ctx context.Context, inp internal.ModerationAudit) error
+}
+
+type IdempotentRequests interface {
+	ClaimIdempotentRequest(ctx context.Context, req internal.IdempotentRequest, staleBefore time.Time) (internal.IdempotentRequest, bool, error)
+	FinishIdempotentRequest(ctx context.Context, req internal.IdempotentRequest) error
+	ReleaseIdempotentRequest(ctx context.Context, userID, key string) error
+}
+
+// Searches are the keyword and semantic searches, with the embeddings the latter ranks by.
+type Searches interface {
+	SearchMine(ctx context.Context, userID, query string, filter internal.SearchFilter, limit, offset int) ([]internal.SearchResult, error)
+	UpsertMessageEmbedding(ctx context.Context, chatID string, seq int, model string, vector []float32) error
+	UpsertScrapEmbedding(ctx context.Context, scrapID, model string, vector []float32) error
+	SearchMyMessagesByEmbedding(ctx context.Context, userID, model string, vector []float32, limit int) ([]internal.SearchResult, error)
+	SearchMyScrapsByEmbedding(ctx context.Context, userID, model string, vector []float32, limit int) ([]internal.SearchResult, error)
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"github.com/evergarden0412/gptea-api/internal/memory"
+	"github.com/evergarden0412/gptea-api/internal/postgres"
+)
+
+// Store is kept in the types of internal, so the server builds on neither of them
+var (
+	_ Store = (*postgres.DB)(nil)
+	_ Store = (*memory.DB)(nil)
+)
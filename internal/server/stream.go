@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// persistTimeout bounds the writes done after a stream ended.
+// They run on a fresh context because the request context is cancelled when the client disconnects.
+const persistTimeout = 5 * time.Second
+
+// contextKeyStreamFailed marks a stream that ended with an "error" event, which idempotent can't tell from the status,
+// 200 having been sent with the first event.
+const contextKeyStreamFailed = "streamFailed"
+
+type deltaEvent struct {
+	Content string `json:"content"`
+}
+
+// retractEvent tells the client to take down the reply streamed so far, the "done" event after it brings what replaces it.
+type retractEvent struct {
+	Reason string `json:"reason" example:"content_filter"`
+}
+
+func wantsEventStream(ctx *gin.Context) bool {
+	return strings.Contains(ctx.GetHeader("Accept"), "text/event-stream")
+}
+
+// streamMyMessage answers handlePostMyMessage and handleEditMyMessage with server-sent events.
+// It sends a "delta" event for every piece of the reply, then a "done" event with the whole reply and its citations,
+// or an "error" event if generation failed. The messages are persisted once the stream ends.
+// If the client disconnected or the user cancelled, the message is persisted all the same,
+// with what there is of the reply, maybe nothing, as a reply with finishReason "cancelled".
+// Only a generation that failed before anything was streamed persists nothing, so it can be retried.
+// Tool calls are run in between without events, only the reply is streamed.
+// The reply is moderated once it is complete, so a reply moderation withholds has been streamed by then.
+// A "retract" event tells the client to take it down, and the "done" event carries the reply as stored, which replaces it.
+// Buffering the reply until it passed moderation would be safer, but would take streaming away.
+func (s *Server) streamMyMessage(ctx *gin.Context, userID string, conv chatbot.Conversation, content, templateID string) {
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+
+	genCtx, done := s.trackGeneration(ctx.Request.Context(), conv.Chat.ID)
+	inMsg, outMsgs, streamErr := s.c.StreamChat(genCtx, conv, content, func(delta string) error {
+		ctx.SSEvent("delta", deltaEvent{Content: delta})
+		ctx.Writer.Flush()
+		return nil
+	})
+	interrupted := generationCancelled(genCtx) || ctx.Request.Context().Err() != nil
+	done()
+	if streamErr != nil {
+		golog.Error("handlePostMyMessage: stream chat: ", streamErr)
+	}
+	if interrupted {
+		// the user stopped the reply or went away, what there is of it is kept as the reply
+		streamErr = nil
+		outMsgs = markCancelled(inMsg, outMsgs)
+	}
+	if len(outMsgs) == 0 {
+		if streamErr != nil && !ctx.Writer.Written() {
+			// nothing was streamed yet, so the error can still go out with its status
+			respondChatbotError(ctx, streamErr)
+			return
+		}
+		if streamErr != nil {
+			sendErrorEvent(ctx, chatbotError(streamErr))
+		}
+		return
+	}
+
+	inMsg.TemplateID = templateID
+	persistCtx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	verdicts := s.moderateOutput(persistCtx, apperror.Lang(ctx.GetHeader("Accept-Language")), outMsgs...)
+	if err := s.insertMessages(persistCtx, userID, inMsg, outMsgs...); err != nil {
+		golog.Error("handlePostMyMessage: insert messages: ", err)
+		sendErrorEvent(ctx, err)
+		return
+	}
+	s.auditOutput(persistCtx, userID, verdicts)
+	if withheld(verdicts) {
+		ctx.SSEvent("retract", retractEvent{Reason: "content_filter"})
+		ctx.Writer.Flush()
+	}
+
+	if streamErr != nil {
+		sendErrorEvent(ctx, chatbotError(streamErr))
+		return
+	}
+	outMsg := outMsgs[len(outMsgs)-1]
+	ctx.SSEvent("done", newReplyResponse(outMsg))
+	ctx.Writer.Flush()
+	// the reply is out, so naming the chat only holds back the end of the stream
+	s.autoTitle(persistCtx, userID, conv.Chat, inMsg, outMsg)
+}
+
+// sendErrorEvent ends the stream with an "error" event of err, marking it failed with contextKeyStreamFailed.
+func sendErrorEvent(ctx *gin.Context, err error) {
+	_, resp := newErrorResponse(ctx, err)
+	ctx.SSEvent("error", resp)
+	ctx.Writer.Flush()
+	ctx.Set(contextKeyStreamFailed, true)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// loadConversation loads what the chatbot needs to answer content in chat.
+// Messages that no longer fit into the context window are folded into the summary of the chat first.
+// If the chat uses scraps, the ones relevant to content are retrieved for the chatbot to cite.
+func (s *Server) loadConversation(ctx context.Context, userID string, chat internal.Chat, content string) (chatbot.Conversation, error) {
+	history, err := s.db.SelectMessagePath(ctx, userID, chat.ID, chat.HeadSeq)
+	if err != nil {
+		return chatbot.Conversation{}, err
+	}
+	lastSeq, err := s.db.SelectLastSeq(ctx, userID, chat.ID)
+	if err != nil {
+		return chatbot.Conversation{}, err
+	}
+	conv := chatbot.Conversation{Chat: chat, UserID: userID, History: chronological(history), LastSeq: lastSeq}
+	conv.References = s.retrieveScraps(ctx, userID, chat, content)
+
+	summary, err := s.db.SelectChatSummaryBefore(ctx, userID, chat.ID, chat.HeadSeq+1)
+	if err != nil && err != sql.ErrNoRows {
+		return chatbot.Conversation{}, err
+	}
+	if err == nil && onPath(history, summary.LastSeq) {
+		conv.Summary = &summary
+	}
+
+	newSummary, usage, err := s.c.Summarize(ctx, conv, content)
+	s.addUsage(ctx, userID, usage)
+	if err != nil {
+		return chatbot.Conversation{}, err
+	}
+	if newSummary != nil {
+		if err := s.db.InsertChatSummary(ctx, userID, *newSummary); err != nil {
+			return chatbot.Conversation{}, err
+		}
+		conv.Summary = newSummary
+	}
+	return conv, nil
+}
+
+// chronological returns branch, which the db returns newest first, oldest first as chatbot.Conversation takes it.
+func chronological(branch []*internal.MessageWithScrap) []*internal.MessageWithScrap {
+	res := make([]*internal.MessageWithScrap, len(branch))
+	for i, msg := range branch {
+		res[len(branch)-1-i] = msg
+	}
+	return res
+}
+
+// onPath reports whether the message seq is on the branch.
+// A summary made on another branch doesn't apply.
+func onPath(branch []*internal.MessageWithScrap, seq int) bool {
+	for _, msg := range branch {
+		if msg.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetMyChatSummary godoc
+// @summary Get my chat summary
+// @description Get the running summary of the earlier messages on the active branch of my chat, which is sent to the chatbot in place of them
+// @tags chats
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @success 200 {object} internal.ChatSummary
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/chats/{chatID}/summary [get]
+func (s *Server) handleGetMyChatSummary(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+
+	chat, err := s.db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		golog.Error("handleGetMyChatSummary: select chat: ", err)
+		respondError(ctx, err)
+		return
+	}
+	branch, err := s.db.SelectMessagePath(ctx, userID, chatID, chat.HeadSeq)
+	if err != nil {
+		golog.Error("handleGetMyChatSummary: select message path: ", err)
+		respondError(ctx, err)
+		return
+	}
+	summary, err := s.db.SelectChatSummaryBefore(ctx, userID, chatID, chat.HeadSeq+1)
+	if err == nil && !onPath(branch, summary.LastSeq) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		err = apperror.Wrap(apperror.CodeSummaryNotFound, err)
+	}
+	if err != nil {
+		golog.Error("handleGetMyChatSummary: select chat summary: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, summary)
+}
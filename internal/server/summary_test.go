@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestChronological(t *testing.T) {
+	// a branch the way SelectMessagePath returns it, from its leaf up
+	branch := []*internal.MessageWithScrap{{Seq: 5, ParentSeq: 2}, {Seq: 2, ParentSeq: 1}, {Seq: 1}}
+
+	res := chronological(branch)
+	want := []int{1, 2, 5}
+	if len(res) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(res), len(want))
+	}
+	for i := range want {
+		if res[i].Seq != want[i] {
+			t.Errorf("message %d is seq %d, want %d", i, res[i].Seq, want[i])
+		}
+	}
+}
+
+func TestHistorySentOldestFirst(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.register("alice")
+	chatID := ts.createChat(alice, "tea")
+	ts.bot.Script("a1", "a2")
+	ts.postMessage(alice, chatID, "u1")
+	ts.postMessage(alice, chatID, "u2")
+	ts.postMessage(alice, chatID, "u3")
+
+	var sent []string
+	for _, msg := range ts.sent.last().Messages {
+		if msg.Role != openai.ChatMessageRoleSystem {
+			sent = append(sent, msg.Content)
+		}
+	}
+	want := []string{"u1", "a1", "u2", "a2", "u3"}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %q, want %q", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("message %d is %q, want %q", i, sent[i], want[i])
+		}
+	}
+}
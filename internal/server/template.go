@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+var errContentOrTemplate = apperror.New(apperror.CodeMessageContentOrTemplate)
+
+type templatesResponse struct {
+	Templates []internal.PromptTemplate `json:"templates"`
+}
+
+type templateBody struct {
+	Name      string                      `json:"name" example:"퀴즈 만들기"`
+	Content   string                      `json:"content" example:"{{topic}}에 대한 퀴즈 문제 {{count}}개를 만들어 줘."`
+	Variables []internal.TemplateVariable `json:"variables"`
+}
+
+type missingVariablesResponse struct {
+	errorResponse
+	Missing []string `json:"missing" example:"topic"`
+}
+
+// template returns the built-in template or the template of the user with templateID.
+func (s *Server) template(ctx context.Context, userID, templateID string) (internal.PromptTemplate, error) {
+	if template, ok := internal.BuiltInTemplate(templateID); ok {
+		return template, nil
+	}
+	return s.db.SelectMyTemplate(ctx, userID, templateID)
+}
+
+// renderMessage returns the content of the message in body, rendering its template if it has one,
+// and responds with the error and reports false if it can't.
+func (s *Server) renderMessage(ctx *gin.Context, userID string, body messageBody) (string, bool) {
+	if (body.Content == "") == (body.TemplateID == "") {
+		golog.Error("renderMessage: ", errContentOrTemplate)
+		respondError(ctx, errContentOrTemplate)
+		return "", false
+	}
+	if body.TemplateID == "" {
+		return body.Content, true
+	}
+	template, err := s.template(ctx, userID, body.TemplateID)
+	if err != nil {
+		golog.Error("renderMessage: select template: ", err)
+		respondError(ctx, err)
+		return "", false
+	}
+	content, err := template.Render(body.Variables)
+	if err != nil {
+		golog.Error("renderMessage: render: ", err)
+		var missing *internal.MissingVariablesError
+		if errors.As(err, &missing) {
+			status, resp := newErrorResponse(ctx, apperror.Wrap(apperror.CodeTemplateVariablesMissing, err))
+			ctx.JSON(status, missingVariablesResponse{errorResponse: resp, Missing: missing.Names})
+		} else {
+			respondError(ctx, apperror.Invalid(err))
+		}
+		return "", false
+	}
+	return content, true
+}
+
+// handleGetMyTemplates godoc
+// @summary Get my templates
+// @description Get the built-in prompt templates followed by mine.
+// @tags templates
+// @security AccessTokenAuth
+// @success 200 {object} templatesResponse
+// @failure 401 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/templates [get]
+func (s *Server) handleGetMyTemplates(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+
+	templates, err := s.db.SelectMyTemplates(ctx, userID)
+	if err != nil {
+		golog.Error("handleGetMyTemplates: select my templates: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, templatesResponse{Templates: append(append([]internal.PromptTemplate{}, internal.BuiltInTemplates...), templates...)})
+}
+
+// handleGetMyTemplate godoc
+// @summary Get my template
+// @description Get a built-in prompt template or one of mine.
+// @tags templates
+// @security AccessTokenAuth
+// @param templateID path string true "templateID"
+// @success 200 {object} internal.PromptTemplate
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/templates/{templateID} [get]
+func (s *Server) handleGetMyTemplate(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	templateID := ctx.Param("templateID")
+
+	template, err := s.template(ctx, userID, templateID)
+	if err != nil {
+		golog.Error("handleGetMyTemplate: select template: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, template)
+}
+
+// handlePostMyTemplate godoc
+// @summary Post my template
+// @description Save a prompt template. Its content refers to variables as `{{name}}`, every one of them must be declared.
+// @description A required variable must be given when posting a message with the template,
+// @description an optional one not given is replaced with its default.
+// @tags templates
+// @security AccessTokenAuth
+// @param body body templateBody true "body"
+// @success 201 {object} internal.PromptTemplate
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/templates [post]
+func (s *Server) handlePostMyTemplate(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	var body templateBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		golog.Error("handlePostMyTemplate: bind json: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+	template := internal.PromptTemplate{
+		Name:      body.Name,
+		Content:   body.Content,
+		Variables: body.Variables,
+	}
+	if err := template.Validate(); err != nil {
+		golog.Error("handlePostMyTemplate: validate: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+	if err := template.Assign(); err != nil {
+		golog.Error("handlePostMyTemplate: assign: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	if err := s.db.InsertTemplate(ctx, userID, template); err != nil {
+		golog.Error("handlePostMyTemplate: insert template: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, template)
+}
+
+// handlePatchMyTemplate godoc
+// @summary Patch my template
+// @description Replace the name, content and variables of my prompt template. Built-in templates can't be changed.
+// @tags templates
+// @security AccessTokenAuth
+// @param templateID path string true "templateID"
+// @param body body templateBody true "body"
+// @success 204
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 403 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/templates/{templateID} [patch]
+func (s *Server) handlePatchMyTemplate(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	templateID := ctx.Param("templateID")
+	var body templateBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		golog.Error("handlePatchMyTemplate: bind json: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+	template := internal.PromptTemplate{
+		ID:        templateID,
+		Name:      body.Name,
+		Content:   body.Content,
+		Variables: body.Variables,
+	}
+	if err := template.Validate(); err != nil {
+		golog.Error("handlePatchMyTemplate: validate: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	if err := s.db.PatchTemplate(ctx, userID, template); err != nil {
+		golog.Error("handlePatchMyTemplate: patch template: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// handleDeleteMyTemplate godoc
+// @summary Delete my template
+// @description Delete my prompt template. Messages posted with it keep its ID. Built-in templates can't be deleted.
+// @tags templates
+// @security AccessTokenAuth
+// @param templateID path string true "templateID"
+// @success 204
+// @failure 401 {object} errorResponse
+// @failure 403 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/templates/{templateID} [delete]
+func (s *Server) handleDeleteMyTemplate(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	templateID := ctx.Param("templateID")
+
+	if err := s.db.DeleteTemplate(ctx, userID, templateID); err != nil {
+		golog.Error("handleDeleteMyTemplate: delete template: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// titleTimeout bounds naming a chat after its first reply, which holds back the response by as much.
+const titleTimeout = 3 * time.Second
+
+var errNoExchange = apperror.New(apperror.CodeChatHasNoReply)
+
+// autoTitle names the chat after its first exchange, in with the reply out, unless the user named it.
+// A failure only leaves the chat unnamed, so it is logged and not returned.
+// Handlers run it before responding, on lambda nothing runs once the response is out.
+func (s *Server) autoTitle(ctx context.Context, userID string, chat internal.Chat, in, out *internal.Message) {
+	if chat.Name != "" || in.ParentSeq != 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, titleTimeout)
+	defer cancel()
+	title, usage, err := s.c.GenerateTitle(ctx, in.Content, out.Content)
+	if err != nil {
+		golog.Error("autoTitle: generate title: ", err)
+		return
+	}
+	s.addUsage(ctx, userID, usage)
+	// the user may have named the chat while the reply was generated
+	chat, err = s.db.SelectMyChat(ctx, userID, chat.ID)
+	if err != nil {
+		golog.Error("autoTitle: select chat: ", err)
+		return
+	}
+	if chat.Name != "" || title == "" {
+		return
+	}
+	if err := s.db.PatchChat(ctx, userID, internal.Chat{ID: chat.ID, Name: title}); err != nil {
+		golog.Error("autoTitle: patch chat: ", err)
+	}
+}
+
+type titleResponse struct {
+	Name string `json:"name" example:"Brewing green tea"`
+}
+
+// customMethod lets through only the path ending in the custom method :name, like title:generate.
+// gin reads :name after its static prefix as a param, which holds the custom method itself
+// but also matches any other end of the segment, like titlexyz.
+func customMethod(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Param(name) != ":"+name {
+			respondError(ctx, apperror.New(apperror.CodeNotFound))
+		}
+	}
+}
+
+// handleGenerateMyChatTitle godoc
+// @summary Generate my chat title
+// @description Name my chat after the first exchange of its active branch, replacing its current name.
+// @description Chats are named this way after their first reply unless they already have a name.
+// @tags chats
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @success 200 {object} titleResponse
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @failure 503 {object} errorResponse
+// @router /me/chats/{chatID}/title:generate [post]
+func (s *Server) handleGenerateMyChatTitle(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+
+	branch, _, err := s.db.GetMyMessages(ctx, userID, chatID, internal.Page{})
+	if err != nil {
+		golog.Error("handleGenerateMyChatTitle: get messages: ", err)
+		respondError(ctx, err)
+		return
+	}
+	// the branch is newest first, so the first exchange is at its end, maybe with tool calls in between
+	var in, out *internal.MessageWithScrap
+	for i := len(branch) - 1; i >= 0 && out == nil; i-- {
+		switch {
+		case in == nil:
+			in = branch[i]
+		case branch[i].Role == chatbot.GetAssistantMessageRole():
+			out = branch[i]
+		}
+	}
+	if out == nil {
+		golog.Error("handleGenerateMyChatTitle: ", errNoExchange)
+		respondError(ctx, errNoExchange)
+		return
+	}
+
+	title, usage, err := s.c.GenerateTitle(ctx, in.Content, out.Content)
+	if err != nil {
+		golog.Error("handleGenerateMyChatTitle: generate title: ", err)
+		respondChatbotError(ctx, err)
+		return
+	}
+	s.addUsage(ctx, userID, usage)
+	if err := s.db.PatchChat(ctx, userID, internal.Chat{ID: chatID, Name: title}); err != nil {
+		golog.Error("handleGenerateMyChatTitle: patch chat: ", err)
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, titleResponse{Name: title})
+}
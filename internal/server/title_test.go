@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/evergarden0412/gptea-api/internal"
+)
+
+func TestAutoTitleBeforeResponse(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.register("alice")
+	ts.must(http.StatusCreated, token, "POST", "/me/chats", chatBody{})
+	chats := decode[chatsResponse](t, ts.must(http.StatusOK, token, "GET", "/me/chats", nil))
+	chatID := chats.Chats[0].ID
+
+	ts.bot.Script("Steep it at 80°C.", `"Brewing green tea."`)
+	ts.postMessage(token, chatID, "How do I brew green tea?")
+
+	// the name is there as soon as the reply is, nothing is left running after the response
+	chat := decode[internal.Chat](t, ts.must(http.StatusOK, token, "GET", "/me/chats/"+chatID, nil))
+	if chat.Name != "Brewing green tea" {
+		t.Errorf("name = %q, want %q", chat.Name, "Brewing green tea")
+	}
+}
+
+func TestGenerateMyChatTitle(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.register("alice")
+	chatID := ts.createChat(token, "tea")
+	ts.postMessage(token, chatID, "How do I brew green tea?")
+
+	ts.bot.Script("Brewing green tea")
+	title := decode[titleResponse](t, ts.must(http.StatusOK, token, "POST", "/me/chats/"+chatID+"/title:generate", nil))
+	if title.Name != "Brewing green tea" {
+		t.Errorf("title = %q, want %q", title.Name, "Brewing green tea")
+	}
+	chat := decode[internal.Chat](t, ts.must(http.StatusOK, token, "GET", "/me/chats/"+chatID, nil))
+	if chat.Name != title.Name {
+		t.Errorf("name = %q, want %q", chat.Name, title.Name)
+	}
+
+	for _, path := range []string{"/title", "/titlegenerate", "/title:regenerate"} {
+		ts.must(http.StatusNotFound, token, "POST", "/me/chats/"+chatID+path, nil)
+	}
+}
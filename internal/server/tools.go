@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	_ "time/tzdata" // for current_time, lambda has no zoneinfo
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/kataras/golog"
+	"github.com/sashabaranov/go-openai"
+)
+
+// maxToolScraps is the most scraps search_scraps returns, newest first.
+const maxToolScraps = 10
+
+var errNoQuery = apperror.Invalid(errors.New("query is required"))
+
+// Tools returns the tools the chatbot may call on the data of the user it answers.
+func (s *Server) Tools() []chatbot.Tool {
+	tools := []chatbot.Tool{
+		{
+			Definition: openai.FunctionDefinition{
+				Name:        "search_scraps",
+				Description: "Search the scraps of the user, saved messages with a memo, by words in the memo or the message.",
+				Parameters: json.RawMessage(`{
+					"type": "object",
+					"properties": {"query": {"type": "string", "description": "words to look for"}},
+					"required": ["query"]
+				}`),
+			},
+			Run: s.toolSearchScraps,
+		},
+		{
+			Definition: openai.FunctionDefinition{
+				Name:        "list_scrapbooks",
+				Description: "List the scrapbooks of the user, which scraps are filed in.",
+				Parameters:  json.RawMessage(`{"type": "object", "properties": {}}`),
+			},
+			Run: s.toolListScrapbooks,
+		},
+		{
+			Definition: openai.FunctionDefinition{
+				Name:        "create_scrap",
+				Description: "Scrap a message of the current chat with a memo, so that the user finds it later.",
+				Parameters: json.RawMessage(`{
+					"type": "object",
+					"properties": {
+						"seq": {"type": "integer", "description": "seq of the message in the current chat"},
+						"memo": {"type": "string", "description": "memo to save with the message"},
+						"scrapbookIDs": {"type": "array", "items": {"type": "string"}, "description": "scrapbooks to file the scrap in, the default scrapbook if omitted"}
+					},
+					"required": ["seq", "memo"]
+				}`),
+			},
+			Run: s.toolCreateScrap,
+		},
+		{
+			Definition: openai.FunctionDefinition{
+				Name:        "current_time",
+				Description: "Get the current date and time.",
+				Parameters: json.RawMessage(`{
+					"type": "object",
+					"properties": {"timezone": {"type": "string", "description": "IANA time zone, e.g. Asia/Seoul, UTC if omitted"}}
+				}`),
+			},
+			Run: toolCurrentTime,
+		},
+	}
+	for i := range tools {
+		tools[i].Run = stableToolErrors(tools[i].Definition.Name, tools[i].Run)
+	}
+	return tools
+}
+
+// stableToolErrors makes run, the tool name, fail with the english message of the code of its error, and the detail if there is one,
+// like clients get them. The error itself may be database text, which is not for the model to tell the user.
+func stableToolErrors(name string, run func(context.Context, chatbot.ToolCall) (string, error)) func(context.Context, chatbot.ToolCall) (string, error) {
+	return func(ctx context.Context, call chatbot.ToolCall) (string, error) {
+		res, err := run(ctx, call)
+		if err != nil {
+			golog.Error("tool ", name, ": ", err)
+			msg := apperror.Message(apperror.CodeOf(err), apperror.LangEnglish)
+			if detail := apperror.DetailOf(err); detail != "" {
+				msg += " " + detail
+			}
+			return "", errors.New(msg)
+		}
+		return res, nil
+	}
+}
+
+func (s *Server) toolSearchScraps(ctx context.Context, call chatbot.ToolCall) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+		return "", apperror.Invalid(err)
+	}
+	query := strings.ToLower(strings.TrimSpace(args.Query))
+	if query == "" {
+		return "", errNoQuery
+	}
+
+	scraps, _, err := s.db.SelectMyScraps(ctx, call.UserID, internal.Page{})
+	if err != nil {
+		return "", err
+	}
+	found := []internal.ScrapWithMessage{}
+	for _, scrap := range scraps {
+		if len(found) == maxToolScraps {
+			break
+		}
+		if strings.Contains(strings.ToLower(scrap.Memo), query) ||
+			scrap.Message != nil && strings.Contains(strings.ToLower(scrap.Message.Content), query) {
+			found = append(found, scrap)
+		}
+	}
+	res, err := json.Marshal(found)
+	return string(res), err
+}
+
+func (s *Server) toolListScrapbooks(ctx context.Context, call chatbot.ToolCall) (string, error) {
+	scrapbooks, _, err := s.db.SelectMyScrapbooks(ctx, call.UserID, internal.Page{})
+	if err != nil {
+		return "", err
+	}
+	res, err := json.Marshal(scrapbooks)
+	return string(res), err
+}
+
+func (s *Server) toolCreateScrap(ctx context.Context, call chatbot.ToolCall) (string, error) {
+	var args struct {
+		Seq          int      `json:"seq"`
+		Memo         string   `json:"memo"`
+		ScrapbookIDs []string `json:"scrapbookIDs"`
+	}
+	if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+		return "", apperror.Invalid(err)
+	}
+
+	if len(args.ScrapbookIDs) == 0 {
+		scrapbookID, err := s.defaultScrapbookID(ctx, call.UserID)
+		if err != nil {
+			return "", err
+		}
+		args.ScrapbookIDs = []string{scrapbookID}
+	}
+
+	scrap := internal.Scrap{
+		Memo: args.Memo,
+	}
+	if err := scrap.Assign(); err != nil {
+		return "", err
+	}
+	// InsertScrap checks that the chat belongs to the user
+	msg := internal.Message{
+		ChatID: call.ChatID,
+		Seq:    args.Seq,
+	}
+	if err := s.db.InsertScrap(ctx, call.UserID, scrap, msg, args.ScrapbookIDs); err != nil {
+		return "", err
+	}
+	s.embedScrap(ctx, call.UserID, scrap.ID)
+	res, err := json.Marshal(scrap)
+	return string(res), err
+}
+
+// defaultScrapbookID returns the ID of the default scrapbook of the user, which every user has from registering.
+func (s *Server) defaultScrapbookID(ctx context.Context, userID string) (string, error) {
+	scrapbooks, _, err := s.db.SelectMyScrapbooks(ctx, userID, internal.Page{})
+	if err != nil {
+		return "", err
+	}
+	for _, scrapbook := range scrapbooks {
+		if scrapbook.IsDefault {
+			return scrapbook.ID, nil
+		}
+	}
+	return "", apperror.New(apperror.CodeScrapbookNotFound)
+}
+
+func toolCurrentTime(ctx context.Context, call chatbot.ToolCall) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if call.Arguments != "" {
+		if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+			return "", apperror.Invalid(err)
+		}
+	}
+	loc := time.UTC
+	if args.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(args.Timezone); err != nil {
+			return "", apperror.Invalid(err)
+		}
+	}
+	return time.Now().In(loc).Format(time.RFC1123Z), nil
+}
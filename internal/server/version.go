@@ -0,0 +1,205 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/evergarden0412/gptea-api/internal"
+	"github.com/evergarden0412/gptea-api/internal/apperror"
+	"github.com/evergarden0412/gptea-api/internal/chatbot"
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+var (
+	errMessageNotFound = apperror.New(apperror.CodeMessageNotFound)
+	errNotRegenerable  = apperror.New(apperror.CodeMessageNotRegenerable)
+)
+
+// handleRegenerateMyMessage godoc
+// @summary Regenerate a reply
+// @description Answer the user message or tool result the reply at seq follows again, with the history up to it.
+// @description The new answer is saved as the next version of the reply and becomes its active version.
+// @tags messages
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @param seq path int true "seq of the reply"
+// @success 201 {object} internal.MessageVersion
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 409 {object} errorResponse
+// @failure 429 {object} quotaExceededResponse
+// @failure 500 {object} errorResponse
+// @failure 503 {object} errorResponse
+// @router /me/chats/{chatID}/messages/{seq}/regenerate [post]
+func (s *Server) handleRegenerateMyMessage(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+	seq, err := strconv.Atoi(ctx.Param("seq"))
+	if err != nil {
+		golog.Error("handleRegenerateMyMessage: parse seq: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	chat, err := s.db.SelectMyChat(ctx, userID, chatID)
+	if err != nil {
+		golog.Error("handleRegenerateMyMessage: select chat: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if !s.ensureNoUnfinishedJob(ctx, chatID) {
+		return
+	}
+	if !s.enforceQuota(ctx, userID) {
+		return
+	}
+	// the branch ending at the reply, newest first
+	branch, err := s.db.SelectMessagePath(ctx, userID, chatID, seq)
+	if err != nil {
+		golog.Error("handleRegenerateMyMessage: select message path: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if len(branch) == 0 {
+		golog.Error("handleRegenerateMyMessage: ", errMessageNotFound)
+		respondError(ctx, errMessageNotFound)
+		return
+	}
+	if len(branch) < 2 || branch[0].Role != chatbot.GetAssistantMessageRole() ||
+		branch[1].Role != chatbot.GetUserMessageRole() && branch[1].Role != chatbot.GetFunctionMessageRole() {
+		golog.Error("handleRegenerateMyMessage: ", errNotRegenerable)
+		respondError(ctx, errNotRegenerable)
+		return
+	}
+	prompt, before := branch[1], branch[2:]
+
+	conv := chatbot.Conversation{Chat: chat, UserID: userID, History: chronological(before)}
+	summary, err := s.db.SelectChatSummaryBefore(ctx, userID, chatID, prompt.Seq)
+	if err != nil && err != sql.ErrNoRows {
+		golog.Error("handleRegenerateMyMessage: select chat summary: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if err == nil && onPath(before, summary.LastSeq) {
+		conv.Summary = &summary
+	}
+	if prompt.Role == chatbot.GetUserMessageRole() {
+		conv.References = s.retrieveScraps(ctx, userID, chat, prompt.Content)
+	}
+	outMsg, err := s.c.Regenerate(ctx, conv, &internal.Message{
+		ChatID:    prompt.ChatID,
+		Seq:       prompt.Seq,
+		ParentSeq: prompt.ParentSeq,
+		Content:   prompt.Content,
+		Role:      prompt.Role,
+		Name:      prompt.Name,
+		CreatedAt: prompt.CreatedAt,
+	})
+	if err != nil {
+		golog.Error("handleRegenerateMyMessage: regenerate: ", err)
+		respondChatbotError(ctx, err)
+		return
+	}
+	// replies on other branches took the seqs after the prompt, the new version goes to the reply itself
+	outMsg.Seq = seq
+	verdicts := s.moderateOutput(ctx, apperror.Lang(ctx.GetHeader("Accept-Language")), outMsg)
+	version, err := s.db.InsertMessageVersion(ctx, userID, *outMsg)
+	if err != nil {
+		golog.Error("handleRegenerateMyMessage: insert message version: ", err)
+		respondError(ctx, err)
+		return
+	}
+	s.auditOutput(ctx, userID, verdicts)
+	s.embedMessages(ctx, outMsg)
+
+	ctx.JSON(http.StatusCreated, version)
+}
+
+type messageVersionsResponse struct {
+	Versions []internal.MessageVersion `json:"versions"`
+}
+
+// handleGetMyMessageVersions godoc
+// @summary Get the versions of my message
+// @description Get every version of the message in ascending order, the message itself carries the active one
+// @tags messages
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @param seq path int true "seq"
+// @success 200 {object} messageVersionsResponse
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/chats/{chatID}/messages/{seq}/versions [get]
+func (s *Server) handleGetMyMessageVersions(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+	seq, err := strconv.Atoi(ctx.Param("seq"))
+	if err != nil {
+		golog.Error("handleGetMyMessageVersions: parse seq: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	versions, err := s.db.SelectMessageVersions(ctx, userID, chatID, seq)
+	if err != nil {
+		golog.Error("handleGetMyMessageVersions: select message versions: ", err)
+		respondError(ctx, err)
+		return
+	}
+	if len(versions) == 0 {
+		golog.Error("handleGetMyMessageVersions: ", errMessageNotFound)
+		respondError(ctx, errMessageNotFound)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, messageVersionsResponse{Versions: versions})
+}
+
+type patchMessageBody struct {
+	Version int `json:"version" binding:"required,min=1" example:"2"`
+}
+
+// handlePatchMyMessage godoc
+// @summary Patch my message
+// @description Pick the active version of my message, which is shown and sent to the chatbot from now on
+// @tags messages
+// @security AccessTokenAuth
+// @param chatID path string true "chatID"
+// @param seq path int true "seq"
+// @param body body patchMessageBody true "body"
+// @success 204
+// @failure 400 {object} errorResponse
+// @failure 401 {object} errorResponse
+// @failure 404 {object} errorResponse
+// @failure 500 {object} errorResponse
+// @router /me/chats/{chatID}/messages/{seq} [patch]
+func (s *Server) handlePatchMyMessage(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	chatID := ctx.Param("chatID")
+	seq, err := strconv.Atoi(ctx.Param("seq"))
+	if err != nil {
+		golog.Error("handlePatchMyMessage: parse seq: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+	var body patchMessageBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		golog.Error("handlePatchMyMessage: bind json: ", err)
+		respondError(ctx, apperror.Invalid(err))
+		return
+	}
+
+	if err := s.db.ActivateMessageVersion(ctx, userID, chatID, seq, body.Version); err != nil {
+		golog.Error("handlePatchMyMessage: activate message version: ", err)
+		respondError(ctx, err)
+		return
+	}
+	s.embedMessage(ctx, userID, chatID, seq)
+
+	ctx.Status(http.StatusNoContent)
+}
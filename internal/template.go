@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PromptTemplate is a message with {{variable}} placeholders, filled in when a message is posted with it.
+// Templates belong to a user, except for BuiltInTemplates which every user has.
+type PromptTemplate struct {
+	ID        string             `json:"id" example:"Hjejwerhj"`
+	Name      string             `json:"name" example:"퀴즈 만들기"`
+	Content   string             `json:"content" example:"{{topic}}에 대한 퀴즈 문제 {{count}}개를 만들어 줘."`
+	Variables []TemplateVariable `json:"variables"`
+	IsBuiltIn bool               `json:"isBuiltIn" example:"false"`
+	CreatedAt time.Time          `json:"createdAt" example:"2021-01-01T00:00:00Z"`
+}
+
+type TemplateVariable struct {
+	Name     string `json:"name" example:"count"`
+	Required bool   `json:"required" example:"false"`
+	// Default fills in an optional variable that is not given
+	Default string `json:"default,omitempty" example:"5"`
+}
+
+var (
+	ErrTemplateNameRequired    = errors.New("name is required")
+	ErrTemplateContentRequired = errors.New("content is required")
+	ErrBadVariableName         = errors.New("variable names must be letters, digits and underscores, not starting with a digit")
+	ErrDuplicateVariable       = errors.New("variable is declared twice")
+	ErrUndeclaredVariable      = errors.New("content uses a variable that is not declared")
+)
+
+// MissingVariablesError is returned by Render when required variables are not given.
+type MissingVariablesError struct {
+	Names []string
+}
+
+func (e *MissingVariablesError) Error() string {
+	return "missing required variables: " + strings.Join(e.Names, ", ")
+}
+
+var (
+	variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	placeholder  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+func (t *PromptTemplate) Assign() error {
+	id, err := NewID()
+	if err != nil {
+		return err
+	}
+	t.ID = id
+	t.CreatedAt = time.Now().UTC()
+	return nil
+}
+
+// Validate checks that the template has a name and content, and that every placeholder in its content is declared.
+func (t PromptTemplate) Validate() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return ErrTemplateNameRequired
+	}
+	if strings.TrimSpace(t.Content) == "" {
+		return ErrTemplateContentRequired
+	}
+	declared := map[string]bool{}
+	for _, v := range t.Variables {
+		if !variableName.MatchString(v.Name) {
+			return fmt.Errorf("%w: %q", ErrBadVariableName, v.Name)
+		}
+		if declared[v.Name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateVariable, v.Name)
+		}
+		declared[v.Name] = true
+	}
+	for _, match := range placeholder.FindAllStringSubmatch(t.Content, -1) {
+		if !declared[match[1]] {
+			return fmt.Errorf("%w: %s", ErrUndeclaredVariable, match[1])
+		}
+	}
+	return nil
+}
+
+// Render fills in the placeholders of the template with values, optional variables falling back to their default.
+func (t PromptTemplate) Render(values map[string]string) (string, error) {
+	resolved := map[string]string{}
+	var missing []string
+	for _, v := range t.Variables {
+		value, ok := values[v.Name]
+		switch {
+		case ok && strings.TrimSpace(value) != "":
+			resolved[v.Name] = value
+		case v.Required:
+			missing = append(missing, v.Name)
+		default:
+			resolved[v.Name] = v.Default
+		}
+	}
+	if len(missing) > 0 {
+		return "", &MissingVariablesError{Names: missing}
+	}
+	return placeholder.ReplaceAllStringFunc(t.Content, func(match string) string {
+		return resolved[placeholder.FindStringSubmatch(match)[1]]
+	}), nil
+}
+
+// BuiltInTemplates are the templates every user has. They can't be changed or deleted.
+var BuiltInTemplates = []PromptTemplate{
+	{
+		ID:        "builtin-textbook",
+		Name:      "교과서처럼 설명하기",
+		Content:   "다음 내용을 교과서처럼 정의, 핵심 개념, 예시 순서로 설명해 줘.\n\n{{topic}}",
+		Variables: []TemplateVariable{{Name: "topic", Required: true}},
+		IsBuiltIn: true,
+	},
+	{
+		ID:      "builtin-quiz",
+		Name:    "퀴즈 만들기",
+		Content: "{{topic}}에 대한 퀴즈 문제 {{count}}개를 만들어 줘. 문제마다 정답과 해설을 붙여 줘.",
+		Variables: []TemplateVariable{
+			{Name: "topic", Required: true},
+			{Name: "count", Default: "5"},
+		},
+		IsBuiltIn: true,
+	},
+	{
+		ID:      "builtin-summary",
+		Name:    "요약하기",
+		Content: "다음 글을 {{length}} 요약해 줘.\n\n{{text}}",
+		Variables: []TemplateVariable{
+			{Name: "text", Required: true},
+			{Name: "length", Default: "세 문장으로"},
+		},
+		IsBuiltIn: true,
+	},
+}
+
+// BuiltInTemplate returns the built-in template with id, if there is one.
+func BuiltInTemplate(id string) (PromptTemplate, bool) {
+	for _, t := range BuiltInTemplates {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return PromptTemplate{}, false
+}